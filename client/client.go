@@ -0,0 +1,710 @@
+// Package client is a client for the snapback protocol that is used to
+// list and export images from an exporter.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/certs"
+	"github.com/tobias-urdin/snapback/internal/filter"
+	"github.com/tobias-urdin/snapback/internal/message"
+	"github.com/tobias-urdin/snapback/internal/version"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// Errors returned by the exporter, use errors.Is to check for them
+var (
+	ErrNotFound = message.ErrNotFound
+	ErrPermissionDenied = message.ErrPermissionDenied
+	ErrBackendFailure = message.ErrBackendFailure
+	ErrProtocolViolation = message.ErrProtocolViolation
+	ErrBusy = message.ErrBusy
+	ErrInvalidFromSnapshot = message.ErrInvalidFromSnapshot
+	ErrInvalidResumeToken = message.ErrInvalidResumeToken
+	ErrCancelled = message.ErrCancelled
+)
+
+// The time between keep alives on an idle connection
+const keepAlivePeriod = 15 * time.Second
+
+// Returned when the exporter does not support a request
+var ErrNotSupported = errors.New("not supported by exporter")
+
+// Returned when the client is closed
+var ErrClosed = errors.New("client closed")
+
+// Returns true if an error from the exporter is temporary and the
+// request can be retried
+func IsRetryable(err error) bool {
+	var protoErr *message.Error
+	return errors.As(err, &protoErr) && protoErr.Retryable
+}
+
+// Client options
+type Options struct {
+	// The TLS config used to connect to the exporter, it must have the
+	// client certificate and a way to verify the exporter
+	TLS *tls.Config
+
+	// Logger, nothing is logged if it is nil
+	Logger *zap.Logger
+}
+
+// Client is a connection to an exporter, it is safe for concurrent use.
+// Listing requests is pipelined on a shared stream and each export is
+// done on its own stream. The connection is made again by the next
+// request if it is lost.
+type Client struct {
+	// Logger
+	logger *zap.Logger
+
+	// Message handler
+	handler *message.MessageHandler
+
+	// The address of the exporter
+	addr string
+
+	// The TLS config for the connection
+	tlsConfig *tls.Config
+
+	// Protects conn
+	connMu sync.Mutex
+
+	// Connection, it is replaced if it is lost
+	conn quic.Connection
+
+	// Protects the fields below
+	mu sync.Mutex
+
+	// The stream for listing requests, it is opened on first use
+	control *message.Dispatcher
+
+	// Set when the client is closed
+	closed bool
+}
+
+// Connect to the exporter at the address
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	if opts.TLS == nil {
+		return nil, errors.New("a TLS config is required")
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = zap.NewNop()
+	}
+
+	tlsConfig := opts.TLS.Clone()
+	if !slices.Contains(tlsConfig.NextProtos, certs.NextProto) {
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, certs.NextProto)
+	}
+
+	conn, err := dial(ctx, addr, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Client{
+		logger: logger,
+		handler: message.NewHandler(logger),
+		addr: addr,
+		tlsConfig: tlsConfig,
+		conn: conn,
+	}, nil
+}
+
+// Make a connection to the exporter
+func dial(ctx context.Context, addr string, tlsConfig *tls.Config) (quic.Connection, error) {
+	// NOTE: Keep alives is sent so the connection is not
+	// closed for being idle while waiting for events from a subscription.
+	quicConfig := &quic.Config{
+		KeepAlivePeriod: keepAlivePeriod,
+	}
+
+	conn, err := quic.DialAddr(ctx, addr, tlsConfig, quicConfig)
+	if err != nil {
+		return nil, fmt.Errorf("dial exporter %s: %w", addr, err)
+	}
+
+	return conn, nil
+}
+
+// Returns the connection to the exporter, a new connection is made if
+// the connection has been lost so requests can be made again
+func (c *Client) connection(ctx context.Context) (quic.Connection, error) {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.conn.Context().Err() == nil {
+		return c.conn, nil
+	}
+
+	c.logger.Info("connection to exporter lost, connecting again", zap.String("address", c.addr),
+		zap.NamedError("reason", context.Cause(c.conn.Context())))
+
+	conn, err := dial(ctx, c.addr, c.tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	c.conn = conn
+	return conn, nil
+}
+
+// Close the client and the connection
+func (c *Client) Close() error {
+	c.mu.Lock()
+	control := c.control
+	c.control = nil
+	c.closed = true
+	c.mu.Unlock()
+
+	if control != nil {
+		if err := control.Close(); err != nil {
+			c.logger.Warn("failed to close stream", zap.Error(err))
+		}
+	}
+
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	return c.conn.CloseWithError(0, "Goodbye")
+}
+
+// Returns the protocol capabilities of the client
+func capabilities() *message.Capabilities {
+	return &message.Capabilities{
+		SoftwareVersion: version.Version,
+		Messages: map[message.MessageType][]message.MessageVersion{
+			message.ErrorType: {1, 2},
+			message.ListPoolRequestType: {1, 2},
+			message.ListPoolResponseType: {1, 2},
+			message.ListSnapshotsRequestType: {1},
+			message.ListSnapshotsResponseType: {1, 2},
+			message.ExportRequestType: {1, 2, 3},
+			message.ExportResponseType: {1, 2},
+			message.ExportChunkType: {1, 2, 3},
+			message.ImageInfoRequestType: {1},
+			message.ImageInfoResponseType: {1, 2},
+			message.ListPoolsRequestType: {1},
+			message.ListPoolsResponseType: {1},
+			message.SubscribeRequestType: {1},
+			message.SubscribeResponseType: {1},
+			message.EventType: {1},
+			message.CancelExportType: {1},
+		},
+		// A peer that cannot list or export is refused at the handshake
+		Required: []message.MessageType{
+			message.ErrorType,
+			message.ListPoolRequestType,
+			message.ListPoolResponseType,
+			message.ListSnapshotsRequestType,
+			message.ListSnapshotsResponseType,
+			message.ExportRequestType,
+			message.ExportResponseType,
+			message.ExportChunkType,
+		},
+		Features: []message.Feature{
+			message.FeatureNamespaces,
+			message.FeatureResume,
+			message.FeatureCompression,
+		},
+		Codecs: message.Codecs,
+	}
+}
+
+// Open a new stream, do the handshake and return a dispatcher for it
+func (c *Client) openStream(ctx context.Context, logger *zap.Logger) (*message.Dispatcher, error) {
+	conn, err := c.connection(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger = logger.With(
+		zap.Any("stream", stream.StreamID()))
+
+	session, err := c.handler.Hello(stream, capabilities())
+	if err != nil {
+		stream.CancelRead(0)
+		stream.Close()
+		return nil, err
+	}
+
+	logger.Debug("stream opened", zap.String("peer_version", session.PeerVersion))
+
+	return message.NewDispatcher(logger, stream, session), nil
+}
+
+// Returns the dispatcher for the control stream, it is opened if it is
+// not open yet
+func (c *Client) controlStream(ctx context.Context) (*message.Dispatcher, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	if c.control != nil {
+		return c.control, nil
+	}
+
+	d, err := c.openStream(ctx, c.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	c.control = d
+	return d, nil
+}
+
+// Forget the control stream so the next request opens a new one
+func (c *Client) resetControl(d *message.Dispatcher) {
+	c.mu.Lock()
+	if c.control != d {
+		c.mu.Unlock()
+		return
+	}
+
+	c.control = nil
+	c.mu.Unlock()
+
+	d.Close()
+}
+
+// Send a request on the control stream and wait for the response
+func (c *Client) call(ctx context.Context, req message.MessageInterface, expected message.MessageType) (*message.Message, error) {
+	d, err := c.controlStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !d.Session().Supports(req.Type()) {
+		return nil, fmt.Errorf("%w: message type %d", ErrNotSupported, req.Type())
+	}
+
+	msg, err := d.Call(ctx, req, expected)
+	if err != nil {
+		// NOTE: Errors from the exporter is answers to the
+		// request, anything else means the stream cannot be used anymore.
+		var protoErr *message.Error
+		if !errors.As(err, &protoErr) && ctx.Err() == nil {
+			c.resetControl(d)
+		}
+
+		return nil, err
+	}
+
+	return msg, nil
+}
+
+// Returns an error if the image is in a namespace and the exporter does
+// not support namespaces
+func checkNamespace(session *message.Session, namespace string) error {
+	if namespace != "" && !session.HasFeature(message.FeatureNamespaces) {
+		return fmt.Errorf("%w: namespaces", ErrNotSupported)
+	}
+
+	return nil
+}
+
+// Addresses an image on the exporter
+type ImageSpec struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// The image name
+	Image string
+}
+
+// Returns the image spec as pool/image, or pool/namespace/image if the
+// image is in a namespace
+func (s ImageSpec) String() string {
+	if s.Namespace != "" {
+		return fmt.Sprintf("%s/%s/%s", s.Pool, s.Namespace, s.Image)
+	}
+
+	return fmt.Sprintf("%s/%s", s.Pool, s.Image)
+}
+
+// A pool on the exporter
+type Pool struct {
+	// The pool name
+	Name string
+
+	// The RBD namespaces in the pool that the client can access, the
+	// default namespace is the empty string
+	Namespaces []string
+}
+
+// List the pools with images that the client can access
+func (c *Client) ListPools(ctx context.Context) ([]Pool, error) {
+	msg, err := c.call(ctx, &message.ListPoolsRequestV1{}, message.ListPoolsResponseType)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp message.ListPoolsResponseV1
+	if err := msg.Unmarshal(&resp); err != nil {
+		return nil, err
+	}
+
+	pools := make([]Pool, 0, len(resp.Pools))
+	for _, pool := range resp.Pools {
+		pools = append(pools, Pool{
+			Name: pool.Name,
+			Namespaces: pool.Namespaces,
+		})
+	}
+
+	return pools, nil
+}
+
+// Request to list the images in a pool
+type ListImagesRequest struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// Only images that matches the glob is listed
+	Glob string
+
+	// Only images that matches the regular expression is listed, only
+	// one of Glob and Regex can be set
+	Regex string
+
+	// The maximum number of images in each page, zero lets the exporter
+	// decide
+	PageSize uint32
+}
+
+// List a page of the images in a pool ordered by name. The token is
+// empty for the first page and the token that is returned is used to get
+// the next page, it is empty after the last page.
+func (c *Client) ListImagesPage(ctx context.Context, req *ListImagesRequest, token string) ([]string, string, error) {
+	d, err := c.controlStream(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if d.Session().Version(message.ListPoolRequestType) < 2 {
+		return c.listImagesV1(ctx, req, token)
+	}
+
+	msg, err := c.call(ctx, &message.ListPoolRequestV2{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Glob: req.Glob,
+		Regex: req.Regex,
+		PageToken: token,
+		Limit: req.PageSize,
+	}, message.ListPoolResponseType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resp message.ListPoolResponseV2
+	if err := msg.Unmarshal(&resp); err != nil {
+		return nil, "", err
+	}
+
+	return resp.Names, resp.NextPageToken, nil
+}
+
+// List the images with version 1 of the request that has no namespaces
+// or pages, the filter is applied by the client
+func (c *Client) listImagesV1(ctx context.Context, req *ListImagesRequest, token string) ([]string, string, error) {
+	if req.Namespace != "" {
+		return nil, "", fmt.Errorf("%w: namespaces", ErrNotSupported)
+	}
+
+	if token != "" {
+		return nil, "", fmt.Errorf("%w: page tokens", ErrNotSupported)
+	}
+
+	match, err := filter.Images(req.Glob, req.Regex)
+	if err != nil {
+		return nil, "", err
+	}
+
+	msg, err := c.call(ctx, &message.ListPoolRequestV1{
+		Pool: req.Pool,
+	}, message.ListPoolResponseType)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var resp message.ListPoolResponseV1
+	if err := msg.Unmarshal(&resp); err != nil {
+		return nil, "", err
+	}
+
+	names := make([]string, 0, len(resp.Names))
+	for _, name := range resp.Names {
+		if match(name) {
+			names = append(names, name)
+		}
+	}
+
+	slices.Sort(names)
+
+	return names, "", nil
+}
+
+// List all images in a pool that matches the request ordered by name,
+// the pages is requested until the last one
+func (c *Client) ListImages(ctx context.Context, req *ListImagesRequest) ([]string, error) {
+	var names []string
+
+	token := ""
+	for {
+		page, next, err := c.ListImagesPage(ctx, req, token)
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, page...)
+
+		if next == "" {
+			return names, nil
+		}
+
+		token = next
+	}
+}
+
+// A snapshot of an image
+type Snapshot struct {
+	// The snapshot ID, a newer snapshot always has a higher ID
+	ID uint64
+
+	// The snapshot name
+	Name string
+
+	// The size of the image when the snapshot was taken
+	Size uint64
+
+	// When the snapshot was created
+	Timestamp time.Time
+
+	// If the snapshot is protected
+	Protected bool
+
+	// The snapshot namespace, user, group, trash or mirror
+	Namespace string
+}
+
+// List the snapshots of an image ordered by their ID. Only the name is
+// set if the exporter does not support version 2 of the response.
+func (c *Client) ListSnapshots(ctx context.Context, spec ImageSpec) ([]Snapshot, error) {
+	d, err := c.controlStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkNamespace(d.Session(), spec.Namespace); err != nil {
+		return nil, err
+	}
+
+	req := message.ListSnapshotsRequestV1{
+		Pool: spec.Pool,
+		Namespace: spec.Namespace,
+		Image: spec.Image,
+	}
+
+	msg, err := c.call(ctx, &req, message.ListSnapshotsResponseType)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Header.Version >= 2 {
+		var resp message.ListSnapshotsResponseV2
+		if err := msg.Unmarshal(&resp); err != nil {
+			return nil, err
+		}
+
+		snaps := make([]Snapshot, 0, len(resp.Snapshots))
+		for _, snap := range resp.Snapshots {
+			snaps = append(snaps, Snapshot{
+				ID: snap.ID,
+				Name: snap.Name,
+				Size: snap.Size,
+				Timestamp: snap.Timestamp,
+				Protected: snap.Protected,
+				Namespace: snap.Namespace,
+			})
+		}
+
+		return snaps, nil
+	}
+
+	var resp message.ListSnapshotsResponseV1
+	if err := msg.Unmarshal(&resp); err != nil {
+		return nil, err
+	}
+
+	snaps := make([]Snapshot, 0, len(resp.Snapshots))
+	for _, name := range resp.Snapshots {
+		// NOTE: Older exporters sent empty names first
+		if name == "" {
+			continue
+		}
+
+		snaps = append(snaps, Snapshot{
+			Name: name,
+		})
+	}
+
+	return snaps, nil
+}
+
+// The parent of a cloned image
+type ImageParent struct {
+	// The pool name
+	Pool string
+
+	// The namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// The image name
+	Image string
+
+	// The snapshot the image was cloned from
+	Snapshot string
+}
+
+// Information about an image, only the size is set if the exporter does
+// not support version 2 of the response
+type ImageInfo struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool
+	Namespace string
+
+	// The image name
+	Image string
+
+	// The snapshot, empty for the image head
+	Snapshot string
+
+	// The size of the image in bytes
+	Size uint64
+
+	// The objects of the image is 1 << Order bytes
+	Order uint8
+
+	// The size of the objects of the image
+	ObjectSize uint64
+
+	// The names of the enabled features
+	Features []string
+
+	// The stripe unit in bytes
+	StripeUnit uint64
+
+	// The number of objects that is striped over
+	StripeCount uint64
+
+	// The pool that data is stored in, empty if it is the image pool
+	DataPool string
+
+	// The parent the image was cloned from, nil if it is not a clone
+	Parent *ImageParent
+
+	// The image-meta key/value pairs
+	Metadata map[string]string
+
+	// When the image was created
+	CreateTimestamp time.Time
+}
+
+// Get information about an image at a snapshot, or the image head if
+// the snapshot is empty
+func (c *Client) ImageInfo(ctx context.Context, spec ImageSpec, snapshot string) (*ImageInfo, error) {
+	d, err := c.controlStream(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkNamespace(d.Session(), spec.Namespace); err != nil {
+		return nil, err
+	}
+
+	req := message.ImageInfoRequestV1{
+		Pool: spec.Pool,
+		Namespace: spec.Namespace,
+		Image: spec.Image,
+		Snapshot: snapshot,
+	}
+
+	msg, err := c.call(ctx, &req, message.ImageInfoResponseType)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Header.Version >= 2 {
+		var resp message.ImageInfoResponseV2
+		if err := msg.Unmarshal(&resp); err != nil {
+			return nil, err
+		}
+
+		info := &ImageInfo{
+			Pool: resp.Pool,
+			Namespace: resp.Namespace,
+			Image: resp.Image,
+			Snapshot: resp.Snapshot,
+			Size: resp.Size,
+			Order: resp.Order,
+			ObjectSize: resp.ObjectSize,
+			Features: resp.Features,
+			StripeUnit: resp.StripeUnit,
+			StripeCount: resp.StripeCount,
+			DataPool: resp.DataPool,
+			Metadata: resp.Metadata,
+			CreateTimestamp: resp.CreateTimestamp,
+		}
+
+		if resp.Parent != nil {
+			info.Parent = &ImageParent{
+				Pool: resp.Parent.Pool,
+				Namespace: resp.Parent.Namespace,
+				Image: resp.Parent.Image,
+				Snapshot: resp.Parent.Snapshot,
+			}
+		}
+
+		return info, nil
+	}
+
+	var resp message.ImageInfoResponseV1
+	if err := msg.Unmarshal(&resp); err != nil {
+		return nil, err
+	}
+
+	return &ImageInfo{
+		Pool: resp.Pool,
+		Namespace: resp.Namespace,
+		Image: resp.Image,
+		Snapshot: resp.Snapshot,
+		Size: resp.Size,
+	}, nil
+}
@@ -0,0 +1,348 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/tobias-urdin/snapback/internal/message"
+
+	"go.uber.org/zap"
+)
+
+// Returned when the digest, size or number of chunks of an export does
+// not match what the exporter sent
+var ErrDigestMismatch = errors.New("export digest mismatch")
+
+// Export request
+type ExportRequest struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// The image name
+	Image string
+
+	// The snapshot to export
+	Snapshot string
+
+	// The snapshot the export starts from, only the changes between this
+	// snapshot and Snapshot is exported. Empty means a full export.
+	FromSnapshot string
+
+	// The resume token of an export that was interrupted, the export is
+	// resumed at Offset. Empty for a new export.
+	ResumeToken string
+
+	// The offset in the diff the export is resumed at, the diff that is
+	// read starts at this offset
+	Offset uint64
+
+	// The state of the SHA-256 digest of the diff before Offset from its
+	// MarshalBinary, the digest of the whole diff is verified with it. The
+	// digest is not verified when an export is resumed without it.
+	DigestState []byte
+}
+
+// The diff of an export as it is read from the stream
+type ExportReader struct {
+	// The chunk payloads is written to the pipe
+	pr *io.PipeReader
+
+	// Cancels the export
+	cancel context.CancelFunc
+
+	// Closed when the export has stopped
+	done chan struct{}
+
+	// Protects token
+	mu sync.Mutex
+
+	// The resume token from the exporter
+	token string
+}
+
+// Read the diff, the error from the exporter is returned when the
+// export fails and io.EOF once the exporter has confirmed the export
+func (r *ExportReader) Read(p []byte) (int, error) {
+	return r.pr.Read(p)
+}
+
+// Close the reader, an export that has not finished is cancelled
+func (r *ExportReader) Close() error {
+	r.pr.Close()
+	r.cancel()
+	<-r.done
+
+	return nil
+}
+
+// Returns the token that an interrupted export can be resumed with, it
+// is empty if the export cannot be resumed. It is set once any of the
+// diff has been read.
+func (r *ExportReader) ResumeToken() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.token
+}
+
+// Set the resume token
+func (r *ExportReader) setToken(token string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.token = token
+}
+
+// Build the export request for the negotiated version
+func exportMessage(session *message.Session, req *ExportRequest) (message.MessageInterface, error) {
+	if err := checkNamespace(session, req.Namespace); err != nil {
+		return nil, err
+	}
+
+	if session.Version(message.ExportRequestType) >= 3 && session.HasFeature(message.FeatureResume) {
+		return &message.ExportRequestV3{
+			Pool: req.Pool,
+			Namespace: req.Namespace,
+			Image: req.Image,
+			Snapshot: req.Snapshot,
+			FromSnapshot: req.FromSnapshot,
+			ResumeToken: req.ResumeToken,
+			Offset: req.Offset,
+		}, nil
+	}
+
+	if req.ResumeToken != "" || req.Offset != 0 {
+		return nil, fmt.Errorf("%w: resume", ErrNotSupported)
+	}
+
+	if session.Version(message.ExportRequestType) >= 2 {
+		return &message.ExportRequestV2{
+			Pool: req.Pool,
+			Namespace: req.Namespace,
+			Image: req.Image,
+			Snapshot: req.Snapshot,
+			FromSnapshot: req.FromSnapshot,
+		}, nil
+	}
+
+	if req.FromSnapshot != "" {
+		return nil, fmt.Errorf("%w: incremental export", ErrNotSupported)
+	}
+
+	return &message.ExportRequestV1{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+		Snapshot: req.Snapshot,
+	}, nil
+}
+
+// Export a snapshot of an image on its own stream. The returned reader
+// has the diff in the rbd export-diff format, the CRC of each chunk is
+// verified before it can be read. If the exporter sends the digest of the
+// diff it is verified when the end of the diff is read, the reader returns
+// ErrDigestMismatch instead of io.EOF if it does not match. The reader must
+// be closed, closing it before the end of the diff cancels the export.
+func (c *Client) Export(ctx context.Context, req *ExportRequest) (*ExportReader, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return nil, ErrClosed
+	}
+
+	logger := c.logger.With(
+		zap.String("pool", req.Pool),
+		zap.String("namespace", req.Namespace),
+		zap.String("image", req.Image),
+		zap.String("snapshot", req.Snapshot),
+		zap.String("from_snapshot", req.FromSnapshot))
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	d, err := c.openStream(ctx, logger)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	msg, err := exportMessage(d.Session(), req)
+	if err != nil {
+		d.Close()
+		cancel()
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	r := &ExportReader{
+		pr: pr,
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(r.done)
+		defer cancel()
+
+		err := c.export(ctx, logger, d, msg, req.Offset, req.DigestState, r, pw)
+		pw.CloseWithError(err)
+
+		if err := d.Close(); err != nil {
+			logger.Warn("failed to close stream", zap.Error(err))
+		}
+	}()
+
+	return r, nil
+}
+
+// Returns the chunk in the message as a version 3 chunk with the payload
+// decompressed. Version 1 chunks has no sequence number and offset.
+func decodeChunk(msg *message.Message) (*message.ExportChunkV3, error) {
+	switch msg.Header.Version {
+	case 1:
+		var chunk message.ExportChunkV1
+		if err := msg.Unmarshal(&chunk); err != nil {
+			return nil, err
+		}
+
+		return &message.ExportChunkV3{
+			Payload: chunk.Payload,
+			PayloadCRC: chunk.PayloadCRC,
+		}, nil
+	case 2:
+		var chunk message.ExportChunkV2
+		if err := msg.Unmarshal(&chunk); err != nil {
+			return nil, err
+		}
+
+		return &message.ExportChunkV3{
+			Payload: chunk.Payload,
+			PayloadCRC: chunk.PayloadCRC,
+			Sequence: chunk.Sequence,
+			Offset: chunk.Offset,
+			ResumeToken: chunk.ResumeToken,
+		}, nil
+	}
+
+	var chunk message.ExportChunkV3
+	if err := msg.Unmarshal(&chunk); err != nil {
+		return nil, err
+	}
+
+	if chunk.Codec != message.CodecNone {
+		payload, err := message.Decompress(chunk.Codec, chunk.Payload, chunk.Size)
+		if err != nil {
+			return nil, message.NewError(message.ErrorCodeProtocolViolation, "export chunk %d cannot be decompressed: %s",
+				chunk.Sequence, err)
+		}
+
+		chunk.Payload = payload
+	}
+
+	return &chunk, nil
+}
+
+// Send the export request and write the chunks to w until the response,
+// the diff starts at the offset and the digest continues from the state
+func (c *Client) export(ctx context.Context, logger *zap.Logger, d *message.Dispatcher, req message.MessageInterface, offset uint64, state []byte, r *ExportReader, w io.Writer) error {
+	table := crc32.MakeTable(crc32.Castagnoli)
+	digest := sha256.New()
+	start := offset
+
+	if state != nil {
+		if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state); err != nil {
+			return fmt.Errorf("invalid digest state: %w", err)
+		}
+	}
+
+	var sequence uint64
+
+	cb := func(msg *message.Message) error {
+		chunk, err := decodeChunk(msg)
+		if err != nil {
+			return err
+		}
+
+		if msg.Header.Version >= 2 {
+			if chunk.Sequence != sequence {
+				return message.NewError(message.ErrorCodeProtocolViolation, "export chunk out of order, got sequence %d expected %d",
+					chunk.Sequence, sequence)
+			}
+
+			if chunk.Offset != offset {
+				return message.NewError(message.ErrorCodeProtocolViolation, "export chunk at wrong offset, got %d expected %d",
+					chunk.Offset, offset)
+			}
+		}
+
+		// NOTE: The CRC is of the payload before it was compressed so it
+		// also covers the decompression.
+		if sum := crc32.Checksum(chunk.Payload, table); sum != chunk.PayloadCRC {
+			return fmt.Errorf("export chunk crc mismatch, got %d expected %d", sum, chunk.PayloadCRC)
+		}
+
+		if chunk.ResumeToken != "" {
+			r.setToken(chunk.ResumeToken)
+		}
+
+		digest.Write(chunk.Payload)
+		sequence++
+		offset += uint64(len(chunk.Payload))
+
+		_, err = w.Write(chunk.Payload)
+		return err
+	}
+
+	rawResp, err := d.CallChunks(ctx, req, cb)
+	if err != nil {
+		return err
+	}
+
+	if rawResp.Header.Version < 2 {
+		var resp message.ExportResponseV1
+		if err := rawResp.Unmarshal(&resp); err != nil {
+			return err
+		}
+
+		logger.Debug("got export response", zap.Any("msg", resp))
+		return nil
+	}
+
+	var resp message.ExportResponseV2
+	if err := rawResp.Unmarshal(&resp); err != nil {
+		return err
+	}
+
+	logger.Debug("got export response", zap.String("digest", hex.EncodeToString(resp.Digest)),
+		zap.Uint64("bytes", resp.Bytes), zap.Uint64("chunks", resp.Chunks), zap.Uint64("offset", resp.Offset))
+
+	switch {
+	case resp.Offset != start:
+		return fmt.Errorf("%w: export started at offset %d, expected %d", ErrDigestMismatch, resp.Offset, start)
+	case resp.Bytes != offset:
+		return fmt.Errorf("%w: diff has %d bytes, exporter sent %d", ErrDigestMismatch, offset, resp.Bytes)
+	case resp.Chunks != sequence:
+		return fmt.Errorf("%w: got %d chunks, exporter sent %d", ErrDigestMismatch, sequence, resp.Chunks)
+	case start > 0 && state == nil:
+		logger.Debug("export was resumed without a digest state, not verifying the digest")
+		return nil
+	}
+
+	if sum := digest.Sum(nil); !bytes.Equal(sum, resp.Digest) {
+		return fmt.Errorf("%w: got %s, exporter sent %s", ErrDigestMismatch, hex.EncodeToString(sum), hex.EncodeToString(resp.Digest))
+	}
+
+	return nil
+}
@@ -0,0 +1,221 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/message"
+
+	"go.uber.org/zap"
+)
+
+// The kind of change an event is for
+type EventKind = message.EventKind
+
+// The kinds of events
+const (
+	EventSnapshotCreated = message.EventSnapshotCreated
+	EventSnapshotRemoved = message.EventSnapshotRemoved
+	EventImageRemoved = message.EventImageRemoved
+)
+
+// What to get events for, an image or all images in a namespace of a
+// pool if Image is empty
+type SubscribeTarget struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// The image name, empty for all images in the namespace
+	Image string
+}
+
+// A change on the exporter
+type Event struct {
+	// The kind of change
+	Kind EventKind
+
+	// The image that changed
+	Image ImageSpec
+
+	// The snapshot name, empty for image events
+	Snapshot string
+
+	// The snapshot ID, zero for image events
+	SnapshotID uint64
+}
+
+// A subscription to events from the exporter
+type Subscription struct {
+	// The events
+	events chan Event
+
+	// How often the exporter checks for changes
+	interval time.Duration
+
+	// Cancels the subscription
+	cancel context.CancelFunc
+
+	// Protects err
+	mu sync.Mutex
+
+	// The error that ended the subscription
+	err error
+
+	// Closed when the subscription has ended
+	done chan struct{}
+}
+
+// Returns the channel the events is delivered on, it is closed when the
+// subscription ends
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Returns how often the exporter checks for changes, changes is seen
+// at most this long after they happened
+func (s *Subscription) Interval() time.Duration {
+	return s.interval
+}
+
+// Returns the error that ended the subscription, it is nil until the
+// events channel is closed and if the subscription was closed
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+// Close the subscription
+func (s *Subscription) Close() error {
+	s.cancel()
+	<-s.done
+
+	return nil
+}
+
+// Subscribe to events for the targets, the events is sent on a stream of
+// its own for as long as the subscription is open. The subscription must
+// be closed.
+func (c *Client) Subscribe(ctx context.Context, targets []SubscribeTarget) (*Subscription, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+
+	if closed {
+		return nil, ErrClosed
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+
+	d, err := c.openStream(ctx, c.logger)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	req := message.SubscribeRequestV1{
+		Subscriptions: make([]message.SubscriptionV1, 0, len(targets)),
+	}
+
+	for _, target := range targets {
+		if err := checkNamespace(d.Session(), target.Namespace); err != nil {
+			d.Close()
+			cancel()
+			return nil, err
+		}
+
+		req.Subscriptions = append(req.Subscriptions, message.SubscriptionV1{
+			Pool: target.Pool,
+			Namespace: target.Namespace,
+			Image: target.Image,
+		})
+	}
+
+	if !d.Session().Supports(req.Type()) {
+		d.Close()
+		cancel()
+		return nil, fmt.Errorf("%w: message type %d", ErrNotSupported, req.Type())
+	}
+
+	s := &Subscription{
+		events: make(chan Event),
+		cancel: cancel,
+		done: make(chan struct{}),
+	}
+
+	// The first message is the response, the result of it is passed on
+	// so the error can be returned from here
+	started := make(chan error, 1)
+	first := true
+
+	cb := func(msg *message.Message) error {
+		if first {
+			first = false
+
+			var resp message.SubscribeResponseV1
+			if err := msg.Unmarshal(&resp); err != nil {
+				return err
+			}
+
+			s.interval = time.Duration(resp.Interval) * time.Second
+			started <- nil
+			return nil
+		}
+
+		var event message.EventV1
+		if err := msg.Unmarshal(&event); err != nil {
+			return err
+		}
+
+		select {
+		case s.events <- Event{
+			Kind: event.Kind,
+			Image: ImageSpec{
+				Pool: event.Pool,
+				Namespace: event.Namespace,
+				Image: event.Image,
+			},
+			Snapshot: event.Snapshot,
+			SnapshotID: event.SnapshotID,
+		}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+
+		return nil
+	}
+
+	go func() {
+		defer close(s.done)
+		defer close(s.events)
+		defer cancel()
+
+		err := d.CallEvents(ctx, &req, message.SubscribeResponseType, cb)
+
+		if first {
+			// The subscription failed before the response
+			started <- err
+		} else if ctx.Err() == nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+		}
+
+		if err := d.Close(); err != nil {
+			c.logger.Warn("failed to close stream", zap.Error(err))
+		}
+	}()
+
+	if err := <-started; err != nil {
+		<-s.done
+		return nil, err
+	}
+
+	return s, nil
+}
@@ -0,0 +1,249 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// Returned when a pool, image or snapshot does not exist
+	ErrNotFound = errors.New("not found")
+
+	// Returned when the backend is not allowed to access something
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+// Addresses an image in a pool
+type ImageSpec struct {
+	// The pool name
+	Pool string
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string
+
+	// The image name
+	Image string
+}
+
+// Returns the image spec as pool/image, or pool/namespace/image if the
+// image is in a namespace
+func (s ImageSpec) String() string {
+	if s.Namespace != "" {
+		return fmt.Sprintf("%s/%s/%s", s.Pool, s.Namespace, s.Image)
+	}
+
+	return fmt.Sprintf("%s/%s", s.Pool, s.Image)
+}
+
+// A pool with images
+type Pool struct {
+	// The pool name
+	Name string
+
+	// The RBD namespaces in the pool, the default namespace is not listed
+	Namespaces []string
+}
+
+// A snapshot of an image
+type Snapshot struct {
+	// The snapshot ID, a newer snapshot always has a higher ID
+	ID uint64
+
+	// The snapshot name
+	Name string
+
+	// The size of the image when the snapshot was taken
+	Size uint64
+
+	// When the snapshot was created
+	Timestamp time.Time
+
+	// If the snapshot is protected
+	Protected bool
+
+	// The namespace of the snapshot
+	Namespace SnapshotNamespace
+}
+
+// The namespace of a snapshot, only user snapshots is created by users,
+// the others is created by rbd for mirroring, groups or the trash
+type SnapshotNamespace string
+
+// The snapshot namespaces
+const (
+	SnapshotNamespaceUser SnapshotNamespace = "user"
+	SnapshotNamespaceGroup SnapshotNamespace = "group"
+	SnapshotNamespaceTrash SnapshotNamespace = "trash"
+	SnapshotNamespaceMirror SnapshotNamespace = "mirror"
+	SnapshotNamespaceUnknown SnapshotNamespace = "unknown"
+)
+
+// The parent of a cloned image
+type ParentSpec struct {
+	// The pool name
+	Pool string `json:"pool"`
+
+	// The namespace in the pool, empty for the default namespace
+	Namespace string `json:"namespace,omitempty"`
+
+	// The image name
+	Image string `json:"image"`
+
+	// The snapshot the image was cloned from
+	Snapshot string `json:"snapshot"`
+}
+
+// Returns the parent as pool/image@snapshot
+func (p ParentSpec) String() string {
+	if p.Namespace != "" {
+		return fmt.Sprintf("%s/%s/%s@%s", p.Pool, p.Namespace, p.Image, p.Snapshot)
+	}
+
+	return fmt.Sprintf("%s/%s@%s", p.Pool, p.Image, p.Snapshot)
+}
+
+// Information about an image, the layout fields is zero when the backend
+// does not know them and the defaults of the destination is used instead
+type ImageInfo struct {
+	// The size of the image
+	Size uint64 `json:"size"`
+
+	// The objects of the image is 1 << Order bytes
+	Order uint8 `json:"order,omitempty"`
+
+	// The size of the objects of the image
+	ObjectSize uint64 `json:"object_size,omitempty"`
+
+	// The names of the enabled features
+	Features []string `json:"features,omitempty"`
+
+	// The stripe unit in bytes
+	StripeUnit uint64 `json:"stripe_unit,omitempty"`
+
+	// The number of objects that is striped over
+	StripeCount uint64 `json:"stripe_count,omitempty"`
+
+	// The pool that data is stored in, empty if it is the image pool
+	DataPool string `json:"data_pool,omitempty"`
+
+	// The parent the image was cloned from, nil if it is not a clone
+	Parent *ParentSpec `json:"parent,omitempty"`
+
+	// The image-meta key/value pairs
+	Metadata map[string]string `json:"metadata,omitempty"`
+
+	// When the image was created
+	CreateTimestamp time.Time `json:"create_timestamp"`
+}
+
+// The request for a diff
+type DiffRequest struct {
+	// The image
+	Image ImageSpec
+
+	// The snapshot the diff ends at, empty for the image head
+	Snapshot string
+
+	// The snapshot the diff starts from, empty for a full diff
+	FromSnapshot string
+
+	// Called with the offset that has been reached, can be nil
+	Progress func(offset uint64, size uint64)
+}
+
+// Statistics for a diff that was streamed
+type DiffStats struct {
+	// The size of the image
+	Size uint64
+
+	// The number of extents in the diff
+	Extents uint64
+
+	// The number of bytes of data in the diff
+	Written uint64
+
+	// The number of bytes that was zeroed in the diff
+	Zeroed uint64
+}
+
+// Backend is the storage that images is exported from
+type Backend interface {
+	// List the pools that can have images and their namespaces
+	ListPools(ctx context.Context) ([]Pool, error)
+
+	// List the images in a namespace of a pool, an empty namespace is
+	// the default namespace
+	ListImages(ctx context.Context, pool string, namespace string) ([]string, error)
+
+	// List the snapshots of an image ordered by their ID
+	ListSnapshots(ctx context.Context, spec ImageSpec) ([]Snapshot, error)
+
+	// List the snapshots of an image ordered by their ID with only the ID,
+	// name and namespace set, it is cheaper than ListSnapshots
+	ListSnapshotNames(ctx context.Context, spec ImageSpec) ([]Snapshot, error)
+
+	// Get information about an image, or a snapshot of it if snapshot is set
+	ImageInfo(ctx context.Context, spec ImageSpec, snapshot string) (*ImageInfo, error)
+
+	// Write the diff in the rbd export-diff format to w
+	ExportDiff(ctx context.Context, req *DiffRequest, w io.Writer) (*DiffStats, error)
+
+	// Close the backend
+	Close() error
+}
+
+// Image that is open for writing
+type Image interface {
+	// Write data at an offset
+	WriteAt(p []byte, off int64) (int, error)
+
+	// Zero a range
+	Zero(offset uint64, length uint64) error
+
+	// Returns the size of the image
+	Size() (uint64, error)
+
+	// Resize the image
+	Resize(size uint64) error
+
+	// Flush the writes to the image to storage
+	Flush() error
+
+	// Store the checkpoint of an import that is in progress alongside
+	// the image, it replaces the checkpoint that was stored before
+	SaveCheckpoint(data []byte) error
+
+	// Close the image
+	Close() error
+}
+
+// Destination is the storage that images is imported to
+type Destination interface {
+	// List the snapshots of an image ordered by their ID
+	ListSnapshots(ctx context.Context, spec ImageSpec) ([]Snapshot, error)
+
+	// Open an image for writing, it is created with the size if it does not exist
+	OpenImage(ctx context.Context, spec ImageSpec, size uint64) (Image, error)
+
+	// Create an image with the size and layout in info
+	CreateImage(ctx context.Context, spec ImageSpec, info *ImageInfo) error
+
+	// Store the image info alongside the image, the image must exist
+	SaveImageInfo(ctx context.Context, spec ImageSpec, info *ImageInfo) error
+
+	// Create a snapshot of an image
+	CreateSnapshot(ctx context.Context, spec ImageSpec, name string) error
+
+	// Returns the checkpoint that was stored alongside the image, nil if
+	// there is none or the image does not exist
+	LoadCheckpoint(ctx context.Context, spec ImageSpec) ([]byte, error)
+
+	// Remove the checkpoint that was stored alongside the image
+	RemoveCheckpoint(ctx context.Context, spec ImageSpec) error
+
+	// Close the destination
+	Close() error
+}
@@ -0,0 +1,523 @@
+package ceph
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/diff"
+
+	"go.uber.org/zap"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/ceph/go-ceph/rbd"
+)
+
+// The maximum number of bytes that is read from an image at once
+const diffReadSize = 4 * 1024 * 1024
+
+// NOTE: go-ceph has no constant for the mirror snapshot
+// namespace, this is RBD_SNAP_NAMESPACE_TYPE_MIRROR from librbd.
+const snapNamespaceTypeMirror = rbd.SnapNamespaceType(3)
+
+// Returns the backend namespace for a snapshot namespace type
+func snapshotNamespace(t rbd.SnapNamespaceType) backend.SnapshotNamespace {
+	switch t {
+	case rbd.SnapNamespaceTypeUser:
+		return backend.SnapshotNamespaceUser
+	case rbd.SnapNamespaceTypeGroup:
+		return backend.SnapshotNamespaceGroup
+	case rbd.SnapNamespaceTypeTrash:
+		return backend.SnapshotNamespaceTrash
+	case snapNamespaceTypeMirror:
+		return backend.SnapshotNamespaceMirror
+	}
+
+	return backend.SnapshotNamespaceUnknown
+}
+
+// Backend that exports RBD images from a Ceph cluster
+type Backend struct {
+	// Logger
+	logger *zap.Logger
+
+	// Rados
+	conn *rados.Conn
+}
+
+// Options for the connection to the Ceph cluster
+type Options struct {
+	// Path to the Ceph config file, the default locations is searched
+	// if it is empty
+	ConfigFile string
+
+	// The cephx user without the client. prefix
+	User string
+
+	// Path to the keyring for the cephx user, the keyring in the
+	// config file is used if it is empty
+	Keyring string
+
+	// The name of the cluster
+	Cluster string
+}
+
+// Returns a new Backend that is connected to the Ceph cluster
+func New(logger *zap.Logger, opts Options) (*Backend, error) {
+	logger.Info("connecting to rados", zap.String("cluster", opts.Cluster), zap.String("user", opts.User))
+
+	conn, err := rados.NewConnWithClusterAndUser(opts.Cluster, "client."+opts.User)
+	if err != nil {
+		return nil, fmt.Errorf("create rados connection: %w", err)
+	}
+
+	if opts.ConfigFile != "" {
+		err = conn.ReadConfigFile(opts.ConfigFile)
+	} else {
+		err = conn.ReadDefaultConfigFile()
+	}
+	if err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("read ceph config: %w", err)
+	}
+
+	if opts.Keyring != "" {
+		if err := conn.SetConfigOption("keyring", opts.Keyring); err != nil {
+			conn.Shutdown()
+			return nil, fmt.Errorf("set keyring %s: %w", opts.Keyring, err)
+		}
+	}
+
+	if err := conn.Connect(); err != nil {
+		conn.Shutdown()
+		return nil, fmt.Errorf("connect to ceph cluster %s as client.%s: %w", opts.Cluster, opts.User, err)
+	}
+
+	return &Backend{
+		logger: logger,
+		conn: conn,
+	}, nil
+}
+
+// Close the connection to the Ceph cluster
+func (b *Backend) Close() error {
+	b.conn.Shutdown()
+	return nil
+}
+
+// Returns the backend error for an error from Ceph
+func cephError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+
+	switch {
+	case errors.Is(err, rados.ErrNotFound), errors.Is(err, rbd.ErrNotFound):
+		return fmt.Errorf("%s: %w: %w", msg, backend.ErrNotFound, err)
+	case errors.Is(err, rados.ErrPermissionDenied):
+		return fmt.Errorf("%s: %w: %w", msg, backend.ErrPermissionDenied, err)
+	}
+
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// Open an IO context for a namespace in a pool
+func (b *Backend) openIOContext(pool string, namespace string) (*rados.IOContext, error) {
+	ioctx, err := b.conn.OpenIOContext(pool)
+	if err != nil {
+		return nil, cephError(err, "open pool %s", pool)
+	}
+
+	ioctx.SetNamespace(namespace)
+
+	return ioctx, nil
+}
+
+// Open an image read-only at the snapshot, the returned func must be
+// called to close the image.
+func (b *Backend) openImage(spec backend.ImageSpec, snapshot string) (*rbd.Image, func(), error) {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	image, err := rbd.OpenImageReadOnly(ioctx, spec.Image, snapshot)
+	if err != nil {
+		ioctx.Destroy()
+		return nil, nil, cephError(err, "open image %s", spec)
+	}
+
+	closeFunc := func() {
+		image.Close()
+		ioctx.Destroy()
+	}
+
+	return image, closeFunc, nil
+}
+
+// A pool in the output of the osd pool ls command
+type monPool struct {
+	// The pool name
+	Name string `json:"pool_name"`
+
+	// The applications enabled on the pool
+	Applications map[string]json.RawMessage `json:"application_metadata"`
+}
+
+// List the pools with the rbd application enabled and their namespaces
+func (b *Backend) ListPools(ctx context.Context) ([]backend.Pool, error) {
+	// NOTE: go-ceph cannot read the applications of a pool
+	// so the monitors is asked for the details of all pools instead.
+	cmd, err := json.Marshal(map[string]string{
+		"prefix": "osd pool ls",
+		"detail": "detail",
+		"format": "json",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	out, status, err := b.conn.MonCommand(cmd)
+	if err != nil {
+		return nil, cephError(err, "list pools: %s", status)
+	}
+
+	var monPools []monPool
+	if err := json.Unmarshal(out, &monPools); err != nil {
+		return nil, fmt.Errorf("list pools: %w", err)
+	}
+
+	pools := make([]backend.Pool, 0, len(monPools))
+	for _, p := range monPools {
+		if _, ok := p.Applications["rbd"]; !ok {
+			continue
+		}
+
+		ioctx, err := b.openIOContext(p.Name, "")
+		if err != nil {
+			return nil, err
+		}
+
+		namespaces, err := rbd.NamespaceList(ioctx)
+		ioctx.Destroy()
+		if err != nil {
+			return nil, cephError(err, "list namespaces in pool %s", p.Name)
+		}
+
+		sort.Strings(namespaces)
+
+		pools = append(pools, backend.Pool{
+			Name: p.Name,
+			Namespaces: namespaces,
+		})
+	}
+
+	return pools, nil
+}
+
+// List the images in a namespace of a pool
+func (b *Backend) ListImages(ctx context.Context, pool string, namespace string) ([]string, error) {
+	ioctx, err := b.openIOContext(pool, namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+
+	names, err := rbd.GetImageNames(ioctx)
+	if err != nil {
+		return nil, cephError(err, "list images in pool %s namespace %q", pool, namespace)
+	}
+
+	return names, nil
+}
+
+// List the snapshots of an image ordered by their ID
+func (b *Backend) ListSnapshots(ctx context.Context, spec backend.ImageSpec) ([]backend.Snapshot, error) {
+	image, closeImage, err := b.openImage(spec, rbd.NoSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer closeImage()
+
+	snaps, err := image.GetSnapshotNames()
+	if err != nil {
+		return nil, cephError(err, "list snapshots of image %s", spec)
+	}
+
+	result := make([]backend.Snapshot, 0, len(snaps))
+	for _, snap := range snaps {
+		ts, err := image.GetSnapTimestamp(snap.Id)
+		if err != nil {
+			return nil, cephError(err, "get timestamp of snapshot %s@%s", spec, snap.Name)
+		}
+
+		protected, err := image.GetSnapshot(snap.Name).IsProtected()
+		if err != nil {
+			return nil, cephError(err, "get protection of snapshot %s@%s", spec, snap.Name)
+		}
+
+		nsType, err := image.GetSnapNamespaceType(snap.Id)
+		if err != nil {
+			return nil, cephError(err, "get namespace of snapshot %s@%s", spec, snap.Name)
+		}
+
+		result = append(result, backend.Snapshot{
+			ID: snap.Id,
+			Name: snap.Name,
+			Size: snap.Size,
+			Timestamp: time.Unix(ts.Sec, ts.Nsec),
+			Protected: protected,
+			Namespace: snapshotNamespace(nsType),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+// List the snapshots of an image with only their ID, name and namespace
+func (b *Backend) ListSnapshotNames(ctx context.Context, spec backend.ImageSpec) ([]backend.Snapshot, error) {
+	image, closeImage, err := b.openImage(spec, rbd.NoSnapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer closeImage()
+
+	snaps, err := image.GetSnapshotNames()
+	if err != nil {
+		return nil, cephError(err, "list snapshots of image %s", spec)
+	}
+
+	result := make([]backend.Snapshot, 0, len(snaps))
+	for _, snap := range snaps {
+		nsType, err := image.GetSnapNamespaceType(snap.Id)
+		if err != nil {
+			return nil, cephError(err, "get namespace of snapshot %s@%s", spec, snap.Name)
+		}
+
+		result = append(result, backend.Snapshot{
+			ID: snap.Id,
+			Name: snap.Name,
+			Namespace: snapshotNamespace(nsType),
+		})
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ID < result[j].ID
+	})
+
+	return result, nil
+}
+
+// Returns the name of the data pool of an image, or empty if the data is
+// stored in the image pool
+func (b *Backend) dataPool(spec backend.ImageSpec, image *rbd.Image, features uint64) (string, error) {
+	if features&rbd.FeatureDataPool == 0 {
+		return "", nil
+	}
+
+	id, err := image.GetId()
+	if err != nil {
+		return "", err
+	}
+
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return "", err
+	}
+	defer ioctx.Destroy()
+
+	// NOTE: go-ceph does not wrap rbd_get_data_pool_id so
+	// the pool ID is read from the image header like librbd does.
+	values, err := ioctx.GetOmapValues("rbd_header."+id, "", "data_pool_id", 1)
+	if err != nil {
+		return "", err
+	}
+
+	value, ok := values["data_pool_id"]
+	if !ok || len(value) != 8 {
+		return "", errors.New("image has the data-pool feature but no valid data pool ID")
+	}
+
+	return b.conn.GetPoolByID(int64(binary.LittleEndian.Uint64(value)))
+}
+
+// Get information about an image
+func (b *Backend) ImageInfo(ctx context.Context, spec backend.ImageSpec, snapshot string) (*backend.ImageInfo, error) {
+	image, closeImage, err := b.openImage(spec, snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer closeImage()
+
+	stat, err := image.Stat()
+	if err != nil {
+		return nil, cephError(err, "stat image %s", spec)
+	}
+
+	features, err := image.GetFeatures()
+	if err != nil {
+		return nil, cephError(err, "get features of image %s", spec)
+	}
+
+	stripeUnit, err := image.GetStripeUnit()
+	if err != nil {
+		return nil, cephError(err, "get stripe unit of image %s", spec)
+	}
+
+	stripeCount, err := image.GetStripeCount()
+	if err != nil {
+		return nil, cephError(err, "get stripe count of image %s", spec)
+	}
+
+	dataPool, err := b.dataPool(spec, image, features)
+	if err != nil {
+		return nil, cephError(err, "get data pool of image %s", spec)
+	}
+
+	var parent *backend.ParentSpec
+
+	parentInfo, err := image.GetParent()
+	switch {
+	case err == nil:
+		parent = &backend.ParentSpec{
+			Pool: parentInfo.Image.PoolName,
+			Namespace: parentInfo.Image.PoolNamespace,
+			Image: parentInfo.Image.ImageName,
+			Snapshot: parentInfo.Snap.SnapName,
+		}
+	case !errors.Is(err, rbd.ErrNotFound):
+		return nil, cephError(err, "get parent of image %s", spec)
+	}
+
+	metadata, err := image.ListMetadata()
+	if err != nil {
+		return nil, cephError(err, "list metadata of image %s", spec)
+	}
+
+	created, err := image.GetCreateTimestamp()
+	if err != nil {
+		return nil, cephError(err, "get create timestamp of image %s", spec)
+	}
+
+	featureSet := rbd.FeatureSet(features)
+
+	return &backend.ImageInfo{
+		Size: stat.Size,
+		Order: uint8(stat.Order),
+		ObjectSize: stat.Obj_size,
+		Features: featureSet.Names(),
+		StripeUnit: stripeUnit,
+		StripeCount: stripeCount,
+		DataPool: dataPool,
+		Parent: parent,
+		Metadata: metadata,
+		CreateTimestamp: time.Unix(created.Sec, created.Nsec),
+	}, nil
+}
+
+// Write the diff in the rbd export-diff format to w
+func (b *Backend) ExportDiff(ctx context.Context, req *backend.DiffRequest, w io.Writer) (*backend.DiffStats, error) {
+	image, closeImage, err := b.openImage(req.Image, req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	defer closeImage()
+
+	size, err := image.GetSize()
+	if err != nil {
+		return nil, cephError(err, "get size of image %s", req.Image)
+	}
+
+	dw := diff.NewWriter(w)
+
+	if err := dw.WriteHeader(req.FromSnapshot, req.Snapshot, size); err != nil {
+		return nil, err
+	}
+
+	stats := backend.DiffStats{
+		Size: size,
+	}
+
+	var writeErr error
+
+	buf := make([]byte, diffReadSize)
+
+	// NOTE: The callback cannot return a Go error so we save
+	// it and abort the iteration by returning a non-zero value.
+	cb := func(offset uint64, length uint64, exists int, _ interface{}) int {
+		if writeErr = ctx.Err(); writeErr != nil {
+			return -1
+		}
+
+		stats.Extents++
+
+		if exists == 0 {
+			if writeErr = dw.WriteZero(offset, length); writeErr != nil {
+				return -1
+			}
+
+			stats.Zeroed += length
+			return 0
+		}
+
+		for pos := offset; pos < offset+length; {
+			n := offset + length - pos
+			if n > diffReadSize {
+				n = diffReadSize
+			}
+
+			read, err := image.ReadAt(buf[:n], int64(pos))
+			if err != nil && err != io.EOF {
+				writeErr = cephError(err, "read %d bytes at offset %d of image %s", n, pos, req.Image)
+				return -1
+			}
+
+			if uint64(read) != n {
+				writeErr = fmt.Errorf("short read of %d bytes at offset %d of image %s, expected %d", read, pos, req.Image, n)
+				return -1
+			}
+
+			if writeErr = dw.WriteData(pos, buf[:n]); writeErr != nil {
+				return -1
+			}
+
+			pos += n
+			stats.Written += n
+		}
+
+		if req.Progress != nil {
+			req.Progress(offset+length, size)
+		}
+
+		return 0
+	}
+
+	err = image.DiffIterate(rbd.DiffIterateConfig{
+		SnapName: req.FromSnapshot,
+		Offset: 0,
+		Length: size,
+		IncludeParent: rbd.IncludeParent,
+		WholeObject: rbd.DisableWholeObject,
+		Callback: cb,
+	})
+	if writeErr != nil {
+		return nil, writeErr
+	}
+	if err != nil {
+		return nil, cephError(err, "diff image %s", req.Image)
+	}
+
+	if err := dw.WriteEnd(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,328 @@
+package ceph
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+
+	"go.uber.org/zap"
+
+	"github.com/ceph/go-ceph/rados"
+	"github.com/ceph/go-ceph/rbd"
+)
+
+// The image-meta key the image info is stored in on the destination
+const imageInfoKey = "snapback.image_info"
+
+// The image-meta key the checkpoint of an import is stored in
+const checkpointKey = "snapback.checkpoint"
+
+// The features that can be enabled when an image is created, the others
+// is set by rbd itself or cannot be used on a new image
+const createFeatures = rbd.FeatureLayering | rbd.FeatureStripingV2 | rbd.FeatureExclusiveLock |
+	rbd.FeatureObjectMap | rbd.FeatureFastDiff | rbd.FeatureDeepFlatten | rbd.FeatureJournaling
+
+// An RBD image that is open for writing
+type image struct {
+	ioctx *rados.IOContext
+	image *rbd.Image
+}
+
+// Write data at an offset
+func (i *image) WriteAt(p []byte, off int64) (int, error) {
+	return i.image.WriteAt(p, off)
+}
+
+// The buffer that is repeated when a range is zeroed
+var zeroSector = make([]byte, 512)
+
+// The most that is zeroed with one writesame, librbd rejects a length
+// above INT_MAX
+const maxZeroLength = 1024 * 1024 * 1024
+
+// Zero a range by writing zeroes to it, librbd turns it into a discard
+// where the objects can be released.
+//
+// NOTE: A discard is not used since librbd skips the parts of it that is
+// not aligned to the discard granularity, they would keep their data.
+func (i *image) Zero(offset uint64, length uint64) error {
+	for length >= uint64(len(zeroSector)) {
+		n := min(length-length%uint64(len(zeroSector)), maxZeroLength)
+
+		if _, err := i.image.WriteSame(offset, n, zeroSector, rados.OpFlagNone); err != nil {
+			return err
+		}
+
+		offset += n
+		length -= n
+	}
+
+	if length > 0 {
+		if _, err := i.image.WriteAt(zeroSector[:length], int64(offset)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns the size of the image
+func (i *image) Size() (uint64, error) {
+	return i.image.GetSize()
+}
+
+// Resize the image
+func (i *image) Resize(size uint64) error {
+	return i.image.Resize(size)
+}
+
+// Flush the writes to the image
+func (i *image) Flush() error {
+	return i.image.Flush()
+}
+
+// Store the checkpoint in the image-meta of the image
+func (i *image) SaveCheckpoint(data []byte) error {
+	return i.image.SetMetadata(checkpointKey, string(data))
+}
+
+// Close the image
+func (i *image) Close() error {
+	defer i.ioctx.Destroy()
+
+	if err := i.image.Flush(); err != nil {
+		i.image.Close()
+		return err
+	}
+
+	return i.image.Close()
+}
+
+// Create the namespace of an image if it does not exist
+func ensureNamespace(ioctx *rados.IOContext, spec backend.ImageSpec) error {
+	if spec.Namespace == "" {
+		return nil
+	}
+
+	exists, err := rbd.NamespaceExists(ioctx, spec.Namespace)
+	if err != nil {
+		return cephError(err, "check namespace %s in pool %s", spec.Namespace, spec.Pool)
+	}
+
+	if exists {
+		return nil
+	}
+
+	if err := rbd.NamespaceCreate(ioctx, spec.Namespace); err != nil {
+		return cephError(err, "create namespace %s in pool %s", spec.Namespace, spec.Pool)
+	}
+
+	return nil
+}
+
+// Open an image for writing, it is created with the size if it does not exist
+func (b *Backend) OpenImage(ctx context.Context, spec backend.ImageSpec, size uint64) (backend.Image, error) {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	img, err := rbd.OpenImage(ioctx, spec.Image, rbd.NoSnapshot)
+	if errors.Is(err, rbd.ErrNotFound) {
+		b.logger.Info("creating image", zap.Stringer("image", spec), zap.Uint64("size", size))
+
+		opts := rbd.NewRbdImageOptions()
+		defer opts.Destroy()
+
+		if err := ensureNamespace(ioctx, spec); err != nil {
+			ioctx.Destroy()
+			return nil, err
+		}
+
+		if err := rbd.CreateImage(ioctx, spec.Image, size, opts); err != nil {
+			ioctx.Destroy()
+			return nil, cephError(err, "create image %s", spec)
+		}
+
+		img, err = rbd.OpenImage(ioctx, spec.Image, rbd.NoSnapshot)
+	}
+	if err != nil {
+		ioctx.Destroy()
+		return nil, cephError(err, "open image %s", spec)
+	}
+
+	return &image{
+		ioctx: ioctx,
+		image: img,
+	}, nil
+}
+
+// Create an image with the size and layout in info, fields that is zero
+// use the defaults of the cluster
+func (b *Backend) CreateImage(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	opts := rbd.NewRbdImageOptions()
+	defer opts.Destroy()
+
+	if info.Order != 0 {
+		if err := opts.SetUint64(rbd.ImageOptionOrder, uint64(info.Order)); err != nil {
+			return fmt.Errorf("set order: %w", err)
+		}
+	}
+
+	if len(info.Features) > 0 {
+		features := uint64(rbd.FeatureSetFromNames(info.Features)) & createFeatures
+		if err := opts.SetUint64(rbd.ImageOptionFeatures, features); err != nil {
+			return fmt.Errorf("set features: %w", err)
+		}
+	}
+
+	if info.StripeUnit != 0 && info.StripeCount != 0 {
+		if err := opts.SetUint64(rbd.ImageOptionStripeUnit, info.StripeUnit); err != nil {
+			return fmt.Errorf("set stripe unit: %w", err)
+		}
+
+		if err := opts.SetUint64(rbd.ImageOptionStripeCount, info.StripeCount); err != nil {
+			return fmt.Errorf("set stripe count: %w", err)
+		}
+	}
+
+	if info.DataPool != "" {
+		if err := opts.SetString(rbd.ImageOptionDataPool, info.DataPool); err != nil {
+			return fmt.Errorf("set data pool: %w", err)
+		}
+	}
+
+	if err := ensureNamespace(ioctx, spec); err != nil {
+		return err
+	}
+
+	b.logger.Info("creating image", zap.Stringer("image", spec), zap.Uint64("size", info.Size),
+		zap.Uint8("order", info.Order), zap.Strings("features", info.Features), zap.String("data_pool", info.DataPool))
+
+	if err := rbd.CreateImage(ioctx, spec.Image, info.Size, opts); err != nil {
+		return cephError(err, "create image %s", spec)
+	}
+
+	return nil
+}
+
+// Store the image info on the image, the image-meta key/value pairs is
+// set on the image and the rest is stored as JSON in a key of its own
+func (b *Backend) SaveImageInfo(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImage(ioctx, spec.Image, rbd.NoSnapshot)
+	if err != nil {
+		return cephError(err, "open image %s", spec)
+	}
+	defer img.Close()
+
+	for key, value := range info.Metadata {
+		if err := img.SetMetadata(key, value); err != nil {
+			return cephError(err, "set metadata %s of image %s", key, spec)
+		}
+	}
+
+	stored := *info
+	stored.Metadata = nil
+
+	data, err := json.Marshal(&stored)
+	if err != nil {
+		return err
+	}
+
+	if err := img.SetMetadata(imageInfoKey, string(data)); err != nil {
+		return cephError(err, "set metadata %s of image %s", imageInfoKey, spec)
+	}
+
+	return nil
+}
+
+// Create a snapshot of an image
+func (b *Backend) CreateSnapshot(ctx context.Context, spec backend.ImageSpec, name string) error {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImage(ioctx, spec.Image, rbd.NoSnapshot)
+	if err != nil {
+		return cephError(err, "open image %s", spec)
+	}
+	defer img.Close()
+
+	if _, err := img.CreateSnapshot(name); err != nil {
+		return cephError(err, "create snapshot %s of image %s", name, spec)
+	}
+
+	return nil
+}
+
+// Returns true if the error is a missing image or image-meta key, librbd
+// returns both errors depending on the call
+func isNotFound(err error) bool {
+	return errors.Is(err, rbd.ErrNotFound) || errors.Is(err, rbd.ErrNotExist)
+}
+
+// Returns the checkpoint in the image-meta of the image
+func (b *Backend) LoadCheckpoint(ctx context.Context, spec backend.ImageSpec) ([]byte, error) {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImageReadOnly(ioctx, spec.Image, rbd.NoSnapshot)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, cephError(err, "open image %s", spec)
+	}
+	defer img.Close()
+
+	value, err := img.GetMetadata(checkpointKey)
+	if isNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, cephError(err, "get metadata %s of image %s", checkpointKey, spec)
+	}
+
+	return []byte(value), nil
+}
+
+// Remove the checkpoint from the image-meta of the image
+func (b *Backend) RemoveCheckpoint(ctx context.Context, spec backend.ImageSpec) error {
+	ioctx, err := b.openIOContext(spec.Pool, spec.Namespace)
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	img, err := rbd.OpenImage(ioctx, spec.Image, rbd.NoSnapshot)
+	if err != nil {
+		return cephError(err, "open image %s", spec)
+	}
+	defer img.Close()
+
+	if err := img.RemoveMetadata(checkpointKey); err != nil && !isNotFound(err) {
+		return cephError(err, "remove metadata %s of image %s", checkpointKey, spec)
+	}
+
+	return nil
+}
@@ -0,0 +1,289 @@
+package file
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+
+	"go.uber.org/zap"
+)
+
+// A file with an image head that is open for writing
+type image struct {
+	f *os.File
+}
+
+// Write data at an offset
+func (i *image) WriteAt(p []byte, off int64) (int, error) {
+	return i.f.WriteAt(p, off)
+}
+
+// Zero a range by writing zeroes to it
+func (i *image) Zero(offset uint64, length uint64) error {
+	zero := make([]byte, blockSize)
+
+	for length > 0 {
+		n := length
+		if n > blockSize {
+			n = blockSize
+		}
+
+		if _, err := i.f.WriteAt(zero[:n], int64(offset)); err != nil {
+			return err
+		}
+
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
+
+// Returns the size of the image
+func (i *image) Size() (uint64, error) {
+	info, err := i.f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.Size()), nil
+}
+
+// Resize the image
+func (i *image) Resize(size uint64) error {
+	return i.f.Truncate(int64(size))
+}
+
+// Flush the writes to the file to disk
+func (i *image) Flush() error {
+	return i.f.Sync()
+}
+
+// Store the checkpoint in a file next to the image head
+func (i *image) SaveCheckpoint(data []byte) error {
+	return replaceFile(filepath.Dir(i.f.Name()), checkpointFile, data)
+}
+
+// Close the image
+func (i *image) Close() error {
+	if err := i.f.Sync(); err != nil {
+		i.f.Close()
+		return err
+	}
+
+	return i.f.Close()
+}
+
+// Open an image for writing, it is created with the size if it does not exist
+func (b *Backend) OpenImage(ctx context.Context, spec backend.ImageSpec, size uint64) (backend.Image, error) {
+	path, err := b.dataPath(spec, "")
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		b.logger.Info("creating image", zap.Stringer("image", spec), zap.Uint64("size", size))
+
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, fileError(err, "create image %s", spec)
+		}
+
+		f, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			err = f.Truncate(int64(size))
+		}
+	}
+	if err != nil {
+		return nil, fileError(err, "open image %s", spec)
+	}
+
+	return &image{
+		f: f,
+	}, nil
+}
+
+// Create an image with the size, the file has no layout so only the
+// size is used
+func (b *Backend) CreateImage(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	path, err := b.dataPath(spec, "")
+	if err != nil {
+		return err
+	}
+
+	b.logger.Info("creating image", zap.Stringer("image", spec), zap.Uint64("size", info.Size))
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fileError(err, "create image %s", spec)
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return fileError(err, "create image %s", spec)
+	}
+
+	if err := f.Truncate(int64(info.Size)); err != nil {
+		f.Close()
+		return fileError(err, "create image %s", spec)
+	}
+
+	if err := f.Close(); err != nil {
+		return fileError(err, "create image %s", spec)
+	}
+
+	return nil
+}
+
+// Store the image info as JSON in the image directory
+func (b *Backend) SaveImageInfo(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	path, err := b.imagePath(spec)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(filepath.Join(path, headFile)); err != nil {
+		return fileError(err, "open image %s", spec)
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := replaceFile(path, infoFile, append(data, '\n')); err != nil {
+		return fileError(err, "save info of image %s", spec)
+	}
+
+	return nil
+}
+
+// Replace the file in dir with the data, it is written to a temporary file
+// first so a partial file is never read
+func replaceFile(dir string, name string, data []byte) error {
+	tmp, err := os.CreateTemp(dir, "."+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, name))
+}
+
+// Create a snapshot of an image by copying the image head
+func (b *Backend) CreateSnapshot(ctx context.Context, spec backend.ImageSpec, name string) error {
+	headPath, err := b.dataPath(spec, "")
+	if err != nil {
+		return err
+	}
+
+	snapPath, err := b.dataPath(spec, name)
+	if err != nil {
+		return err
+	}
+
+	head, err := os.Open(headPath)
+	if err != nil {
+		return fileError(err, "open image %s", spec)
+	}
+	defer head.Close()
+
+	if err := os.MkdirAll(filepath.Dir(snapPath), 0o755); err != nil {
+		return fileError(err, "create snapshot %s of image %s", name, spec)
+	}
+
+	// NOTE: The copy is written to a temporary file first
+	// so a partial copy is never seen as a snapshot.
+	tmp, err := os.CreateTemp(filepath.Dir(headPath), "."+name+"-*")
+	if err != nil {
+		return fileError(err, "create snapshot %s of image %s", name, spec)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return fileError(err, "create snapshot %s of image %s", name, spec)
+	}
+
+	if _, err := io.Copy(tmp, head); err != nil {
+		tmp.Close()
+		return fileError(err, "copy snapshot %s of image %s", name, spec)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fileError(err, "copy snapshot %s of image %s", name, spec)
+	}
+
+	if _, err := os.Stat(snapPath); err == nil {
+		return fileError(fs.ErrExist, "create snapshot %s of image %s", name, spec)
+	}
+
+	// Snapshots is ordered by modification time so make sure it is now
+	now := time.Now()
+	if err := os.Chtimes(tmp.Name(), now, now); err != nil {
+		return fileError(err, "create snapshot %s of image %s", name, spec)
+	}
+
+	if err := os.Rename(tmp.Name(), snapPath); err != nil {
+		return fileError(err, "create snapshot %s of image %s", name, spec)
+	}
+
+	return nil
+}
+
+// Returns the checkpoint that is stored next to the image head
+func (b *Backend) LoadCheckpoint(ctx context.Context, spec backend.ImageSpec) ([]byte, error) {
+	path, err := b.imagePath(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(filepath.Join(path, checkpointFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fileError(err, "read checkpoint of image %s", spec)
+	}
+
+	return data, nil
+}
+
+// Remove the checkpoint that is stored next to the image head
+func (b *Backend) RemoveCheckpoint(ctx context.Context, spec backend.ImageSpec) error {
+	path, err := b.imagePath(spec)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(path, checkpointFile)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fileError(err, "remove checkpoint of image %s", spec)
+	}
+
+	return nil
+}
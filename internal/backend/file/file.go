@@ -0,0 +1,443 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/diff"
+
+	"go.uber.org/zap"
+)
+
+// The size of the blocks that is compared when building a diff
+const blockSize = 64 * 1024
+
+// The name of the file with the image head in an image directory
+const headFile = "head"
+
+// The name of the directory with snapshots in an image directory
+const snapshotsDir = "snapshots"
+
+// The name of the file with the image info in an image directory
+const infoFile = "info.json"
+
+// The name of the file with the checkpoint of an import in an image
+// directory on the destination
+const checkpointFile = "checkpoint.json"
+
+// Backend that exports images from a local directory, it is meant for
+// development and testing without a Ceph cluster. There is no namespaces,
+// only the default namespace exists. The layout is
+//
+//	<root>/<pool>/<image>/head                   sparse file with the image
+//	<root>/<pool>/<image>/snapshots/<snapshot>   copy of the image at a snapshot
+//	<root>/<pool>/<image>/info.json              image info, optional
+//	<root>/<pool>/<image>/checkpoint.json        import in progress, destination only
+//
+// Snapshots is ordered by their modification time.
+type Backend struct {
+	// Logger
+	logger *zap.Logger
+
+	// The root directory
+	root string
+}
+
+// Returns a new Backend for the root directory
+func New(logger *zap.Logger, root string) (*Backend, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", root)
+	}
+
+	return &Backend{
+		logger: logger,
+		root: root,
+	}, nil
+}
+
+// Close the backend
+func (b *Backend) Close() error {
+	return nil
+}
+
+// Returns the backend error for a file system error
+func fileError(err error, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return fmt.Errorf("%s: %w: %w", msg, backend.ErrNotFound, err)
+	case errors.Is(err, fs.ErrPermission):
+		return fmt.Errorf("%s: %w: %w", msg, backend.ErrPermissionDenied, err)
+	}
+
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// Returns an error if name cannot be used as a path element
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid name %q: %w", name, backend.ErrNotFound)
+	}
+
+	return nil
+}
+
+// Returns the path to the image directory
+func (b *Backend) imagePath(spec backend.ImageSpec) (string, error) {
+	if err := validName(spec.Pool); err != nil {
+		return "", err
+	}
+
+	if spec.Namespace != "" {
+		return "", fmt.Errorf("namespace %s in pool %s: %w", spec.Namespace, spec.Pool, backend.ErrNotFound)
+	}
+
+	if err := validName(spec.Image); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(b.root, spec.Pool, spec.Image), nil
+}
+
+// Returns the path to the file with the image head or a snapshot
+func (b *Backend) dataPath(spec backend.ImageSpec, snapshot string) (string, error) {
+	path, err := b.imagePath(spec)
+	if err != nil {
+		return "", err
+	}
+
+	if snapshot == "" {
+		return filepath.Join(path, headFile), nil
+	}
+
+	if err := validName(snapshot); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(path, snapshotsDir, snapshot), nil
+}
+
+// List the names of the directories in path
+func listDirs(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			names = append(names, entry.Name())
+		}
+	}
+
+	return names, nil
+}
+
+// List the pools, they never has namespaces
+func (b *Backend) ListPools(ctx context.Context) ([]backend.Pool, error) {
+	names, err := listDirs(b.root)
+	if err != nil {
+		return nil, fileError(err, "list pools")
+	}
+
+	sort.Strings(names)
+
+	pools := make([]backend.Pool, 0, len(names))
+	for _, name := range names {
+		pools = append(pools, backend.Pool{
+			Name: name,
+		})
+	}
+
+	return pools, nil
+}
+
+// List the images in a pool
+func (b *Backend) ListImages(ctx context.Context, pool string, namespace string) ([]string, error) {
+	if err := validName(pool); err != nil {
+		return nil, err
+	}
+
+	if namespace != "" {
+		return nil, fmt.Errorf("namespace %s in pool %s: %w", namespace, pool, backend.ErrNotFound)
+	}
+
+	images, err := listDirs(filepath.Join(b.root, pool))
+	if err != nil {
+		return nil, fileError(err, "list images in pool %s", pool)
+	}
+
+	return images, nil
+}
+
+// List the snapshots of an image ordered by their ID
+func (b *Backend) ListSnapshots(ctx context.Context, spec backend.ImageSpec) ([]backend.Snapshot, error) {
+	path, err := b.imagePath(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(path, headFile)); err != nil {
+		return nil, fileError(err, "open image %s", spec)
+	}
+
+	entries, err := os.ReadDir(filepath.Join(path, snapshotsDir))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return []backend.Snapshot{}, nil
+		}
+
+		return nil, fileError(err, "list snapshots of image %s", spec)
+	}
+
+	infos := make([]fs.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fileError(err, "stat snapshot %s of image %s", entry.Name(), spec)
+		}
+
+		infos = append(infos, info)
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].ModTime().Equal(infos[j].ModTime()) {
+			return infos[i].Name() < infos[j].Name()
+		}
+
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	snaps := make([]backend.Snapshot, 0, len(infos))
+	for idx, info := range infos {
+		snaps = append(snaps, backend.Snapshot{
+			ID: uint64(idx + 1),
+			Name: info.Name(),
+			Size: uint64(info.Size()),
+			Timestamp: info.ModTime(),
+			Namespace: backend.SnapshotNamespaceUser,
+		})
+	}
+
+	return snaps, nil
+}
+
+// List the snapshots of an image, it is as cheap as ListSnapshots
+func (b *Backend) ListSnapshotNames(ctx context.Context, spec backend.ImageSpec) ([]backend.Snapshot, error) {
+	return b.ListSnapshots(ctx, spec)
+}
+
+// Get information about an image
+func (b *Backend) ImageInfo(ctx context.Context, spec backend.ImageSpec, snapshot string) (*backend.ImageInfo, error) {
+	path, err := b.dataPath(spec, snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, fileError(err, "stat image %s", spec)
+	}
+
+	imagePath, err := b.imagePath(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	// The layout and metadata is only known if an importer saved it
+	var info backend.ImageInfo
+
+	data, err := os.ReadFile(filepath.Join(imagePath, infoFile))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fileError(err, "read info of image %s", spec)
+	}
+
+	if err == nil {
+		if err := json.Unmarshal(data, &info); err != nil {
+			return nil, fmt.Errorf("read info of image %s: %w", spec, err)
+		}
+	}
+
+	info.Size = uint64(stat.Size())
+
+	return &info, nil
+}
+
+// Read a block at offset, the part of the block past the end of
+// the file is zeroed.
+func readBlock(f *os.File, buf []byte, offset int64) error {
+	n, err := f.ReadAt(buf, offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	clear(buf[n:])
+	return nil
+}
+
+// Returns true if the buffer only contains zeroes
+func isZero(buf []byte) bool {
+	for _, b := range buf {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Write the diff in the rbd export-diff format to w, blocks that is
+// equal to the from snapshot is skipped.
+func (b *Backend) ExportDiff(ctx context.Context, req *backend.DiffRequest, w io.Writer) (*backend.DiffStats, error) {
+	path, err := b.dataPath(req.Image, req.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fileError(err, "open image %s", req.Image)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, fileError(err, "stat image %s", req.Image)
+	}
+
+	var from *os.File
+	if req.FromSnapshot != "" {
+		fromPath, err := b.dataPath(req.Image, req.FromSnapshot)
+		if err != nil {
+			return nil, err
+		}
+
+		from, err = os.Open(fromPath)
+		if err != nil {
+			return nil, fileError(err, "open snapshot %s of image %s", req.FromSnapshot, req.Image)
+		}
+		defer from.Close()
+	}
+
+	size := uint64(info.Size())
+
+	dw := diff.NewWriter(w)
+	if err := dw.WriteHeader(req.FromSnapshot, req.Snapshot, size); err != nil {
+		return nil, err
+	}
+
+	stats := backend.DiffStats{
+		Size: size,
+	}
+
+	buf := make([]byte, blockSize)
+	fromBuf := make([]byte, blockSize)
+
+	// Adjacent zeroed blocks is sent as a single zero record
+	var zeroStart, zeroLength uint64
+	flushZero := func() error {
+		if zeroLength == 0 {
+			return nil
+		}
+
+		if err := dw.WriteZero(zeroStart, zeroLength); err != nil {
+			return err
+		}
+
+		stats.Extents++
+		stats.Zeroed += zeroLength
+		zeroLength = 0
+
+		return nil
+	}
+
+	for offset := uint64(0); offset < size; offset += blockSize {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n := size - offset
+		if n > blockSize {
+			n = blockSize
+		}
+
+		block := buf[:n]
+		if err := readBlock(f, block, int64(offset)); err != nil {
+			return nil, fileError(err, "read image %s", req.Image)
+		}
+
+		zero := isZero(block)
+
+		if from != nil {
+			if err := readBlock(from, fromBuf[:n], int64(offset)); err != nil {
+				return nil, fileError(err, "read snapshot %s of image %s", req.FromSnapshot, req.Image)
+			}
+
+			if bytes.Equal(block, fromBuf[:n]) {
+				if err := flushZero(); err != nil {
+					return nil, err
+				}
+
+				continue
+			}
+		} else if zero {
+			// A full diff does not include unallocated data
+			continue
+		}
+
+		if zero {
+			if zeroLength == 0 {
+				zeroStart = offset
+			}
+
+			zeroLength += n
+			continue
+		}
+
+		if err := flushZero(); err != nil {
+			return nil, err
+		}
+
+		if err := dw.WriteData(offset, block); err != nil {
+			return nil, err
+		}
+
+		stats.Extents++
+		stats.Written += n
+
+		if req.Progress != nil {
+			req.Progress(offset+n, size)
+		}
+	}
+
+	if err := flushZero(); err != nil {
+		return nil, err
+	}
+
+	if err := dw.WriteEnd(); err != nil {
+		return nil, err
+	}
+
+	return &stats, nil
+}
@@ -0,0 +1,169 @@
+package file
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/diff"
+
+	"go.uber.org/zap"
+)
+
+// Returns a new backend for a temporary directory
+func newTestBackend(t *testing.T) *Backend {
+	t.Helper()
+
+	b, err := New(zap.NewNop(), t.TempDir())
+	if err != nil {
+		t.Fatalf("new backend: %v", err)
+	}
+
+	return b
+}
+
+// Export the diff from fromSnap to snap and apply it to the destination
+func exportAndApply(t *testing.T, src *Backend, dest *Backend, spec backend.ImageSpec, fromSnap string, snap string) {
+	t.Helper()
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	stats, err := src.ExportDiff(ctx, &backend.DiffRequest{
+		Image: spec,
+		Snapshot: snap,
+		FromSnapshot: fromSnap,
+	}, &buf)
+	if err != nil {
+		t.Fatalf("export diff from %q to %q: %v", fromSnap, snap, err)
+	}
+
+	dr := diff.NewReader(&buf)
+	header, err := dr.ReadHeader()
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	if header.FromSnap != fromSnap || header.ToSnap != snap || header.Size != stats.Size {
+		t.Fatalf("got header %+v, expected from %q to %q with size %d", header, fromSnap, snap, stats.Size)
+	}
+
+	img, err := dest.OpenImage(ctx, spec, header.Size)
+	if err != nil {
+		t.Fatalf("open image: %v", err)
+	}
+
+	if err := img.Resize(header.Size); err != nil {
+		t.Fatalf("resize image: %v", err)
+	}
+
+	if err := dr.Apply(header, img); err != nil {
+		t.Fatalf("apply diff: %v", err)
+	}
+
+	if err := img.Close(); err != nil {
+		t.Fatalf("close image: %v", err)
+	}
+
+	if err := dest.CreateSnapshot(ctx, spec, snap); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+}
+
+// Fail if the snapshot on the destination is not equal to the source
+func compareSnapshot(t *testing.T, src *Backend, dest *Backend, spec backend.ImageSpec, snap string) {
+	t.Helper()
+
+	read := func(b *Backend) []byte {
+		path, err := b.dataPath(spec, snap)
+		if err != nil {
+			t.Fatalf("data path: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read snapshot %s: %v", snap, err)
+		}
+
+		return data
+	}
+
+	want := read(src)
+	got := read(dest)
+
+	if len(got) != len(want) {
+		t.Fatalf("snapshot %s has size %d, expected %d", snap, len(got), len(want))
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Fatalf("snapshot %s on the destination is not equal to the source", snap)
+	}
+}
+
+func TestExportDiffRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+
+	src := newTestBackend(t)
+	dest := newTestBackend(t)
+
+	spec := backend.ImageSpec{
+		Pool: "pool",
+		Image: "image",
+	}
+
+	headPath, err := src.dataPath(spec, "")
+	if err != nil {
+		t.Fatalf("data path: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(headPath), 0o755); err != nil {
+		t.Fatalf("create image: %v", err)
+	}
+
+	// Blocks 0, 2 and 5 has data, the last block is partial
+	head := make([]byte, 6*blockSize+123)
+	rnd.Read(head[:blockSize])
+	rnd.Read(head[2*blockSize : 3*blockSize])
+	rnd.Read(head[5*blockSize:])
+
+	if err := os.WriteFile(headPath, head, 0o644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+
+	if err := src.CreateSnapshot(ctx, spec, "s1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+
+	// Change a block, zero a block with data and grow the image
+	rnd.Read(head[3*blockSize+10 : 3*blockSize+20])
+	clear(head[2*blockSize : 3*blockSize])
+	head = append(head, make([]byte, blockSize)...)
+	rnd.Read(head[len(head)-100:])
+
+	if err := os.WriteFile(headPath, head, 0o644); err != nil {
+		t.Fatalf("write image: %v", err)
+	}
+
+	if err := src.CreateSnapshot(ctx, spec, "s2"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+
+	exportAndApply(t, src, dest, spec, "", "s1")
+	compareSnapshot(t, src, dest, spec, "s1")
+
+	exportAndApply(t, src, dest, spec, "s1", "s2")
+	compareSnapshot(t, src, dest, spec, "s2")
+
+	snaps, err := dest.ListSnapshots(ctx, spec)
+	if err != nil {
+		t.Fatalf("list snapshots: %v", err)
+	}
+
+	if len(snaps) != 2 || snaps[0].Name != "s1" || snaps[1].Name != "s2" {
+		t.Fatalf("got snapshots %+v on the destination, expected s1 and s2", snaps)
+	}
+}
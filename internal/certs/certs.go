@@ -0,0 +1,112 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// The ALPN protocol that is used by snapback
+const NextProto = "snapback"
+
+// Returns a certificate pool with the certificates in the PEM file
+func loadCAPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("read ca %s: %w", caFile, err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in ca %s", caFile)
+	}
+
+	return pool, nil
+}
+
+// Load a certificate and key pair
+func loadKeyPair(certFile string, keyFile string) (tls.Certificate, error) {
+	if certFile == "" || keyFile == "" {
+		return tls.Certificate{}, errors.New("both a certificate and key is required")
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("load certificate %s and key %s: %w", certFile, keyFile, err)
+	}
+
+	return cert, nil
+}
+
+// Returns the TLS config for the exporter, clients must present a
+// certificate that is signed by the CA.
+func ServerConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if caFile == "" {
+		return nil, errors.New("a ca is required to verify clients")
+	}
+
+	pool, err := loadCAPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth: tls.RequireAndVerifyClientCert,
+		ClientCAs: pool,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{NextProto},
+	}, nil
+}
+
+// Returns the TLS config for the importer, the exporter must present a
+// certificate that is signed by the CA and valid for serverName. If verify
+// is set it is called with the exporter certificate, the CA can then be
+// empty to only trust the exporter by what verify accepts.
+func ClientConfig(certFile string, keyFile string, caFile string, serverName string, verify func(*x509.Certificate) error) (*tls.Config, error) {
+	cert, err := loadKeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName: serverName,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{NextProto},
+	}
+
+	if caFile != "" {
+		pool, err := loadCAPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		config.RootCAs = pool
+	} else if verify != nil {
+		// NOTE: The chain is not verified without a CA, the
+		// exporter is verified in VerifyConnection instead.
+		config.InsecureSkipVerify = true
+	} else {
+		return nil, errors.New("a ca is required to verify the exporter")
+	}
+
+	if verify != nil {
+		config.VerifyConnection = func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("exporter did not present a certificate")
+			}
+
+			return verify(state.PeerCertificates[0])
+		}
+	}
+
+	return config, nil
+}
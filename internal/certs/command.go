@@ -0,0 +1,80 @@
+package certs
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "certs",
+		Short: "Manage certificates",
+		Long: "Manage the certificates the exporter and importer authenticate each other with " +
+			"over mutual TLS. Both sides must have a certificate signed by the same CA.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newInitCommand())
+
+	return cmd
+}
+
+func newInitCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "init",
+		Short: "Create a CA and a certificate signed by it",
+		Long: "Create an ECDSA P-256 key and a certificate for --name signed by the CA in --dir. " +
+			"The CA is created if it does not exist, copy ca.crt to the other side so it can " +
+			"verify the certificate and run init there with the same CA to issue its certificate.",
+		Args: cobra.NoArgs,
+		RunE: runInit,
+	}
+
+	cmd.Flags().String("dir", ".", "directory to write the CA, certificate and key to")
+	cmd.Flags().String("name", "", "name of the certificate, for example exporter or importer")
+	cmd.Flags().StringSlice("host", nil, "DNS name or IP address the certificate is valid for")
+	cmd.Flags().Duration("validity", 365*24*time.Hour, "how long the certificate is valid")
+	cmd.MarkFlagRequired("name")
+
+	return cmd
+}
+
+func runInit(cmd *cobra.Command, args []string) error {
+	dir, err := cmd.Flags().GetString("dir")
+	if err != nil {
+		return err
+	}
+
+	name, err := cmd.Flags().GetString("name")
+	if err != nil {
+		return err
+	}
+
+	hosts, err := cmd.Flags().GetStringSlice("host")
+	if err != nil {
+		return err
+	}
+
+	validity, err := cmd.Flags().GetDuration("validity")
+	if err != nil {
+		return err
+	}
+
+	created, err := Init(dir, name, hosts, validity)
+	if err != nil {
+		return err
+	}
+
+	if created {
+		fmt.Fprintf(cmd.OutOrStdout(), "created ca %s/%s\n", dir, CAFile)
+	}
+
+	certPath, keyPath := Paths(dir, name)
+	fmt.Fprintf(cmd.OutOrStdout(), "created certificate %s and key %s\n", certPath, keyPath)
+
+	return nil
+}
@@ -0,0 +1,231 @@
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The file name of the CA certificate
+const CAFile = "ca.crt"
+
+// The file name of the CA key
+const CAKeyFile = "ca.key"
+
+// Returns the paths to the certificate and key for name in dir
+func Paths(dir string, name string) (string, string) {
+	return filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+}
+
+// Returns a random serial number
+func newSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 127))
+}
+
+// Write a PEM block to a file that must not already exist
+func writePEM(path string, blockType string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if err := pem.Encode(f, &pem.Block{Type: blockType, Bytes: data}); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// Write a private key in PKCS #8 form
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	return writePEM(path, "PRIVATE KEY", der, 0o600)
+}
+
+// Read a PEM encoded certificate
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("no certificate found in %s", path)
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Read a PEM encoded PKCS #8 private key
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found in %s", path)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("private key in %s cannot sign", path)
+	}
+
+	return signer, nil
+}
+
+// Load the CA in dir or create it if it does not exist
+func loadOrCreateCA(dir string, validity time.Duration) (*x509.Certificate, crypto.Signer, bool, error) {
+	certPath := filepath.Join(dir, CAFile)
+	keyPath := filepath.Join(dir, CAKeyFile)
+
+	cert, err := readCert(certPath)
+	if err == nil {
+		key, err := readKey(keyPath)
+		if err != nil {
+			return nil, nil, false, fmt.Errorf("read ca key: %w", err)
+		}
+
+		return cert, key, false, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, false, fmt.Errorf("read ca: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: "snapback ca",
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(validity),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, key.Public(), key)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	if err := writeKey(keyPath, key); err != nil {
+		return nil, nil, false, fmt.Errorf("write ca key: %w", err)
+	}
+
+	if err := writePEM(certPath, "CERTIFICATE", der, 0o644); err != nil {
+		return nil, nil, false, fmt.Errorf("write ca: %w", err)
+	}
+
+	cert, err = x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, false, err
+	}
+
+	return cert, key, true, nil
+}
+
+// Create a certificate and ECDSA P-256 key for name in dir that is signed
+// by the CA in dir, the CA is created first if it does not exist. The
+// certificate can be used both as a server and client certificate. Returns
+// true if the CA was created.
+func Init(dir string, name string, hosts []string, validity time.Duration) (bool, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return false, err
+	}
+
+	certPath, keyPath := Paths(dir, name)
+	if _, err := os.Stat(certPath); err == nil {
+		return false, fmt.Errorf("certificate %s already exists", certPath)
+	}
+
+	caCert, caKey, created, err := loadOrCreateCA(dir, validity)
+	if err != nil {
+		return false, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return created, err
+	}
+
+	serial, err := newSerial()
+	if err != nil {
+		return created, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber: serial,
+		Subject: pkix.Name{
+			CommonName: name,
+		},
+		NotBefore: now.Add(-time.Hour),
+		NotAfter: now.Add(validity),
+		KeyUsage: x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{
+			x509.ExtKeyUsageServerAuth,
+			x509.ExtKeyUsageClientAuth,
+		},
+	}
+
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, caCert, key.Public(), caKey)
+	if err != nil {
+		return created, err
+	}
+
+	if err := writeKey(keyPath, key); err != nil {
+		return created, fmt.Errorf("write key: %w", err)
+	}
+
+	if err := writePEM(certPath, "CERTIFICATE", der, 0o644); err != nil {
+		return created, fmt.Errorf("write certificate: %w", err)
+	}
+
+	return created, nil
+}
@@ -0,0 +1,152 @@
+package cli
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/tobias-urdin/snapback/client"
+	"github.com/tobias-urdin/snapback/internal/certs"
+	"github.com/tobias-urdin/snapback/internal/config"
+	"github.com/tobias-urdin/snapback/internal/pins"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+)
+
+// The prefix of the environment variables for the commands
+const envPrefix = "SNAPBACK_"
+
+// The settings used to connect to an exporter
+type connectConfig struct {
+	// The address of the exporter
+	Exporter string
+
+	// The log level
+	LogLevel string
+
+	// The certificate the client identifies itself with
+	TLSCert string
+
+	// The private key for the certificate
+	TLSKey string
+
+	// The CA that the exporter certificate must be signed by
+	TLSCA string
+
+	// The name the exporter certificate must be valid for
+	ServerName string
+
+	// The file with pinned exporters
+	KnownHosts string
+
+	// What to do when the exporter is not pinned
+	PinMode string
+}
+
+// Add the flags used to connect to an exporter
+func addConnectFlags(flags *pflag.FlagSet) {
+	flags.String("exporter", "localhost:4242", "address of the exporter")
+	flags.String("log-level", "warn", "log level, debug, info, warn or error")
+	flags.String("tls-cert", "", "certificate to identify with")
+	flags.String("tls-key", "", "private key for the certificate")
+	flags.String("tls-ca", "", "ca that the exporter certificate must be signed by, optional with --known-hosts")
+	flags.String("server-name", "", "name the exporter certificate must be valid for, defaults to the exporter host")
+	flags.String("known-hosts", "", "file with pinned exporters, for example "+pins.DefaultPath)
+	flags.String("pin-mode", string(pins.ModeStrict), "what to do when the exporter is not pinned, strict refuses it and tofu pins it")
+}
+
+// Load the settings used to connect to an exporter from the flags and
+// environment variables
+func loadConnectConfig(flags *pflag.FlagSet) (*connectConfig, error) {
+	cfg := connectConfig{
+		Exporter: "localhost:4242",
+		LogLevel: "warn",
+		PinMode: string(pins.ModeStrict),
+	}
+
+	b := config.NewBinder(flags, envPrefix)
+	b.String("exporter", &cfg.Exporter)
+	b.String("log-level", &cfg.LogLevel)
+	b.String("tls-cert", &cfg.TLSCert)
+	b.String("tls-key", &cfg.TLSKey)
+	b.String("tls-ca", &cfg.TLSCA)
+	b.String("server-name", &cfg.ServerName)
+	b.String("known-hosts", &cfg.KnownHosts)
+	b.String("pin-mode", &cfg.PinMode)
+
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	errs := []error{
+		config.Address("exporter", cfg.Exporter, true),
+		config.LogLevel("log-level", cfg.LogLevel),
+		config.FileRequired("tls-cert", cfg.TLSCert),
+		config.FileRequired("tls-key", cfg.TLSKey),
+	}
+
+	if cfg.KnownHosts == "" {
+		errs = append(errs, config.FileRequired("tls-ca", cfg.TLSCA))
+	}
+
+	if _, err := pins.ParseMode(cfg.PinMode); err != nil {
+		errs = append(errs, fmt.Errorf("pin-mode: %w", err))
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// Connect to the exporter with the settings from the flags
+func dial(ctx context.Context, flags *pflag.FlagSet) (*client.Client, *zap.Logger, error) {
+	cfg, err := loadConnectConfig(flags)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger, err := config.NewLogger(cfg.LogLevel)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serverName := cfg.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(cfg.Exporter)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		serverName = host
+	}
+
+	var verify func(*x509.Certificate) error
+	if cfg.KnownHosts != "" {
+		kh, err := pins.Load(cfg.KnownHosts)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		verify = kh.Verifier(logger, cfg.Exporter, pins.Mode(cfg.PinMode))
+	}
+
+	tlsConfig, err := certs.ClientConfig(cfg.TLSCert, cfg.TLSKey, cfg.TLSCA, serverName, verify)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := client.Dial(ctx, cfg.Exporter, client.Options{
+		TLS: tlsConfig,
+		Logger: logger,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, logger, nil
+}
@@ -0,0 +1,283 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/tobias-urdin/snapback/client"
+
+	"github.com/spf13/cobra"
+)
+
+// The output formats
+const (
+	formatTable = "table"
+	formatJSON = "json"
+)
+
+// Returns the command that lists what an exporter can see
+func NewListCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "ls",
+		Short: "List pools, images or snapshots on an exporter",
+		Long: "List pools, images or snapshots on an exporter. Flags can also be set with " +
+			"environment variables, " + envPrefix + " followed by the flag name in upper case with - replaced by _.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	addConnectFlags(cmd.PersistentFlags())
+	cmd.PersistentFlags().String("format", formatTable, "output format, table or json")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "pools",
+		Short: "List the pools and namespaces on an exporter",
+		Args:  cobra.NoArgs,
+		RunE:  runListPools,
+	})
+
+	imagesCmd := &cobra.Command{
+		Use:   "images POOL",
+		Short: "List the images in a pool",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runListImages,
+	}
+
+	imagesCmd.Flags().String("namespace", "", "rbd namespace in the pool")
+	imagesCmd.Flags().String("glob", "", "only list images that matches the glob")
+	imagesCmd.Flags().String("regex", "", "only list images that matches the regular expression")
+	imagesCmd.Flags().Uint32("page-size", 0, "number of images that is requested at once, 0 lets the exporter decide")
+	imagesCmd.MarkFlagsMutuallyExclusive("glob", "regex")
+
+	cmd.AddCommand(imagesCmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "snapshots POOL/[NAMESPACE/]IMAGE",
+		Short: "List the snapshots of an image",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runListSnapshots,
+	})
+
+	return cmd
+}
+
+// Returns the output format from the flag
+func outputFormat(cmd *cobra.Command) (string, error) {
+	format, err := cmd.Flags().GetString("format")
+	if err != nil {
+		return "", err
+	}
+
+	if format != formatTable && format != formatJSON {
+		return "", fmt.Errorf("unknown format %q, must be %s or %s", format, formatTable, formatJSON)
+	}
+
+	return format, nil
+}
+
+// Write v as JSON, or the rows as a table with a header
+func writeOutput(w io.Writer, format string, v interface{}, header []string, rows [][]string) error {
+	if format == formatJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+
+	return tw.Flush()
+}
+
+// A pool in the output
+type poolOutput struct {
+	Name string `json:"name"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// An image in the output
+type imageOutput struct {
+	Name string `json:"name"`
+}
+
+// A snapshot in the output
+type snapshotOutput struct {
+	ID uint64 `json:"id"`
+	Name string `json:"name"`
+	Size uint64 `json:"size"`
+	Timestamp *time.Time `json:"timestamp,omitempty"`
+	Protected bool `json:"protected"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+func runListPools(cmd *cobra.Command, args []string) error {
+	// Errors after this is not usage errors
+	cmd.SilenceUsage = true
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	c, _, err := dial(cmd.Context(), cmd.Flags())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	result, err := c.ListPools(cmd.Context())
+	if errors.Is(err, client.ErrNotSupported) {
+		return errors.New("the exporter does not support listing pools, list the images in a known pool instead")
+	}
+	if err != nil {
+		return err
+	}
+
+	pools := make([]poolOutput, 0, len(result))
+	rows := make([][]string, 0, len(result))
+	for _, pool := range result {
+		pools = append(pools, poolOutput{
+			Name: pool.Name,
+			Namespaces: pool.Namespaces,
+		})
+
+		// NOTE: The default namespace is shown as - since
+		// it is the empty string.
+		namespaces := make([]string, 0, len(pool.Namespaces))
+		for _, namespace := range pool.Namespaces {
+			if namespace == "" {
+				namespace = "-"
+			}
+			namespaces = append(namespaces, namespace)
+		}
+
+		rows = append(rows, []string{pool.Name, strings.Join(namespaces, ",")})
+	}
+
+	return writeOutput(cmd.OutOrStdout(), format, pools, []string{"NAME", "NAMESPACES"}, rows)
+}
+
+func runListImages(cmd *cobra.Command, args []string) error {
+	// Errors after this is not usage errors
+	cmd.SilenceUsage = true
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	req := client.ListImagesRequest{
+		Pool: args[0],
+	}
+
+	flags := cmd.Flags()
+	if req.Namespace, err = flags.GetString("namespace"); err != nil {
+		return err
+	}
+
+	if req.Glob, err = flags.GetString("glob"); err != nil {
+		return err
+	}
+
+	if req.Regex, err = flags.GetString("regex"); err != nil {
+		return err
+	}
+
+	if req.PageSize, err = flags.GetUint32("page-size"); err != nil {
+		return err
+	}
+
+	c, _, err := dial(cmd.Context(), cmd.Flags())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	names, err := c.ListImages(cmd.Context(), &req)
+	if err != nil {
+		return err
+	}
+
+	images := make([]imageOutput, 0, len(names))
+	rows := make([][]string, 0, len(names))
+	for _, name := range names {
+		images = append(images, imageOutput{
+			Name: name,
+		})
+		rows = append(rows, []string{name})
+	}
+
+	return writeOutput(cmd.OutOrStdout(), format, images, []string{"NAME"}, rows)
+}
+
+func runListSnapshots(cmd *cobra.Command, args []string) error {
+	// Errors after this is not usage errors
+	cmd.SilenceUsage = true
+
+	format, err := outputFormat(cmd)
+	if err != nil {
+		return err
+	}
+
+	spec, err := parseImageSpec(args[0])
+	if err != nil {
+		return err
+	}
+
+	if spec.snapshot != "" {
+		return fmt.Errorf("%s: a snapshot cannot be given when listing snapshots", args[0])
+	}
+
+	c, _, err := dial(cmd.Context(), cmd.Flags())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	snaps, err := c.ListSnapshots(cmd.Context(), spec.clientSpec())
+	if err != nil {
+		return err
+	}
+
+	snapshots := make([]snapshotOutput, 0, len(snaps))
+	rows := make([][]string, 0, len(snaps))
+	for _, snap := range snaps {
+		out := snapshotOutput{
+			ID: snap.ID,
+			Name: snap.Name,
+			Size: snap.Size,
+			Protected: snap.Protected,
+			Namespace: snap.Namespace,
+		}
+
+		timestamp := ""
+		if !snap.Timestamp.IsZero() {
+			ts := snap.Timestamp
+			out.Timestamp = &ts
+			timestamp = snap.Timestamp.Format(time.RFC3339)
+		}
+
+		snapshots = append(snapshots, out)
+		rows = append(rows, []string{
+			strconv.FormatUint(snap.ID, 10),
+			snap.Name,
+			strconv.FormatUint(snap.Size, 10),
+			timestamp,
+			strconv.FormatBool(snap.Protected),
+			snap.Namespace,
+		})
+	}
+
+	header := []string{"ID", "NAME", "SIZE", "TIMESTAMP", "PROTECTED", "NAMESPACE"}
+	return writeOutput(cmd.OutOrStdout(), format, snapshots, header, rows)
+}
@@ -0,0 +1,167 @@
+package cli
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/tobias-urdin/snapback/client"
+
+	"github.com/spf13/cobra"
+	"go.uber.org/zap"
+)
+
+// An image and optional snapshot given as pool/[namespace/]image@snapshot
+type imageSpec struct {
+	pool string
+	namespace string
+	image string
+	snapshot string
+}
+
+// Returns the image on the exporter
+func (s *imageSpec) clientSpec() client.ImageSpec {
+	return client.ImageSpec{
+		Pool: s.pool,
+		Namespace: s.namespace,
+		Image: s.image,
+	}
+}
+
+// Parse pool/image or pool/namespace/image with an optional @snapshot
+func parseImageSpec(s string) (*imageSpec, error) {
+	name, snapshot, hasSnap := strings.Cut(s, "@")
+	parts := strings.Split(name, "/")
+
+	var pool, namespace, image string
+	switch len(parts) {
+	case 2:
+		pool, image = parts[0], parts[1]
+	case 3:
+		pool, namespace, image = parts[0], parts[1], parts[2]
+	}
+
+	if pool == "" || image == "" || (len(parts) == 3 && namespace == "") {
+		return nil, fmt.Errorf("%s: expected pool/image or pool/namespace/image with an optional @snapshot", s)
+	}
+
+	if hasSnap && snapshot == "" {
+		return nil, fmt.Errorf("%s: snapshot name is empty", s)
+	}
+
+	return &imageSpec{
+		pool: pool,
+		namespace: namespace,
+		image: image,
+		snapshot: snapshot,
+	}, nil
+}
+
+// Returns the command that pulls a diff from an exporter
+func NewPullCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pull POOL/[NAMESPACE/]IMAGE[@SNAPSHOT]",
+		Short: "Pull the diff of an image from an exporter",
+		Long: "Pull the diff of an image snapshot from an exporter in the rbd export-diff format, " +
+			"it can be applied with rbd import-diff. The image head is pulled if no snapshot is given. " +
+			"Flags can also be set with environment variables, " + envPrefix +
+			" followed by the flag name in upper case with - replaced by _.",
+		Args: cobra.ExactArgs(1),
+		RunE: runPull,
+	}
+
+	addConnectFlags(cmd.Flags())
+	cmd.Flags().String("from", "", "snapshot to pull the changes since, a full diff is pulled if empty")
+	cmd.Flags().StringP("output", "o", "", "file to write the diff to, - for stdout")
+	cmd.MarkFlagRequired("output")
+
+	return cmd
+}
+
+// Write the diff to a temporary file next to path that is renamed to
+// path once the whole diff has been written
+func writeFile(path string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		tmp.Close()
+		return n, err
+	}
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return n, err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return n, err
+	}
+
+	return n, os.Rename(tmp.Name(), path)
+}
+
+func runPull(cmd *cobra.Command, args []string) error {
+	// Errors after this is not usage errors
+	cmd.SilenceUsage = true
+
+	spec, err := parseImageSpec(args[0])
+	if err != nil {
+		return err
+	}
+
+	fromSnap, err := cmd.Flags().GetString("from")
+	if err != nil {
+		return err
+	}
+
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	// The export is cancelled on the exporter when we are interrupted
+	ctx, stop := signal.NotifyContext(cmd.Context(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	c, logger, err := dial(ctx, cmd.Flags())
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	r, err := c.Export(ctx, &client.ExportRequest{
+		Pool: spec.pool,
+		Namespace: spec.namespace,
+		Image: spec.image,
+		Snapshot: spec.snapshot,
+		FromSnapshot: fromSnap,
+	})
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var n int64
+	if output == "-" {
+		n, err = io.Copy(cmd.OutOrStdout(), r)
+	} else {
+		n, err = writeFile(output, r)
+	}
+	if err != nil {
+		return fmt.Errorf("pull %s: %w", args[0], err)
+	}
+
+	logger.Info("pulled diff", zap.String("image", args[0]), zap.String("from_snapshot", fromSnap),
+		zap.String("output", output), zap.Int64("bytes", n))
+
+	return nil
+}
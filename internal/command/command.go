@@ -1,8 +1,11 @@
 package command
 
 import (
+	"github.com/tobias-urdin/snapback/internal/certs"
+	"github.com/tobias-urdin/snapback/internal/cli"
 	"github.com/tobias-urdin/snapback/internal/exporter"
 	"github.com/tobias-urdin/snapback/internal/importer"
+	"github.com/tobias-urdin/snapback/internal/pins"
 
 	"github.com/spf13/cobra"
 )
@@ -20,6 +23,10 @@ func New() *cobra.Command {
 
 	cmd.AddCommand(exporter.NewCommand())
 	cmd.AddCommand(importer.NewCommand())
+	cmd.AddCommand(certs.NewCommand())
+	cmd.AddCommand(pins.NewCommand())
+	cmd.AddCommand(cli.NewListCommand())
+	cmd.AddCommand(cli.NewPullCommand())
 
 	return cmd
 }
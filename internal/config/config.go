@@ -0,0 +1,338 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"gopkg.in/yaml.v3"
+)
+
+// The name of the flag with the path to the config file
+const FlagName = "config"
+
+// Ceph cluster settings
+type Ceph struct {
+	// Path to the Ceph config file, the default locations is searched
+	// if it is empty
+	Config string `yaml:"config"`
+
+	// The cephx user without the client. prefix
+	User string `yaml:"user"`
+
+	// Path to the keyring for the cephx user
+	Keyring string `yaml:"keyring"`
+
+	// The name of the cluster
+	Cluster string `yaml:"cluster"`
+}
+
+// Returns the default Ceph settings
+func DefaultCeph() Ceph {
+	return Ceph{
+		User: "admin",
+		Cluster: "ceph",
+	}
+}
+
+// Add the flags for the Ceph settings
+func AddCephFlags(flags *pflag.FlagSet) {
+	defaults := DefaultCeph()
+
+	flags.String("ceph-config", defaults.Config, "ceph config file, the default locations is searched if empty")
+	flags.String("ceph-user", defaults.User, "cephx user without the client. prefix")
+	flags.String("ceph-keyring", defaults.Keyring, "keyring for the cephx user")
+	flags.String("ceph-cluster", defaults.Cluster, "name of the ceph cluster")
+}
+
+// Bind the flags for the Ceph settings
+func (c *Ceph) Bind(b *Binder) {
+	b.String("ceph-config", &c.Config)
+	b.String("ceph-user", &c.User)
+	b.String("ceph-keyring", &c.Keyring)
+	b.String("ceph-cluster", &c.Cluster)
+}
+
+// Validate the Ceph settings
+func (c *Ceph) Validate() error {
+	var errs []error
+
+	if c.User == "" {
+		errs = append(errs, errors.New("ceph.user: is required"))
+	} else if strings.HasPrefix(c.User, "client.") {
+		errs = append(errs, fmt.Errorf("ceph.user: %q must not have the client. prefix", c.User))
+	}
+
+	if c.Cluster == "" {
+		errs = append(errs, errors.New("ceph.cluster: is required"))
+	}
+
+	errs = append(errs, FileExists("ceph.config", c.Config))
+	errs = append(errs, FileExists("ceph.keyring", c.Keyring))
+
+	return errors.Join(errs...)
+}
+
+// Load the YAML config file into v, fields that is not in v is an error
+func Load(path string, v interface{}) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+
+	if err := dec.Decode(v); err != nil && err != io.EOF {
+		return fmt.Errorf("parse config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Binder sets fields in the config from the flags that is given on the
+// command line, or from environment variables for flags that is not given.
+// Fields without a flag or environment variable keeps their value from the
+// config file or the default. The environment variable for a flag is the
+// prefix followed by the flag name in upper case with - replaced by _.
+type Binder struct {
+	// The flags
+	flags *pflag.FlagSet
+
+	// The prefix for environment variables
+	envPrefix string
+
+	// The errors from parsing flags and environment variables
+	errs []error
+}
+
+// Returns a new Binder for the flags
+func NewBinder(flags *pflag.FlagSet, envPrefix string) *Binder {
+	return &Binder{
+		flags: flags,
+		envPrefix: envPrefix,
+	}
+}
+
+// Returns the environment variable for a flag
+func (b *Binder) EnvName(name string) string {
+	return b.envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Returns the value from the environment variable for a flag
+func (b *Binder) env(name string) (string, bool) {
+	return os.LookupEnv(b.EnvName(name))
+}
+
+// Record an error for a flag or environment variable
+func (b *Binder) fail(name string, fromEnv bool, err error) {
+	if fromEnv {
+		b.errs = append(b.errs, fmt.Errorf("%s: %w", b.EnvName(name), err))
+		return
+	}
+
+	b.errs = append(b.errs, fmt.Errorf("--%s: %w", name, err))
+}
+
+// Bind a string
+func (b *Binder) String(name string, field *string) {
+	if b.flags.Changed(name) {
+		value, err := b.flags.GetString(name)
+		if err != nil {
+			b.fail(name, false, err)
+			return
+		}
+
+		*field = value
+	} else if value, ok := b.env(name); ok {
+		*field = value
+	}
+}
+
+// Bind an int
+func (b *Binder) Int(name string, field *int) {
+	if b.flags.Changed(name) {
+		value, err := b.flags.GetInt(name)
+		if err != nil {
+			b.fail(name, false, err)
+			return
+		}
+
+		*field = value
+	} else if env, ok := b.env(name); ok {
+		value, err := strconv.Atoi(env)
+		if err != nil {
+			b.fail(name, true, fmt.Errorf("invalid integer %q", env))
+			return
+		}
+
+		*field = value
+	}
+}
+
+// Bind a duration
+func (b *Binder) Duration(name string, field *time.Duration) {
+	if b.flags.Changed(name) {
+		value, err := b.flags.GetDuration(name)
+		if err != nil {
+			b.fail(name, false, err)
+			return
+		}
+
+		*field = value
+	} else if env, ok := b.env(name); ok {
+		value, err := time.ParseDuration(env)
+		if err != nil {
+			b.fail(name, true, fmt.Errorf("invalid duration %q", env))
+			return
+		}
+
+		*field = value
+	}
+}
+
+// Bind a list of strings, the environment variable is comma separated
+func (b *Binder) StringSlice(name string, field *[]string) {
+	if b.flags.Changed(name) {
+		value, err := b.flags.GetStringSlice(name)
+		if err != nil {
+			b.fail(name, false, err)
+			return
+		}
+
+		*field = value
+	} else if env, ok := b.env(name); ok {
+		*field = splitList(env)
+	}
+}
+
+// Bind a map of strings, the environment variable is comma separated
+// key=value pairs
+func (b *Binder) StringToString(name string, field *map[string]string) {
+	if b.flags.Changed(name) {
+		value, err := b.flags.GetStringToString(name)
+		if err != nil {
+			b.fail(name, false, err)
+			return
+		}
+
+		*field = value
+	} else if env, ok := b.env(name); ok {
+		value := map[string]string{}
+		for _, pair := range splitList(env) {
+			key, val, found := strings.Cut(pair, "=")
+			if !found {
+				b.fail(name, true, fmt.Errorf("%q is not a key=value pair", pair))
+				return
+			}
+
+			value[key] = val
+		}
+
+		*field = value
+	}
+}
+
+// Returns the errors from parsing flags and environment variables
+func (b *Binder) Err() error {
+	return errors.Join(b.errs...)
+}
+
+// Split a comma separated list, empty items is skipped
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+// Returns the config file from the flag or environment variable
+func (b *Binder) ConfigFile() string {
+	path := ""
+	b.String(FlagName, &path)
+	return path
+}
+
+// Returns an error if the address is not a host and port
+func Address(field string, addr string, requireHost bool) error {
+	if addr == "" {
+		return fmt.Errorf("%s: is required", field)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("%s: invalid address %q: %w", field, addr, err)
+	}
+
+	if requireHost && host == "" {
+		return fmt.Errorf("%s: address %q has no host", field, addr)
+	}
+
+	if n, err := strconv.Atoi(port); err != nil || n <= 0 || n > 65535 {
+		return fmt.Errorf("%s: address %q has an invalid port", field, addr)
+	}
+
+	return nil
+}
+
+// Returns an error if the path is set and is not a readable file
+func FileExists(field string, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+
+	if info.IsDir() {
+		return fmt.Errorf("%s: %s is a directory", field, path)
+	}
+
+	return nil
+}
+
+// Returns an error if the path is not set or is not a readable file
+func FileRequired(field string, path string) error {
+	if path == "" {
+		return fmt.Errorf("%s: is required", field)
+	}
+
+	return FileExists(field, path)
+}
+
+// Returns an error if the log level is invalid
+func LogLevel(field string, level string) error {
+	if _, err := zapcore.ParseLevel(level); err != nil {
+		return fmt.Errorf("%s: %w", field, err)
+	}
+
+	return nil
+}
+
+// Returns a production logger that logs at the level
+func NewLogger(level string) (*zap.Logger, error) {
+	lvl, err := zapcore.ParseLevel(level)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := zap.NewProductionConfig()
+	cfg.Level = zap.NewAtomicLevelAt(lvl)
+
+	return cfg.Build()
+}
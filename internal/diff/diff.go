@@ -0,0 +1,34 @@
+package diff
+
+// The rbd export-diff format version 1, all integers are little-endian
+//
+//	"rbd diff v1\n"
+//	'f' <u32 length> <from snapshot name>    (optional)
+//	't' <u32 length> <to snapshot name>      (optional)
+//	's' <u64 image size>
+//	'w' <u64 offset> <u64 length> <data>     (repeated)
+//	'z' <u64 offset> <u64 length>            (repeated)
+//	'e'
+
+const (
+	// The magic that starts a diff
+	Magic = "rbd diff v1\n"
+
+	// Record with the name of the snapshot the diff starts from
+	RecordFromSnap = 'f'
+
+	// Record with the name of the snapshot the diff ends at
+	RecordToSnap = 't'
+
+	// Record with the size of the image
+	RecordSize = 's'
+
+	// Record with data that is written at an offset
+	RecordData = 'w'
+
+	// Record with a range that is zeroed
+	RecordZero = 'z'
+
+	// Record that ends the diff
+	RecordEnd = 'e'
+)
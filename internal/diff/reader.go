@@ -0,0 +1,285 @@
+package diff
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// The longest snapshot name that is accepted in a diff
+const maxNameLength = 4096
+
+// The largest piece of a data record that is written to the target at
+// once, each write to an rbd image is a round trip to the cluster
+const writeSize = 4 * 1024 * 1024
+
+// Returned when the diff is not in the rbd export-diff format
+var ErrInvalidDiff = errors.New("invalid diff")
+
+// The header of a diff
+type Header struct {
+	// The snapshot the diff starts from, empty for a full diff
+	FromSnap string
+
+	// The snapshot the diff ends at, empty for the image head
+	ToSnap string
+
+	// The size of the image
+	Size uint64
+}
+
+// Target is what a diff is applied to
+type Target interface {
+	// Write data at an offset
+	WriteAt(p []byte, off int64) (int, error)
+
+	// Zero a range
+	Zero(offset uint64, length uint64) error
+}
+
+// Counts the bytes that is read
+type countingReader struct {
+	r io.Reader
+
+	// The offset in the diff of the next byte
+	offset uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.offset += uint64(n)
+
+	return n, err
+}
+
+// Reader reads a diff in the rbd export-diff format
+type Reader struct {
+	r *countingReader
+
+	// The offset in the diff after the header or the last record that
+	// was applied
+	applied uint64
+
+	// Called after each record that is applied, see OnApplied
+	onApplied func(applied uint64) error
+
+	// The buffer data records is written to the target from
+	buf []byte
+}
+
+// Returns a new Reader that reads the diff from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: &countingReader{
+			r: r,
+		},
+	}
+}
+
+// Returns a new Reader that reads the rest of a diff from r, it starts
+// at the offset in the diff which must be an offset returned by Applied.
+// Apply is called with the header that was read before.
+func NewResumeReader(r io.Reader, offset uint64) *Reader {
+	return &Reader{
+		r: &countingReader{
+			r: r,
+			offset: offset,
+		},
+		applied: offset,
+	}
+}
+
+// Returns the offset in the diff after the header or the last record
+// that was applied, a diff that was interrupted can be resumed from it
+func (dr *Reader) Applied() uint64 {
+	return dr.applied
+}
+
+// Call fn after each record that is applied with the offset that Applied
+// returns, Apply stops with the error from fn
+func (dr *Reader) OnApplied(fn func(applied uint64) error) {
+	dr.onApplied = fn
+}
+
+// Mark the record that was read last as applied
+func (dr *Reader) recordApplied() error {
+	dr.applied = dr.r.offset
+
+	if dr.onApplied == nil {
+		return nil
+	}
+
+	return dr.onApplied(dr.applied)
+}
+
+// Read a record type
+func (dr *Reader) readRecord() (byte, error) {
+	var buf [1]byte
+	if _, err := io.ReadFull(dr.r, buf[:]); err != nil {
+		return 0, unexpected(err)
+	}
+
+	return buf[0], nil
+}
+
+// Read a little-endian uint64
+func (dr *Reader) readUint64() (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(dr.r, buf[:]); err != nil {
+		return 0, unexpected(err)
+	}
+
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// Read a snapshot name
+func (dr *Reader) readName() (string, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(dr.r, buf[:]); err != nil {
+		return "", unexpected(err)
+	}
+
+	length := binary.LittleEndian.Uint32(buf[:])
+	if length > maxNameLength {
+		return "", fmt.Errorf("%w: snapshot name length %d exceeds maximum of %d", ErrInvalidDiff, length, maxNameLength)
+	}
+
+	name := make([]byte, length)
+	if _, err := io.ReadFull(dr.r, name); err != nil {
+		return "", unexpected(err)
+	}
+
+	return string(name), nil
+}
+
+// Returns io.ErrUnexpectedEOF for io.EOF since the diff ended early
+func unexpected(err error) error {
+	if err == io.EOF {
+		return fmt.Errorf("%w: %w", ErrInvalidDiff, io.ErrUnexpectedEOF)
+	}
+
+	return err
+}
+
+// Read the header, it must be read before the diff is applied
+func (dr *Reader) ReadHeader() (*Header, error) {
+	buf := make([]byte, len(Magic))
+	if _, err := io.ReadFull(dr.r, buf); err != nil {
+		return nil, unexpected(err)
+	}
+
+	if string(buf) != Magic {
+		return nil, fmt.Errorf("%w: bad header %q", ErrInvalidDiff, buf)
+	}
+
+	var header Header
+
+	for {
+		record, err := dr.readRecord()
+		if err != nil {
+			return nil, err
+		}
+
+		switch record {
+		case RecordFromSnap:
+			if header.FromSnap, err = dr.readName(); err != nil {
+				return nil, err
+			}
+		case RecordToSnap:
+			if header.ToSnap, err = dr.readName(); err != nil {
+				return nil, err
+			}
+		case RecordSize:
+			if header.Size, err = dr.readUint64(); err != nil {
+				return nil, err
+			}
+
+			// The size is the last record of the header
+			dr.applied = dr.r.offset
+			return &header, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected record %q in header", ErrInvalidDiff, record)
+		}
+	}
+}
+
+// Apply the records after the header to the target until the end of the
+// diff, writes past the size in the header is rejected.
+func (dr *Reader) Apply(header *Header, t Target) error {
+	for {
+		record, err := dr.readRecord()
+		if err != nil {
+			return err
+		}
+
+		if record == RecordEnd {
+			dr.applied = dr.r.offset
+			return nil
+		}
+
+		if record != RecordData && record != RecordZero {
+			return fmt.Errorf("%w: unexpected record %q", ErrInvalidDiff, record)
+		}
+
+		offset, err := dr.readUint64()
+		if err != nil {
+			return err
+		}
+
+		length, err := dr.readUint64()
+		if err != nil {
+			return err
+		}
+
+		if offset > header.Size || length > header.Size-offset {
+			return fmt.Errorf("%w: extent at offset %d with length %d exceeds image size %d",
+				ErrInvalidDiff, offset, length, header.Size)
+		}
+
+		if record == RecordZero {
+			if err := t.Zero(offset, length); err != nil {
+				return err
+			}
+
+			if err := dr.recordApplied(); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		if err := dr.writeData(t, offset, length); err != nil {
+			return err
+		}
+
+		if err := dr.recordApplied(); err != nil {
+			return err
+		}
+	}
+}
+
+// Read the data of a data record and write it to the target at the
+// offset, in pieces of at most writeSize bytes
+func (dr *Reader) writeData(t Target, offset uint64, length uint64) error {
+	for length > 0 {
+		n := min(length, writeSize)
+		if uint64(cap(dr.buf)) < n {
+			dr.buf = make([]byte, n)
+		}
+
+		buf := dr.buf[:n]
+		if _, err := io.ReadFull(dr.r, buf); err != nil {
+			return unexpected(err)
+		}
+
+		if _, err := t.WriteAt(buf, int64(offset)); err != nil {
+			return err
+		}
+
+		offset += n
+		length -= n
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package diff
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+// A target in memory that counts the writes to it
+type testTarget struct {
+	data []byte
+	writes int
+}
+
+func (t *testTarget) WriteAt(p []byte, off int64) (int, error) {
+	t.writes++
+	return copy(t.data[off:], p), nil
+}
+
+func (t *testTarget) Zero(offset uint64, length uint64) error {
+	clear(t.data[offset : offset+length])
+	return nil
+}
+
+func TestApplyLargeExtent(t *testing.T) {
+	size := 2*writeSize + 1000
+
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	var buf bytes.Buffer
+	dw := NewWriter(&buf)
+
+	if err := dw.WriteHeader("", "s1", uint64(size)); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+
+	if err := dw.WriteData(0, data); err != nil {
+		t.Fatalf("write data: %v", err)
+	}
+
+	if err := dw.WriteEnd(); err != nil {
+		t.Fatalf("write end: %v", err)
+	}
+
+	// The extent is written in pieces of writeSize and not in the
+	// small pieces it is read in
+	target := &testTarget{data: make([]byte, size)}
+	dr := NewReader(iotest.HalfReader(bytes.NewReader(buf.Bytes())))
+
+	header, err := dr.ReadHeader()
+	if err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	if err := dr.Apply(header, target); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+
+	if !bytes.Equal(target.data, data) {
+		t.Fatal("target is not equal to the diff")
+	}
+
+	if target.writes != 3 {
+		t.Fatalf("got %d writes, expected 3", target.writes)
+	}
+
+	// A diff that ends in the middle of the extent is truncated
+	dr = NewReader(bytes.NewReader(buf.Bytes()[:buf.Len()-writeSize]))
+
+	if header, err = dr.ReadHeader(); err != nil {
+		t.Fatalf("read header: %v", err)
+	}
+
+	if err := dr.Apply(header, &testTarget{data: make([]byte, size)}); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v, expected io.ErrUnexpectedEOF", err)
+	}
+}
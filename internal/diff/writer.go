@@ -0,0 +1,88 @@
+package diff
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// Writer writes a diff in the rbd export-diff format
+type Writer struct {
+	w io.Writer
+}
+
+// Returns a new Writer that writes the diff to w
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{
+		w: w,
+	}
+}
+
+// Write the header, the snapshot names is optional and the size
+// is the size of the image at the to snapshot.
+func (dw *Writer) WriteHeader(fromSnap string, toSnap string, size uint64) error {
+	if _, err := io.WriteString(dw.w, Magic); err != nil {
+		return err
+	}
+
+	if fromSnap != "" {
+		if err := dw.writeName(RecordFromSnap, fromSnap); err != nil {
+			return err
+		}
+	}
+
+	if toSnap != "" {
+		if err := dw.writeName(RecordToSnap, toSnap); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 9)
+	buf[0] = RecordSize
+	binary.LittleEndian.PutUint64(buf[1:], size)
+
+	_, err := dw.w.Write(buf)
+	return err
+}
+
+// Write a record with a snapshot name
+func (dw *Writer) writeName(record byte, name string) error {
+	buf := make([]byte, 5+len(name))
+	buf[0] = record
+	binary.LittleEndian.PutUint32(buf[1:5], uint32(len(name)))
+	copy(buf[5:], name)
+
+	_, err := dw.w.Write(buf)
+	return err
+}
+
+// Write a record with an offset and length
+func (dw *Writer) writeExtent(record byte, offset uint64, length uint64) error {
+	buf := make([]byte, 17)
+	buf[0] = record
+	binary.LittleEndian.PutUint64(buf[1:9], offset)
+	binary.LittleEndian.PutUint64(buf[9:17], length)
+
+	_, err := dw.w.Write(buf)
+	return err
+}
+
+// Write data at an offset
+func (dw *Writer) WriteData(offset uint64, data []byte) error {
+	if err := dw.writeExtent(RecordData, offset, uint64(len(data))); err != nil {
+		return err
+	}
+
+	_, err := dw.w.Write(data)
+	return err
+}
+
+// Write a range that is zeroed
+func (dw *Writer) WriteZero(offset uint64, length uint64) error {
+	return dw.writeExtent(RecordZero, offset, length)
+}
+
+// Write the end of the diff
+func (dw *Writer) WriteEnd() error {
+	_, err := dw.w.Write([]byte{RecordEnd})
+	return err
+}
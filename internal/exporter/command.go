@@ -1,8 +1,16 @@
 package exporter
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/backend/ceph"
+	"github.com/tobias-urdin/snapback/internal/backend/file"
+	"github.com/tobias-urdin/snapback/internal/config"
+	"github.com/tobias-urdin/snapback/internal/message"
+	"github.com/tobias-urdin/snapback/internal/policy"
+
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -11,29 +19,86 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "exporter",
 		Short: "Run exporter",
-		Long:  "TODO",
-		Run:   runCommand,
+		Long: "Run exporter. Settings is read from the --config file, " +
+			"environment variables and flags, in that order. The environment variable for a " +
+			"flag is " + envPrefix + " followed by the flag name in upper case with - replaced by _.",
+		Run: runCommand,
 	}
+
+	addConfigFlags(cmd.Flags())
+
 	return cmd
 }
 
 func runCommand(cmd *cobra.Command, args []string) {
-	logger, err := zap.NewProduction()
+	cfg, err := loadConfig(cmd.Flags())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := config.NewLogger(cfg.LogLevel)
 	if err != nil {
 		panic(err)
 	}
 	defer logger.Sync()
 
-	if err := runExporter(cmd, logger); err != nil {
+	if err := runExporter(cfg, logger); err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
-func runExporter(cmd *cobra.Command, logger *zap.Logger) error {
+func newBackend(cfg *Config, logger *zap.Logger) (backend.Backend, error) {
+	switch cfg.Backend {
+	case "ceph":
+		return ceph.New(logger, ceph.Options{
+			ConfigFile: cfg.Ceph.Config,
+			User: cfg.Ceph.User,
+			Keyring: cfg.Ceph.Keyring,
+			Cluster: cfg.Ceph.Cluster,
+		})
+	case "file":
+		return file.New(logger, cfg.BackendPath)
+	}
+
+	return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+}
+
+func runExporter(cfg *Config, logger *zap.Logger) error {
 	logger.Info("starting exporter")
 
-	exp := NewExporter(logger)
+	var accessPolicy *policy.Policy
+	if cfg.Policy != "" {
+		var err error
+		if accessPolicy, err = policy.Load(cfg.Policy); err != nil {
+			return err
+		}
+	} else {
+		logger.Warn("no access policy, all clients can access all pools")
+	}
+
+	codec, err := message.ParseCodec(cfg.Compression)
+	if err != nil {
+		return err
+	}
+
+	b, err := newBackend(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	exp := NewExporter(logger, b, Options{
+		Listen: cfg.Listen,
+		MaxExports: cfg.MaxExports,
+		WatchInterval: cfg.WatchInterval,
+		Compression: codec,
+		ChunkSize: cfg.ChunkSize,
+		TLSCert: cfg.TLS.Cert,
+		TLSKey: cfg.TLS.Key,
+		TLSCA: cfg.TLS.CA,
+		Policy: accessPolicy,
+	})
 
 	if err := exp.Init(); err != nil {
 		return err
@@ -0,0 +1,184 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/config"
+	"github.com/tobias-urdin/snapback/internal/message"
+
+	"github.com/spf13/pflag"
+)
+
+// The prefix of the environment variables for the exporter
+const envPrefix = "SNAPBACK_EXPORTER_"
+
+// The default address the exporter listens on
+const DefaultListen = "localhost:4242"
+
+// The default codec export chunks is compressed with
+const DefaultCompression = "zstd"
+
+// TLS settings for the exporter
+type TLSConfig struct {
+	// The certificate the exporter identifies itself with
+	Cert string `yaml:"cert"`
+
+	// The private key for the certificate
+	Key string `yaml:"key"`
+
+	// The CA that importer certificates must be signed by
+	CA string `yaml:"ca"`
+}
+
+// Exporter config, it is loaded from a YAML file and overridden by
+// environment variables and flags.
+type Config struct {
+	// The address to listen on
+	Listen string `yaml:"listen"`
+
+	// The maximum number of exports that can run at once
+	MaxExports int `yaml:"max-exports"`
+
+	// The time between checks for changes in subscribed images
+	WatchInterval time.Duration `yaml:"watch-interval"`
+
+	// The codec export chunks is compressed with, zstd, lz4 or none
+	Compression string `yaml:"compression"`
+
+	// The size of an export chunk in bytes
+	ChunkSize int `yaml:"chunk-size"`
+
+	// The log level
+	LogLevel string `yaml:"log-level"`
+
+	// The storage backend, ceph or file
+	Backend string `yaml:"backend"`
+
+	// The root directory for the file backend
+	BackendPath string `yaml:"backend-path"`
+
+	// The file with the access policy for clients
+	Policy string `yaml:"policy"`
+
+	// The Ceph cluster for the ceph backend
+	Ceph config.Ceph `yaml:"ceph"`
+
+	// TLS settings
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// Returns the default config
+func DefaultConfig() Config {
+	return Config{
+		Listen: DefaultListen,
+		MaxExports: DefaultMaxExports,
+		WatchInterval: DefaultWatchInterval,
+		Compression: DefaultCompression,
+		ChunkSize: DefaultChunkSize,
+		LogLevel: "info",
+		Backend: "ceph",
+		Ceph: config.DefaultCeph(),
+	}
+}
+
+// Add the flags for the config
+func addConfigFlags(flags *pflag.FlagSet) {
+	defaults := DefaultConfig()
+
+	flags.String(config.FlagName, "", "YAML config file")
+	flags.String("listen", defaults.Listen, "address to listen on")
+	flags.Int("max-exports", defaults.MaxExports, "maximum number of exports that can run at once")
+	flags.Duration("watch-interval", defaults.WatchInterval, "time between checks for changes in images that importers is subscribed to")
+	flags.String("compression", defaults.Compression, "codec export chunks is compressed with, zstd, lz4 or none")
+	flags.Int("chunk-size", defaults.ChunkSize, "size of an export chunk in bytes")
+	flags.String("log-level", defaults.LogLevel, "log level, debug, info, warn or error")
+	flags.String("backend", defaults.Backend, "storage backend to export from, ceph or file")
+	flags.String("backend-path", defaults.BackendPath, "root directory for the file backend")
+	flags.String("policy", defaults.Policy, "file with the access policy for clients, all clients can access everything without it")
+	config.AddCephFlags(flags)
+	flags.String("tls-cert", defaults.TLS.Cert, "certificate the exporter identifies itself with")
+	flags.String("tls-key", defaults.TLS.Key, "private key for the certificate")
+	flags.String("tls-ca", defaults.TLS.CA, "ca that importer certificates must be signed by")
+}
+
+// Load the config from the config file, environment variables and flags
+// and validate it
+func loadConfig(flags *pflag.FlagSet) (*Config, error) {
+	cfg := DefaultConfig()
+	b := config.NewBinder(flags, envPrefix)
+
+	if path := b.ConfigFile(); path != "" {
+		if err := config.Load(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	b.String("listen", &cfg.Listen)
+	b.Int("max-exports", &cfg.MaxExports)
+	b.Duration("watch-interval", &cfg.WatchInterval)
+	b.String("compression", &cfg.Compression)
+	b.Int("chunk-size", &cfg.ChunkSize)
+	b.String("log-level", &cfg.LogLevel)
+	b.String("backend", &cfg.Backend)
+	b.String("backend-path", &cfg.BackendPath)
+	b.String("policy", &cfg.Policy)
+	cfg.Ceph.Bind(b)
+	b.String("tls-cert", &cfg.TLS.Cert)
+	b.String("tls-key", &cfg.TLS.Key)
+	b.String("tls-ca", &cfg.TLS.CA)
+
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	return &cfg, nil
+}
+
+// Validate the config, all errors is returned
+func (c *Config) Validate() error {
+	var errs []error
+
+	errs = append(errs, config.Address("listen", c.Listen, false))
+
+	if c.MaxExports < 1 {
+		errs = append(errs, fmt.Errorf("max-exports: must be at least 1, got %d", c.MaxExports))
+	}
+
+	if c.WatchInterval < time.Second {
+		errs = append(errs, fmt.Errorf("watch-interval: must be at least 1s, got %s", c.WatchInterval))
+	}
+
+	if _, err := message.ParseCodec(c.Compression); err != nil {
+		errs = append(errs, fmt.Errorf("compression: must be zstd, lz4 or none, got %q", c.Compression))
+	}
+
+	if c.ChunkSize < MinChunkSize || c.ChunkSize > MaxChunkSize {
+		errs = append(errs, fmt.Errorf("chunk-size: must be between %d and %d, got %d", MinChunkSize, MaxChunkSize, c.ChunkSize))
+	}
+
+	errs = append(errs, config.LogLevel("log-level", c.LogLevel))
+
+	switch c.Backend {
+	case "ceph":
+		errs = append(errs, c.Ceph.Validate())
+	case "file":
+		if c.BackendPath == "" {
+			errs = append(errs, errors.New("backend-path: is required for the file backend"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("backend: unknown backend %q, must be ceph or file", c.Backend))
+	}
+
+	errs = append(errs, config.FileExists("policy", c.Policy))
+	errs = append(errs, config.FileRequired("tls.cert", c.TLS.Cert))
+	errs = append(errs, config.FileRequired("tls.key", c.TLS.Key))
+	errs = append(errs, config.FileRequired("tls.ca", c.TLS.CA))
+
+	return errors.Join(errs...)
+}
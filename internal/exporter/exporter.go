@@ -1,47 +1,129 @@
 package exporter
 
 import (
+	"crypto/sha256"
+	"encoding/base64"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"sort"
 	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 	"context"
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/tls"
 	"crypto/x509"
-	"encoding/pem"
-	"math/big"
 
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/certs"
+	"github.com/tobias-urdin/snapback/internal/filter"
 	"github.com/tobias-urdin/snapback/internal/message"
+	"github.com/tobias-urdin/snapback/internal/policy"
+	"github.com/tobias-urdin/snapback/internal/version"
 
 	"go.uber.org/zap"
 	"github.com/quic-go/quic-go"
+)
+
+// The default number of exports that can run at once
+const DefaultMaxExports = 4
+
+// The default size of an export chunk
+const DefaultChunkSize = 4 * 1024 * 1024
 
-	"github.com/ceph/go-ceph/rados"
-	"github.com/ceph/go-ceph/rbd"
+// The smallest and largest size of an export chunk
+const (
+	MinChunkSize = 64 * 1024
+	MaxChunkSize = 8 * 1024 * 1024
 )
 
-// Exporter address
-// TODO(tobias.urdin): Hardcoded
-const exporterAddr = "localhost:4242"
+// The number of images in a list pool page when the request has no limit
+const defaultListLimit = 1000
+
+// The maximum number of images in a list pool page
+const maxListLimit = 10000
+
+// Exporter options
+type Options struct {
+	// The address to listen on
+	Listen string
+
+	// The maximum number of exports that can run at once
+	MaxExports int
+
+	// The time between checks for changes in subscribed images
+	WatchInterval time.Duration
+
+	// The codec export chunks is compressed with when the importer
+	// supports it, CodecNone turns compression off
+	Compression message.Codec
+
+	// The size of an export chunk, the last chunk of an export can be
+	// smaller
+	ChunkSize int
+
+	// The certificate and key the exporter identifies itself with
+	TLSCert string
+	TLSKey string
+
+	// The CA that importer certificates must be signed by
+	TLSCA string
+
+	// The access policy for clients, all clients has access to
+	// everything if it is nil
+	Policy *policy.Policy
+}
 
 // Exporter
 type Exporter struct {
 	// Logger
 	logger *zap.Logger
 
+	// Options
+	opts Options
+
 	// Message handler
 	handler *message.MessageHandler
 
-	// Rados
-	conn *rados.Conn
+	// Storage backend
+	backend backend.Backend
+
+	// Holds a slot for each running export
+	exports chan struct{}
+
+	// The buffers for export chunks
+	buffers *sync.Pool
+
+	// Holds a slot for each subscription that checks for changes
+	watches chan struct{}
 }
 
-// Create a new exporter
-func NewExporter(logger *zap.Logger) *Exporter {
+// Create a new exporter that exports images from the backend
+func NewExporter(logger *zap.Logger, b backend.Backend, opts Options) *Exporter {
+	if opts.Listen == "" {
+		opts.Listen = DefaultListen
+	}
+
+	if opts.MaxExports <= 0 {
+		opts.MaxExports = DefaultMaxExports
+	}
+
+	if opts.WatchInterval <= 0 {
+		opts.WatchInterval = DefaultWatchInterval
+	}
+
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+
 	return &Exporter{
 		logger: logger,
+		opts: opts,
+		backend: b,
+		exports: make(chan struct{}, opts.MaxExports),
+		buffers: newBufferPool(opts.ChunkSize),
+		watches: make(chan struct{}, maxWatches),
 	}
 }
 
@@ -52,43 +134,220 @@ func (e *Exporter) Init() error {
 	e.handler = message.NewHandler(e.logger)
 
 	e.handler.AddHandler(message.ErrorType, 1, e.handleErrorV1)
+	e.handler.AddHandler(message.ErrorType, 2, e.handleErrorV2)
 	e.handler.AddHandler(message.ListPoolRequestType, 1, e.handleListPoolRequestV1)
+	e.handler.AddHandler(message.ListPoolRequestType, 2, e.handleListPoolRequestV2)
+	e.handler.AddHandler(message.ListPoolsRequestType, 1, e.handleListPoolsRequestV1)
 	e.handler.AddHandler(message.ListSnapshotsRequestType, 1, e.handleListSnapshotsRequestV1)
+	e.handler.AddHandler(message.ImageInfoRequestType, 1, e.handleImageInfoRequestV1)
 	e.handler.AddHandler(message.ExportRequestType, 1, e.handleExportRequestV1)
+	e.handler.AddHandler(message.ExportRequestType, 2, e.handleExportRequestV2)
+	e.handler.AddHandler(message.ExportRequestType, 3, e.handleExportRequestV3)
+	e.handler.AddHandler(message.SubscribeRequestType, 1, e.handleSubscribeRequestV1)
 
-	e.logger.Info("connecting to rados")
+	return nil
+}
 
-	conn, err := rados.NewConn()
-	if err != nil {
-		return err
+// Close exporter
+func (e *Exporter) Close() {
+	e.logger.Info("close exporter")
+
+	if err := e.backend.Close(); err != nil {
+		e.logger.Error("failed to close backend", zap.Error(err))
 	}
-	e.conn = conn
+}
+
+// Returns the protocol capabilities of the exporter
+func (e *Exporter) capabilities() *message.Capabilities {
+	return &message.Capabilities{
+		SoftwareVersion: version.Version,
+		Messages: map[message.MessageType][]message.MessageVersion{
+			message.ErrorType: {1, 2},
+			message.ListPoolRequestType: {1, 2},
+			message.ListPoolResponseType: {1, 2},
+			message.ListSnapshotsRequestType: {1},
+			message.ListSnapshotsResponseType: {1, 2},
+			message.ExportRequestType: {1, 2, 3},
+			message.ExportResponseType: {1, 2},
+			message.ExportChunkType: {1, 2, 3},
+			message.ImageInfoRequestType: {1},
+			message.ImageInfoResponseType: {1, 2},
+			message.ListPoolsRequestType: {1},
+			message.ListPoolsResponseType: {1},
+			message.SubscribeRequestType: {1},
+			message.SubscribeResponseType: {1},
+			message.EventType: {1},
+			message.CancelExportType: {1},
+		},
+		// A peer that cannot list or export is refused at the handshake
+		Required: []message.MessageType{
+			message.ErrorType,
+			message.ListPoolRequestType,
+			message.ListPoolResponseType,
+			message.ListSnapshotsRequestType,
+			message.ListSnapshotsResponseType,
+			message.ExportRequestType,
+			message.ExportResponseType,
+			message.ExportChunkType,
+		},
+		Features: []message.Feature{
+			message.FeatureNamespaces,
+			message.FeatureResume,
+			message.FeatureCompression,
+		},
+		Codecs: message.Codecs,
+	}
+}
 
-	// TODO(tobias.urdin): Dont use default config, use options to determine
-	// what ceph config file and cephx user should be used
-	if err := e.conn.ReadDefaultConfigFile(); err != nil {
-		panic(err)
+// Handle error message version 1
+func (e *Exporter) handleErrorV1(ctx *message.Context) error {
+	// NOTE: Errors from the peer is only logged, returning
+	// an error here would send an error back and the peers could end up
+	// sending errors to each other forever.
+	ctx.Logger().Warn("error from peer", zap.Error(ctx.Message().AsError()))
+	return nil
+}
+
+// Handle error message version 2
+func (e *Exporter) handleErrorV2(ctx *message.Context) error {
+	ctx.Logger().Warn("error from peer", zap.Error(ctx.Message().AsError()))
+	return nil
+}
+
+// Returns the protocol error for an error from the backend
+func backendError(err error) error {
+	switch {
+	case errors.Is(err, backend.ErrNotFound):
+		return message.NewError(message.ErrorCodeNotFound, "%s", err.Error())
+	case errors.Is(err, backend.ErrPermissionDenied):
+		return message.NewError(message.ErrorCodePermissionDenied, "%s", err.Error())
 	}
 
-	if err := e.conn.Connect(); err != nil {
+	var protoErr *message.Error
+	if errors.As(err, &protoErr) {
 		return err
 	}
 
+	return message.NewError(message.ErrorCodeBackendFailure, "%s", err.Error())
+}
+
+// Check that the client has the right on an image, or on any image in the
+// namespace of the pool if the image is empty. The decision is logged.
+func (e *Exporter) authorize(ctx *message.Context, spec backend.ImageSpec, right policy.Right) error {
+	if e.opts.Policy == nil {
+		return nil
+	}
+
+	logger := ctx.Logger().With(zap.String("pool", spec.Pool), zap.String("namespace", spec.Namespace),
+		zap.String("image", spec.Image), zap.String("right", string(right)))
+
+	client := e.opts.Policy.Client(ctx.Session().Peer)
+	if client == nil {
+		logger.Warn("access denied, client is not in the policy")
+		return message.NewError(message.ErrorCodePermissionDenied, "client is not allowed access")
+	}
+
+	logger = logger.With(zap.String("client", client.Name))
+
+	allowed := false
+	if spec.Image == "" {
+		allowed = client.AllowsNamespace(spec.Pool, spec.Namespace, right)
+	} else {
+		allowed = client.AllowsImage(spec.Pool, spec.Namespace, spec.Image, right)
+	}
+
+	if !allowed {
+		logger.Warn("access denied")
+
+		switch {
+		case spec.Image != "":
+			return message.NewError(message.ErrorCodePermissionDenied, "%s is not allowed on image %s", right, spec)
+		case spec.Namespace != "":
+			return message.NewError(message.ErrorCodePermissionDenied, "%s is not allowed on namespace %s in pool %s",
+				right, spec.Namespace, spec.Pool)
+		}
+
+		return message.NewError(message.ErrorCodePermissionDenied, "%s is not allowed on pool %s", right, spec.Pool)
+	}
+
+	logger.Info("access allowed")
 	return nil
 }
 
-// Close exporter
-func (e *Exporter) Close() {
-	e.logger.Info("close exporter")
+// Returns the images in the namespace of the pool the client can list
+func (e *Exporter) filterImages(ctx *message.Context, pool string, namespace string, names []string) []string {
+	if e.opts.Policy == nil {
+		return names
+	}
+
+	client := e.opts.Policy.Client(ctx.Session().Peer)
+	if client == nil {
+		return []string{}
+	}
 
-	if e.conn != nil {
-		e.conn.Shutdown()
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		if client.AllowsImage(pool, namespace, name, policy.RightList) {
+			allowed = append(allowed, name)
+		}
 	}
+
+	return allowed
 }
 
-// Handle error message version 1
-func (e *Exporter) handleErrorV1(ctx *message.Context) error {
-	return errors.New("not implemented")
+// Handle list pools message version 1
+func (e *Exporter) handleListPoolsRequestV1(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var listMsg message.ListPoolsRequestV1
+	if err := msg.Unmarshal(&listMsg); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("listpools request message")
+
+	var client *policy.Client
+	if e.opts.Policy != nil {
+		client = e.opts.Policy.Client(ctx.Session().Peer)
+		if client == nil {
+			ctx.Logger().Warn("access denied, client is not in the policy")
+			return message.NewError(message.ErrorCodePermissionDenied, "client is not allowed access")
+		}
+	}
+
+	pools, err := e.backend.ListPools(ctx.Context())
+	if err != nil {
+		return backendError(err)
+	}
+
+	result := make([]message.PoolV1, 0, len(pools))
+	for _, pool := range pools {
+		// Namespaces the client cannot list is not shown, neither is
+		// pools without any namespace the client can list
+		namespaces := make([]string, 0, len(pool.Namespaces)+1)
+		for _, namespace := range append([]string{""}, pool.Namespaces...) {
+			if client == nil || client.AllowsNamespace(pool.Name, namespace, policy.RightList) {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+
+		if len(namespaces) == 0 {
+			continue
+		}
+
+		result = append(result, message.PoolV1{
+			Name: pool.Name,
+			Namespaces: namespaces,
+		})
+	}
+
+	ctx.Logger().Info("sending list pools response", zap.Int("count", len(result)))
+
+	resp := message.ListPoolsResponseV1{
+		Pools: result,
+	}
+
+	return ctx.Send(&resp)
 }
 
 // Handle list pool message version 1
@@ -97,22 +356,26 @@ func (e *Exporter) handleListPoolRequestV1(ctx *message.Context) error {
 
 	var listMsg message.ListPoolRequestV1
 	if err := msg.Unmarshal(&listMsg); err != nil {
-		return err
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
 	}
 
 	ctx.Logger().Info("listpool request message", zap.Any("msg", listMsg))
 
-	ioctx, err := e.conn.OpenIOContext(listMsg.Pool)
-	if err != nil {
+	spec := backend.ImageSpec{
+		Pool: listMsg.Pool,
+	}
+
+	if err := e.authorize(ctx, spec, policy.RightList); err != nil {
 		return err
 	}
-	defer ioctx.Destroy()
 
-	names, err := rbd.GetImageNames(ioctx)
+	names, err := e.backend.ListImages(ctx.Context(), listMsg.Pool, "")
 	if err != nil {
-		return err
+		return backendError(err)
 	}
 
+	names = e.filterImages(ctx, listMsg.Pool, "", names)
+
 	ctx.Logger().Info("sending list pool response with names", zap.Any("names", names))
 
 	resp := message.ListPoolResponseV1{
@@ -122,42 +385,157 @@ func (e *Exporter) handleListPoolRequestV1(ctx *message.Context) error {
 	return ctx.Send(&resp)
 }
 
+// Returns the page token that continues after the image name
+func encodePageToken(name string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(name))
+}
+
+// Returns the image name that a page token continues after
+func decodePageToken(token string) (string, error) {
+	name, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid page token: %w", err)
+	}
+
+	return string(name), nil
+}
+
+// Handle list pool message version 2, the pool is listed again for each
+// page since rbd cannot list images from a name. Listing a whole pool
+// costs O(n^2/limit), only the names after the page token is sorted.
+func (e *Exporter) handleListPoolRequestV2(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var listMsg message.ListPoolRequestV2
+	if err := msg.Unmarshal(&listMsg); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("listpool request message", zap.Any("msg", listMsg))
+
+	match, err := filter.Images(listMsg.Glob, listMsg.Regex)
+	if err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "%s", err.Error())
+	}
+
+	after := ""
+	if listMsg.PageToken != "" {
+		after, err = decodePageToken(listMsg.PageToken)
+		if err != nil {
+			return message.NewError(message.ErrorCodeProtocolViolation, "%s", err.Error())
+		}
+	}
+
+	limit := int(listMsg.Limit)
+	if limit == 0 {
+		limit = defaultListLimit
+	}
+	limit = min(limit, maxListLimit)
+
+	spec := backend.ImageSpec{
+		Pool: listMsg.Pool,
+		Namespace: listMsg.Namespace,
+	}
+
+	if err := e.authorize(ctx, spec, policy.RightList); err != nil {
+		return err
+	}
+
+	names, err := e.backend.ListImages(ctx.Context(), listMsg.Pool, listMsg.Namespace)
+	if err != nil {
+		return backendError(err)
+	}
+
+	names = e.filterImages(ctx, listMsg.Pool, listMsg.Namespace, names)
+
+	// NOTE: The page token is the last name in the previous page so pages
+	// stays correct when images is added or removed between the requests.
+	candidates := make([]string, 0, len(names))
+	for _, name := range names {
+		if name > after && match(name) {
+			candidates = append(candidates, name)
+		}
+	}
+
+	sort.Strings(candidates)
+
+	page := candidates
+	next := ""
+	if len(page) > limit {
+		page = page[:limit]
+		next = encodePageToken(page[len(page)-1])
+	}
+
+	ctx.Logger().Info("sending list pool response with names", zap.Int("count", len(page)),
+		zap.Bool("more", next != ""))
+
+	resp := message.ListPoolResponseV2{
+		Pool: listMsg.Pool,
+		Namespace: listMsg.Namespace,
+		Names: page,
+		NextPageToken: next,
+	}
+
+	return ctx.Send(&resp)
+}
+
 // Handle list snapshots message version 1
 func (e *Exporter) handleListSnapshotsRequestV1(ctx *message.Context) error {
 	msg := ctx.Message()
 
 	var listMsg message.ListSnapshotsRequestV1
 	if err := msg.Unmarshal(&listMsg); err != nil {
-		return err
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
 	}
 
 	ctx.Logger().Info("listsnapshots request message", zap.Any("msg", listMsg))
 
-	ioctx, err := e.conn.OpenIOContext(listMsg.Pool)
-	if err != nil {
-		return err
+	spec := backend.ImageSpec{
+		Pool: listMsg.Pool,
+		Namespace: listMsg.Namespace,
+		Image: listMsg.Image,
 	}
-	defer ioctx.Destroy()
 
-	image, err := rbd.OpenImageReadOnly(ioctx, listMsg.Image, rbd.NoSnapshot)
-	if err != nil {
+	if err := e.authorize(ctx, spec, policy.RightList); err != nil {
 		return err
 	}
-	defer image.Close()
 
-	snaps, err := image.GetSnapshotNames()
+	snaps, err := e.backend.ListSnapshots(ctx.Context(), spec)
 	if err != nil {
-		return err
+		return backendError(err)
 	}
 
-	result := make([]string, len(snaps))
+	if ctx.Session().Version(message.ListSnapshotsResponseType) >= 2 {
+		result := make([]message.SnapshotV2, 0, len(snaps))
+		for _, snap := range snaps {
+			result = append(result, message.SnapshotV2{
+				ID: snap.ID,
+				Name: snap.Name,
+				Size: snap.Size,
+				Timestamp: snap.Timestamp,
+				Protected: snap.Protected,
+				Namespace: string(snap.Namespace),
+			})
+		}
 
+		resp := message.ListSnapshotsResponseV2{
+			Pool: listMsg.Pool,
+			Namespace: listMsg.Namespace,
+			Image: listMsg.Image,
+			Snapshots: result,
+		}
+
+		return ctx.Send(&resp)
+	}
+
+	result := make([]string, 0, len(snaps))
 	for _, snap := range snaps {
 		result = append(result, snap.Name)
 	}
 
 	resp := message.ListSnapshotsResponseV1{
 		Pool: listMsg.Pool,
+		Namespace: listMsg.Namespace,
 		Image: listMsg.Image,
 		Snapshots: result,
 	}
@@ -165,6 +543,71 @@ func (e *Exporter) handleListSnapshotsRequestV1(ctx *message.Context) error {
 	return ctx.Send(&resp)
 }
 
+// Handle image info request version 1
+func (e *Exporter) handleImageInfoRequestV1(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var req message.ImageInfoRequestV1
+	if err := msg.Unmarshal(&req); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("image info request message", zap.Any("msg", req))
+
+	spec := backend.ImageSpec{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+	}
+
+	if err := e.authorize(ctx, spec, policy.RightList); err != nil {
+		return err
+	}
+
+	info, err := e.backend.ImageInfo(ctx.Context(), spec, req.Snapshot)
+	if err != nil {
+		return backendError(err)
+	}
+
+	if ctx.Session().Version(message.ImageInfoResponseType) >= 2 {
+		resp := message.ImageInfoResponseV2{
+			Pool: req.Pool,
+			Namespace: req.Namespace,
+			Image: req.Image,
+			Snapshot: req.Snapshot,
+			Size: info.Size,
+			Order: info.Order,
+			ObjectSize: info.ObjectSize,
+			Features: info.Features,
+			StripeUnit: info.StripeUnit,
+			StripeCount: info.StripeCount,
+			DataPool: info.DataPool,
+			Metadata: info.Metadata,
+			CreateTimestamp: info.CreateTimestamp,
+		}
+
+		if info.Parent != nil {
+			resp.Parent = &message.ImageParentV2{
+				Pool: info.Parent.Pool,
+				Namespace: info.Parent.Namespace,
+				Image: info.Parent.Image,
+				Snapshot: info.Parent.Snapshot,
+			}
+		}
+
+		return ctx.Send(&resp)
+	}
+
+	resp := message.ImageInfoResponseV1{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+		Snapshot: req.Snapshot,
+		Size: info.Size,
+	}
+
+	return ctx.Send(&resp)
+}
 
 // Handle export request version 1
 func (e *Exporter) handleExportRequestV1(ctx *message.Context) error {
@@ -172,64 +615,269 @@ func (e *Exporter) handleExportRequestV1(ctx *message.Context) error {
 
 	var req message.ExportRequestV1
 	if err := msg.Unmarshal(&req); err != nil {
-		return err
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
 	}
 
 	ctx.Logger().Info("incoming export request", zap.Any("msg", req))
 
-	w := newChunkedWriter(ctx)
-	if err := exportDiff(&req, w); err != nil {
+	exportReq := message.ExportRequestV3{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+		Snapshot: req.Snapshot,
+	}
+
+	if err := e.authorize(ctx, exportSpec(&exportReq), policy.RightExport); err != nil {
 		return err
 	}
 
-	resp := message.ExportResponseV1{
+	return e.export(ctx, &exportReq, "")
+}
+
+// Handle export request version 2
+func (e *Exporter) handleExportRequestV2(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var req message.ExportRequestV2
+	if err := msg.Unmarshal(&req); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("incoming export request", zap.Any("msg", req))
+
+	exportReq := message.ExportRequestV3{
 		Pool: req.Pool,
+		Namespace: req.Namespace,
 		Image: req.Image,
 		Snapshot: req.Snapshot,
+		FromSnapshot: req.FromSnapshot,
 	}
 
-	if err := ctx.Send(&resp); err != nil {
+	if err := e.authorize(ctx, exportSpec(&exportReq), policy.RightExport); err != nil {
 		return err
 	}
 
-	return nil
+	if req.FromSnapshot != "" {
+		if _, _, err := e.exportSnapshots(ctx.Context(), &exportReq); err != nil {
+			return err
+		}
+	}
+
+	return e.export(ctx, &exportReq, "")
 }
 
-// Generate TLS config
-func (e Exporter) generateTLSConfig() (*tls.Config, error) {
-	key, err := rsa.GenerateKey(rand.Reader, 1024)
+// Handle export request version 3
+func (e *Exporter) handleExportRequestV3(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var req message.ExportRequestV3
+	if err := msg.Unmarshal(&req); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("incoming export request", zap.Any("msg", req))
+
+	if req.ResumeToken == "" && req.Offset != 0 {
+		return message.NewError(message.ErrorCodeProtocolViolation, "an offset requires a resume token")
+	}
+
+	if err := e.authorize(ctx, exportSpec(&req), policy.RightExport); err != nil {
+		return err
+	}
+
+	// NOTE: The image head changes while it is exported so only exports
+	// of snapshots can be resumed.
+	if req.Snapshot == "" {
+		if req.ResumeToken != "" {
+			return message.NewError(message.ErrorCodeInvalidResumeToken, "an export of the image head cannot be resumed")
+		}
+
+		if req.FromSnapshot != "" {
+			if _, _, err := e.exportSnapshots(ctx.Context(), &req); err != nil {
+				return err
+			}
+		}
+
+		return e.export(ctx, &req, "")
+	}
+
+	snap, from, err := e.exportSnapshots(ctx.Context(), &req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
+	token := newResumeToken(&req, snap, from)
+
+	if req.ResumeToken != "" {
+		resumed, err := decodeResumeToken(req.ResumeToken)
+		if err != nil {
+			return message.NewError(message.ErrorCodeInvalidResumeToken, "%s", err.Error())
+		}
+
+		if resumed != token {
+			return message.NewError(message.ErrorCodeInvalidResumeToken, "resume token is not for this export of %s or the snapshots has changed",
+				buildImageSpec(&req))
+		}
 	}
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	// Tokens is only given to importers that can resume
+	encoded := ""
+	if ctx.Session().HasFeature(message.FeatureResume) {
+		if encoded, err = token.encode(); err != nil {
+			return err
+		}
+	}
+
+	return e.export(ctx, &req, encoded)
+}
+
+// Returns the snapshot and the from snapshot of an export, they is nil
+// if they is not set in the request. The from snapshot must exist and be
+// older than the snapshot, snapshot IDs always increase so they give the
+// order.
+func (e *Exporter) exportSnapshots(ctx context.Context, req *message.ExportRequestV3) (*backend.Snapshot, *backend.Snapshot, error) {
+	spec := exportSpec(req)
+
+	snaps, err := e.backend.ListSnapshots(ctx, spec)
 	if err != nil {
-		return nil, err
+		return nil, nil, backendError(err)
 	}
 
-	keyPEM := pem.EncodeToMemory(&pem.Block{
-		Type: "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(key),
-	})
+	var fromSnap, toSnap *backend.Snapshot
+	for idx := range snaps {
+		switch snaps[idx].Name {
+		case req.FromSnapshot:
+			fromSnap = &snaps[idx]
+		case req.Snapshot:
+			toSnap = &snaps[idx]
+		}
+	}
+
+	if req.FromSnapshot != "" && fromSnap == nil {
+		return nil, nil, message.NewError(message.ErrorCodeInvalidFromSnapshot, "from snapshot %s does not exist on image %s",
+			req.FromSnapshot, spec)
+	}
+
+	// An empty snapshot is the image head which is always newer
+	if req.Snapshot == "" {
+		return nil, fromSnap, nil
+	}
+
+	if toSnap == nil {
+		return nil, nil, message.NewError(message.ErrorCodeNotFound, "snapshot %s does not exist on image %s",
+			req.Snapshot, spec)
+	}
+
+	if fromSnap != nil && fromSnap.ID >= toSnap.ID {
+		return nil, nil, message.NewError(message.ErrorCodeInvalidFromSnapshot, "from snapshot %s is not older than snapshot %s on image %s",
+			req.FromSnapshot, req.Snapshot, spec)
+	}
+
+	return toSnap, fromSnap, nil
+}
+
+// Export the diff for the request as chunks followed by the response, the
+// diff starts at the offset in the request. The resume token is sent in
+// the first chunk if it is set.
+func (e *Exporter) export(ctx *message.Context, req *message.ExportRequestV3, token string) error {
+	// NOTE: We don't queue exports when all slots are taken,
+	// the importer is told that we are busy so it can retry later.
+	select {
+	case e.exports <- struct{}{}:
+		defer func() { <-e.exports }()
+	default:
+		return message.NewError(message.ErrorCodeBusy, "all %d export slots are in use", e.opts.MaxExports)
+	}
 
-	certPEM := pem.EncodeToMemory(&pem.Block{
-		Type: "CERTIFICATE",
-		Bytes: certDER,
-	})
+	imageSpec := buildImageSpec(req)
+	logger := ctx.Logger().With(zap.String("image", imageSpec))
+
+	// Log the progress each time another tenth of the image is passed
+	var nextProgress uint64
+	progress := func(offset uint64, size uint64) {
+		if size == 0 || offset < nextProgress {
+			return
+		}
+
+		logger.Info("export progress", zap.Uint64("offset", offset), zap.Uint64("size", size),
+			zap.Uint64("percent", offset*100/size))
+		nextProgress = offset + size/10
+	}
 
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	diffReq := backend.DiffRequest{
+		Image: exportSpec(req),
+		Snapshot: req.Snapshot,
+		FromSnapshot: req.FromSnapshot,
+		Progress: progress,
+	}
+
+	cw := newChunkedWriter(ctx, e.buffers, e.opts.ChunkSize, req.Offset, token, e.opts.Compression)
+	defer cw.Release()
+
+	// NOTE: A resumed export produces the diff from the start and skips
+	// what the importer already has, the extents before the offset is read
+	// again but the diff is guaranteed to be the same.
+	var w io.Writer = cw
+	if req.Offset > 0 {
+		logger.Info("resuming export", zap.Uint64("offset", req.Offset))
+		w = &skipWriter{
+			w: cw,
+			skip: req.Offset,
+		}
+	}
+
+	dw := &digestWriter{
+		w: w,
+		digest: sha256.New(),
+	}
+
+	stats, err := e.backend.ExportDiff(ctx.Context(), &diffReq, dw)
 	if err != nil {
-		return nil, err
+		// The handler logs why the export was cancelled
+		if ctx.Context().Err() != nil {
+			logger.Debug("export cancelled", zap.Uint64("bytes", cw.bytes), zap.Uint64("chunks", cw.sequence))
+		}
+
+		return backendError(err)
+	}
+
+	if err := cw.Flush(); err != nil {
+		return err
+	}
+
+	logger.Info("export finished", zap.String("from_snapshot", req.FromSnapshot),
+		zap.Uint64("size", stats.Size), zap.Uint64("extents", stats.Extents),
+		zap.Uint64("written", stats.Written), zap.Uint64("zeroed", stats.Zeroed),
+		zap.Stringer("compression", cw.codec), zap.Uint64("bytes", cw.bytes), zap.Uint64("sent", cw.sent),
+		zap.Uint64("chunks", cw.sequence))
+
+	if ctx.Session().Version(message.ExportResponseType) >= 2 {
+		resp := message.ExportResponseV2{
+			Pool: req.Pool,
+			Namespace: req.Namespace,
+			Image: req.Image,
+			Snapshot: req.Snapshot,
+			Digest: dw.digest.Sum(nil),
+			Bytes: dw.bytes,
+			Chunks: cw.sequence,
+			Offset: req.Offset,
+		}
+
+		return ctx.Send(&resp)
+	}
+
+	resp := message.ExportResponseV1{
+		Pool: req.Pool,
+		Image: req.Image,
+		Snapshot: req.Snapshot,
+		Namespace: req.Namespace,
+	}
+
+	if err := ctx.Send(&resp); err != nil {
+		return err
 	}
 
-	return &tls.Config{
-		Certificates: []tls.Certificate{tlsCert},
-		NextProtos:   []string{"snapback"},
-	}, nil
+	return nil
 }
 
 // Handle a new connection
@@ -239,6 +887,15 @@ func (e *Exporter) onConn(ctx context.Context, conn quic.Connection) {
 	connLogger := e.logger.With(
 		zap.String("connection", addr.String()))
 
+	var peer *x509.Certificate
+	if peers := conn.ConnectionState().TLS.PeerCertificates; len(peers) > 0 {
+		peer = peers[0]
+		connLogger = connLogger.With(
+			zap.String("peer", peer.Subject.CommonName))
+	}
+
+	connLogger.Info("new connection")
+
 	for {
 		stream, err := conn.AcceptStream(ctx)
 		if err != nil {
@@ -246,12 +903,12 @@ func (e *Exporter) onConn(ctx context.Context, conn quic.Connection) {
 			break
 		}
 
-		go e.onStream(connLogger, stream)
+		go e.onStream(connLogger, stream, peer)
 	}
 }
 
 // Handle a new stream on a connection
-func (e *Exporter) onStream(connLogger *zap.Logger, stream quic.Stream) {
+func (e *Exporter) onStream(connLogger *zap.Logger, stream quic.Stream, peer *x509.Certificate) {
 	logger := connLogger.With(
 		zap.Any("stream", stream.StreamID()))
 
@@ -262,7 +919,17 @@ func (e *Exporter) onStream(connLogger *zap.Logger, stream quic.Stream) {
 
 	logger.Info("new stream opened")
 
-	if err := e.handler.Run(logger, stream); err != nil {
+	session, err := e.handler.Accept(stream, e.capabilities())
+	if err != nil {
+		logger.Error("handshake failed", zap.String("error", err.Error()))
+		return
+	}
+
+	session.Peer = peer
+
+	logger.Info("handshake completed", zap.String("peer_version", session.PeerVersion))
+
+	if err := e.handler.Run(logger, stream, session); err != nil {
 		logger.Error("handler error")
 		logger.Error(err.Error())
 	}
@@ -270,18 +937,18 @@ func (e *Exporter) onStream(connLogger *zap.Logger, stream quic.Stream) {
 
 // Run the exporter
 func (e *Exporter) Run() error {
-	tlsConfig, err := e.generateTLSConfig()
+	tlsConfig, err := certs.ServerConfig(e.opts.TLSCert, e.opts.TLSKey, e.opts.TLSCA)
 	if err != nil {
 		return err
 	}
 
-	listener, err := quic.ListenAddr(exporterAddr, tlsConfig, nil)
+	listener, err := quic.ListenAddr(e.opts.Listen, tlsConfig, nil)
 	if err != nil {
 		return err
 	}
 	defer listener.Close()
 
-	e.logger.Info("listening on address", zap.String("address", exporterAddr))
+	e.logger.Info("listening on address", zap.String("address", e.opts.Listen))
 
 	sigC := make(chan os.Signal, 1)
 	ctx, cancel := context.WithCancel(context.Background())
@@ -0,0 +1,70 @@
+package exporter
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/message"
+)
+
+// What a resume token is for. The diff between two snapshots is always
+// the same so an export can be resumed by producing the diff again, the
+// snapshot IDs and size makes sure the snapshots is the same ones.
+type resumeToken struct {
+	Pool string `json:"pool"`
+	Namespace string `json:"namespace,omitempty"`
+	Image string `json:"image"`
+	Snapshot string `json:"snapshot"`
+	SnapshotID uint64 `json:"snapshot_id"`
+	Size uint64 `json:"size"`
+	FromSnapshot string `json:"from_snapshot,omitempty"`
+	FromSnapshotID uint64 `json:"from_snapshot_id,omitempty"`
+}
+
+// Returns the resume token for an export of the snapshot, from can be nil
+// for a full export
+func newResumeToken(req *message.ExportRequestV3, snap *backend.Snapshot, from *backend.Snapshot) resumeToken {
+	token := resumeToken{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+		Snapshot: snap.Name,
+		SnapshotID: snap.ID,
+		Size: snap.Size,
+	}
+
+	if from != nil {
+		token.FromSnapshot = from.Name
+		token.FromSnapshotID = from.ID
+	}
+
+	return token
+}
+
+// Returns the token as the string that is sent to the importer
+func (t resumeToken) encode() (string, error) {
+	data, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// Returns the token in the string from the importer
+func decodeResumeToken(s string) (resumeToken, error) {
+	var token resumeToken
+
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return token, fmt.Errorf("invalid resume token: %w", err)
+	}
+
+	if err := json.Unmarshal(data, &token); err != nil {
+		return token, fmt.Errorf("invalid resume token: %w", err)
+	}
+
+	return token, nil
+}
@@ -0,0 +1,27 @@
+package exporter
+
+import (
+	"fmt"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/message"
+)
+
+// Returns the image of an export request
+func exportSpec(req *message.ExportRequestV3) backend.ImageSpec {
+	return backend.ImageSpec{
+		Pool: req.Pool,
+		Namespace: req.Namespace,
+		Image: req.Image,
+	}
+}
+
+func buildImageSpec(req *message.ExportRequestV3) string {
+	spec := exportSpec(req)
+
+	if req.Snapshot == "" {
+		return spec.String()
+	}
+
+	return fmt.Sprintf("%s@%s", spec, req.Snapshot)
+}
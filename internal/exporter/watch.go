@@ -0,0 +1,253 @@
+package exporter
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/message"
+	"github.com/tobias-urdin/snapback/internal/policy"
+
+	"go.uber.org/zap"
+)
+
+// The default time between checks for changes in subscribed images
+const DefaultWatchInterval = 10 * time.Second
+
+// The number of subscriptions that checks for changes at the same time
+const maxWatches = 2
+
+// The user snapshots of the images a subscription is for, the snapshots
+// is keyed by name to their ID
+type watchState map[backend.ImageSpec]map[string]uint64
+
+// Returns the current state of the images the subscriptions is for
+func (e *Exporter) watchState(ctx *message.Context, subs []message.SubscriptionV1) (watchState, error) {
+	state := watchState{}
+
+	for _, sub := range subs {
+		names := []string{sub.Image}
+		if sub.Image == "" {
+			list, err := e.backend.ListImages(ctx.Context(), sub.Pool, sub.Namespace)
+			if err != nil {
+				return nil, err
+			}
+
+			names = e.filterImages(ctx, sub.Pool, sub.Namespace, list)
+		}
+
+		for _, name := range names {
+			spec := backend.ImageSpec{
+				Pool: sub.Pool,
+				Namespace: sub.Namespace,
+				Image: name,
+			}
+
+			if _, ok := state[spec]; ok {
+				continue
+			}
+
+			snaps, err := e.backend.ListSnapshotNames(ctx.Context(), spec)
+			if errors.Is(err, backend.ErrNotFound) {
+				// The image was removed after it was listed or a
+				// subscribed image does not exist (yet)
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			// NOTE: Snapshots that rbd creates by itself for mirroring,
+			// groups and the trash is not tracked, they change often and
+			// is of no use to importers.
+			ids := make(map[string]uint64, len(snaps))
+			for _, snap := range snaps {
+				if snap.Namespace == backend.SnapshotNamespaceUser {
+					ids[snap.Name] = snap.ID
+				}
+			}
+
+			state[spec] = ids
+		}
+	}
+
+	return state, nil
+}
+
+// Returns the events for the changes from the old to the new state, the
+// events for an image is ordered with removed snapshots first and created
+// snapshots in the order they was created.
+func watchEvents(old watchState, state watchState) []message.EventV1 {
+	specs := make([]backend.ImageSpec, 0, len(old)+len(state))
+	for spec := range old {
+		specs = append(specs, spec)
+	}
+	for spec := range state {
+		if _, ok := old[spec]; !ok {
+			specs = append(specs, spec)
+		}
+	}
+
+	sort.Slice(specs, func(i, j int) bool {
+		return specs[i].String() < specs[j].String()
+	})
+
+	var events []message.EventV1
+	for _, spec := range specs {
+		snaps, ok := state[spec]
+		if !ok {
+			events = append(events, message.EventV1{
+				Kind: message.EventImageRemoved,
+				Pool: spec.Pool,
+				Namespace: spec.Namespace,
+				Image: spec.Image,
+			})
+			continue
+		}
+
+		var removed, created []message.EventV1
+		for name, id := range old[spec] {
+			if _, ok := snaps[name]; !ok {
+				removed = append(removed, snapshotEvent(message.EventSnapshotRemoved, spec, name, id))
+			}
+		}
+		for name, id := range snaps {
+			if _, ok := old[spec][name]; !ok {
+				created = append(created, snapshotEvent(message.EventSnapshotCreated, spec, name, id))
+			}
+		}
+
+		sortEvents(removed)
+		sortEvents(created)
+
+		events = append(events, removed...)
+		events = append(events, created...)
+	}
+
+	return events
+}
+
+// Returns an event for a snapshot
+func snapshotEvent(kind message.EventKind, spec backend.ImageSpec, name string, id uint64) message.EventV1 {
+	return message.EventV1{
+		Kind: kind,
+		Pool: spec.Pool,
+		Namespace: spec.Namespace,
+		Image: spec.Image,
+		Snapshot: name,
+		SnapshotID: id,
+	}
+}
+
+// Sort snapshot events by snapshot ID and name
+func sortEvents(events []message.EventV1) {
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].SnapshotID == events[j].SnapshotID {
+			return events[i].Snapshot < events[j].Snapshot
+		}
+
+		return events[i].SnapshotID < events[j].SnapshotID
+	})
+}
+
+// Handle subscribe request version 1. The exporter checks the subscribed
+// images for changes on an interval and sends the events until the
+// importer closes the stream. Only maxWatches subscriptions checks at the
+// same time and the first check is at a random time in the interval, so
+// subscriptions that start together does not hit the backend together.
+//
+// TODO: librbd watch/notify on the image headers could
+// replace the polling but it needs a watch for each image.
+func (e *Exporter) handleSubscribeRequestV1(ctx *message.Context) error {
+	msg := ctx.Message()
+
+	var req message.SubscribeRequestV1
+	if err := msg.Unmarshal(&req); err != nil {
+		return message.NewError(message.ErrorCodeProtocolViolation, "invalid message: %s", err.Error())
+	}
+
+	ctx.Logger().Info("subscribe request message", zap.Any("msg", req))
+
+	if len(req.Subscriptions) == 0 {
+		return message.NewError(message.ErrorCodeProtocolViolation, "subscribe request has no subscriptions")
+	}
+
+	for _, sub := range req.Subscriptions {
+		if sub.Pool == "" {
+			return message.NewError(message.ErrorCodeProtocolViolation, "subscription has no pool")
+		}
+
+		spec := backend.ImageSpec{
+			Pool: sub.Pool,
+			Namespace: sub.Namespace,
+			Image: sub.Image,
+		}
+
+		if err := e.authorize(ctx, spec, policy.RightList); err != nil {
+			return err
+		}
+	}
+
+	state, err := e.watchState(ctx, req.Subscriptions)
+	if err != nil {
+		return backendError(err)
+	}
+
+	resp := message.SubscribeResponseV1{
+		Interval: uint32(e.opts.WatchInterval / time.Second),
+	}
+
+	if err := ctx.Send(&resp); err != nil {
+		return err
+	}
+
+	logger := ctx.Logger().With(zap.Int("subscriptions", len(req.Subscriptions)))
+	logger.Info("subscription started", zap.Int("images", len(state)))
+
+	timer := time.NewTimer(time.Duration(rand.Int63n(int64(e.opts.WatchInterval))))
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Context().Done():
+			logger.Info("subscription ended")
+			return nil
+		case <-timer.C:
+		}
+
+		select {
+		case e.watches <- struct{}{}:
+		case <-ctx.Context().Done():
+			logger.Info("subscription ended")
+			return nil
+		}
+
+		next, err := e.watchState(ctx, req.Subscriptions)
+		<-e.watches
+		timer.Reset(e.opts.WatchInterval)
+
+		if err != nil {
+			// NOTE: The state is kept so the changes is sent once the
+			// backend works again.
+			if ctx.Context().Err() == nil {
+				logger.Warn("failed to check subscribed images for changes", zap.Error(err))
+			}
+
+			continue
+		}
+
+		for _, event := range watchEvents(state, next) {
+			logger.Debug("sending event", zap.Stringer("kind", event.Kind), zap.String("pool", event.Pool),
+				zap.String("namespace", event.Namespace), zap.String("image", event.Image),
+				zap.String("snapshot", event.Snapshot))
+
+			if err := ctx.Send(&event); err != nil {
+				return err
+			}
+		}
+
+		state = next
+	}
+}
@@ -3,42 +3,266 @@ package exporter
 import (
 	"hash"
 	"hash/crc32"
+	"io"
+	"sync"
 
 	"github.com/tobias-urdin/snapback/internal/message"
-
-	"go.uber.org/zap"
 )
 
-func newChunkedWriter(ctx *message.Context) *chunkedWriter {
+// Returns a pool of buffers for chunks of the size, the buffers is large
+// enough to also hold a compressed chunk
+func newBufferPool(size int) *sync.Pool {
+	return &sync.Pool{
+		New: func() any {
+			buf := make([]byte, 0, message.CompressBound(size))
+			return &buf
+		},
+	}
+}
+
+// Returns a chunked writer for a diff that starts at the offset in the
+// diff stream, the resume token is sent in the first chunk if it is set.
+// The chunks is compressed with the codec if the importer supports it.
+// The writer must be flushed when the diff is written and released when
+// it is no longer used.
+func newChunkedWriter(ctx *message.Context, pool *sync.Pool, size int, offset uint64, token string, codec message.Codec) *chunkedWriter {
+	session := ctx.Session()
+	if session.Version(message.ExportChunkType) < 3 || !session.HasCodec(codec) {
+		codec = message.CodecNone
+	}
+
 	return &chunkedWriter{
 		ctx: ctx,
 		h:   crc32.New(crc32.MakeTable(crc32.Castagnoli)),
+		offset: offset,
+		token: token,
+		codec: codec,
+		pool: pool,
+		size: size,
+		buf: pool.Get().(*[]byte),
+		zbuf: pool.Get().(*[]byte),
 	}
 }
 
+// Writes the diff in chunks of a fixed size, only the last chunk can be
+// smaller
 type chunkedWriter struct {
 	ctx *message.Context
 	h hash.Hash32
+
+	// The number of payload bytes that is sent
+	bytes uint64
+
+	// The sequence number of the next chunk
+	sequence uint64
+
+	// The offset in the diff stream of the next chunk
+	offset uint64
+
+	// The resume token, it is only sent in the first chunk
+	token string
+
+	// The codec the chunks is compressed with
+	codec message.Codec
+
+	// The number of payload bytes that is sent after compression
+	sent uint64
+
+	// The pool the buffers is from
+	pool *sync.Pool
+
+	// The size of a chunk
+	size int
+
+	// The data for the next chunk
+	buf *[]byte
+
+	// The buffer chunks is compressed into
+	zbuf *[]byte
 }
 
-func (c *chunkedWriter) Write(p []byte) (int, error) {
-	c.h.Reset()
-	c.h.Write(p)
+// Returns the chunk message for the payload in the negotiated version
+// and the size of the payload in it
+func (c *chunkedWriter) chunk(p []byte, sum uint32) (message.MessageInterface, int, error) {
+	version := c.ctx.Session().Version(message.ExportChunkType)
 
-	sum := c.h.Sum32()
-	c.ctx.Logger().Info("sending export chunk", zap.Any("crc", sum))
+	if version >= 3 {
+		chunk := &message.ExportChunkV3{
+			Payload: p,
+			PayloadCRC: sum,
+			Sequence: c.sequence,
+			Offset: c.offset,
+		}
 
-	chunk := message.ExportChunkV1{
+		if c.sequence == 0 {
+			chunk.ResumeToken = c.token
+		}
+
+		compressed, err := message.Compress(c.codec, *c.zbuf, p)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		// A chunk that did not get smaller is sent as it is
+		if compressed != nil {
+			chunk.Payload = compressed
+			chunk.Codec = c.codec
+			chunk.Size = uint64(len(p))
+		}
+
+		return chunk, len(chunk.Payload), nil
+	}
+
+	if version >= 2 {
+		chunk := &message.ExportChunkV2{
+			Payload: p,
+			PayloadCRC: sum,
+			Sequence: c.sequence,
+			Offset: c.offset,
+		}
+
+		if c.sequence == 0 {
+			chunk.ResumeToken = c.token
+		}
+
+		return chunk, len(p), nil
+	}
+
+	return &message.ExportChunkV1{
 		Payload: p,
 		PayloadCRC: sum,
+	}, len(p), nil
+}
+
+// Buffer p and send a chunk each time the buffer is full
+func (c *chunkedWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		buf := *c.buf
+
+		// NOTE: Whole chunks is sent straight from p when
+		// nothing is buffered, there is no point in copying them first.
+		if len(buf) == 0 && len(p) >= c.size {
+			if err := c.send(p[:c.size]); err != nil {
+				return written, err
+			}
+
+			p = p[c.size:]
+			written += c.size
+			continue
+		}
+
+		n := copy(buf[len(buf):c.size], p)
+		buf = buf[:len(buf)+n]
+		*c.buf = buf
+
+		p = p[n:]
+		written += n
+
+		if len(buf) == c.size {
+			if err := c.send(buf); err != nil {
+				return written, err
+			}
+
+			*c.buf = buf[:0]
+		}
 	}
 
-	if err := c.ctx.Send(&chunk); err != nil {
-		return 0, err
+	return written, nil
+}
+
+// Send what is buffered as the last chunk
+func (c *chunkedWriter) Flush() error {
+	buf := *c.buf
+	if len(buf) == 0 {
+		return nil
+	}
+
+	if err := c.send(buf); err != nil {
+		return err
 	}
 
+	*c.buf = buf[:0]
+	return nil
+}
+
+// Return the buffers to the pool, the writer cannot be used after this
+func (c *chunkedWriter) Release() {
+	*c.buf = (*c.buf)[:0]
+	*c.zbuf = (*c.zbuf)[:0]
+
+	c.pool.Put(c.buf)
+	c.pool.Put(c.zbuf)
+
+	c.buf = nil
+	c.zbuf = nil
+}
+
+// Send the payload as a chunk
+func (c *chunkedWriter) send(p []byte) error {
+	c.h.Reset()
+	c.h.Write(p)
+
+	chunk, sent, err := c.chunk(p, c.h.Sum32())
+	if err != nil {
+		return err
+	}
+
+	if err := c.ctx.Send(chunk); err != nil {
+		return err
+	}
+
+	c.sequence++
+	c.offset += uint64(len(p))
+	c.bytes += uint64(len(p))
+	c.sent += uint64(sent)
+
+	return nil
+}
+
+// Hashes and counts the diff that is written to it, it is placed before
+// the skipWriter so the digest is of the whole diff when it is resumed
+type digestWriter struct {
+	w io.Writer
+
+	// The digest of the diff
+	digest hash.Hash
+
+	// The number of bytes of the diff
+	bytes uint64
+}
+
+func (d *digestWriter) Write(p []byte) (int, error) {
+	d.digest.Write(p)
+	d.bytes += uint64(len(p))
+
+	return d.w.Write(p)
+}
+
+// Discards the first bytes that is written to it, it is used to resume
+// an export at an offset in the diff stream
+type skipWriter struct {
+	w io.Writer
+
+	// The number of bytes that is left to discard
+	skip uint64
+}
+
+func (s *skipWriter) Write(p []byte) (int, error) {
 	length := len(p)
-	c.ctx.Logger().Info("going to next", zap.Any("len", length))
+
+	if s.skip >= uint64(length) {
+		s.skip -= uint64(length)
+		return length, nil
+	}
+
+	p = p[s.skip:]
+	s.skip = 0
+
+	if _, err := s.w.Write(p); err != nil {
+		return 0, err
+	}
 
 	return length, nil
 }
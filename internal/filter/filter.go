@@ -0,0 +1,36 @@
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+)
+
+// Returns a func that matches image names against the glob or the
+// regular expression, at most one of them can be set. Everything is
+// matched when none of them is set.
+func Images(glob string, regex string) (func(string) bool, error) {
+	switch {
+	case glob != "" && regex != "":
+		return nil, errors.New("only one of glob and regex can be set")
+	case glob != "":
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+
+		return func(name string) bool {
+			ok, _ := path.Match(glob, name)
+			return ok
+		}, nil
+	case regex != "":
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex %q: %w", regex, err)
+		}
+
+		return re.MatchString, nil
+	}
+
+	return func(string) bool { return true }, nil
+}
@@ -0,0 +1,296 @@
+package importer
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/diff"
+
+	"go.uber.org/zap"
+)
+
+// The number of bytes of a diff that is applied between each time the
+// checkpoint is stored on the destination
+const checkpointInterval = 64 * 1024 * 1024
+
+// Where an export that was interrupted can be resumed from
+type checkpoint struct {
+	// The resume token from the exporter, empty if the export cannot
+	// be resumed
+	token string
+
+	// The header of the diff, nil until it has been read
+	header *diff.Header
+
+	// The offset in the diff after the last record that was applied to
+	// the destination
+	offset uint64
+
+	// The state of the SHA-256 digest of the diff up to offset, the
+	// exporter sends the digest of the whole diff also when it is resumed
+	digest []byte
+
+	// Set when the whole diff has been applied
+	complete bool
+}
+
+// Returns true if the export can be resumed from the checkpoint
+func (cp *checkpoint) resumable() bool {
+	return cp.token != "" && cp.header != nil && cp.digest != nil
+}
+
+// The checkpoint as it is stored on the destination, it is only used to
+// resume the export of the same snapshots
+type storedCheckpoint struct {
+	Snapshot string `json:"snapshot"`
+	FromSnapshot string `json:"from_snapshot,omitempty"`
+	Token string `json:"token"`
+	Size uint64 `json:"size"`
+	Offset uint64 `json:"offset"`
+	Digest []byte `json:"digest"`
+	Complete bool `json:"complete,omitempty"`
+}
+
+// Store the checkpoint alongside the image
+func saveCheckpoint(img backend.Image, cp *checkpoint) error {
+	data, err := json.Marshal(&storedCheckpoint{
+		Snapshot: cp.header.ToSnap,
+		FromSnapshot: cp.header.FromSnap,
+		Token: cp.token,
+		Size: cp.header.Size,
+		Offset: cp.offset,
+		Digest: cp.digest,
+		Complete: cp.complete,
+	})
+	if err != nil {
+		return err
+	}
+
+	return img.SaveCheckpoint(data)
+}
+
+// Returns the checkpoint that is stored alongside the image if it is for
+// the export of the snapshots, otherwise an empty checkpoint
+func loadCheckpoint(ctx context.Context, logger *zap.Logger, dest backend.Destination, spec backend.ImageSpec, snap string, fromSnap string) *checkpoint {
+	data, err := dest.LoadCheckpoint(ctx, spec)
+	if err != nil {
+		logger.Warn("failed to load checkpoint", zap.Error(err))
+		return &checkpoint{}
+	}
+
+	if data == nil {
+		return &checkpoint{}
+	}
+
+	var stored storedCheckpoint
+	if err := json.Unmarshal(data, &stored); err != nil {
+		logger.Warn("ignoring invalid checkpoint", zap.Error(err))
+		return &checkpoint{}
+	}
+
+	if stored.Snapshot != snap || stored.FromSnapshot != fromSnap || stored.Token == "" || stored.Digest == nil {
+		logger.Info("ignoring checkpoint for other snapshots", zap.String("checkpoint_snapshot", stored.Snapshot),
+			zap.String("checkpoint_from_snapshot", stored.FromSnapshot))
+		return &checkpoint{}
+	}
+
+	logger.Info("loaded checkpoint", zap.Uint64("offset", stored.Offset), zap.Bool("complete", stored.Complete))
+
+	return &checkpoint{
+		token: stored.Token,
+		header: &diff.Header{
+			FromSnap: stored.FromSnapshot,
+			ToSnap: stored.Snapshot,
+			Size: stored.Size,
+		},
+		offset: stored.Offset,
+		digest: stored.Digest,
+		complete: stored.Complete,
+	}
+}
+
+// Hashes the diff as it is read
+type digestReader struct {
+	r io.Reader
+	digest hash.Hash
+}
+
+func (d *digestReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.digest.Write(p[:n])
+
+	return n, err
+}
+
+// Returns the state of the digest
+func (d *digestReader) state() ([]byte, error) {
+	return d.digest.(encoding.BinaryMarshaler).MarshalBinary()
+}
+
+// The diff of an export, the resume token is known once the diff is read
+type exportStream interface {
+	io.Reader
+
+	// Returns the token that the export can be resumed with
+	ResumeToken() string
+}
+
+// Apply a diff read from r to the image on the destination, the image
+// is created with the size in the diff if it does not exist. The diff is
+// read from the offset in the checkpoint if it has a header.
+//
+// A full diff only has records for the data that is allocated on the
+// exporter, if existing is set the image can have other data so it is
+// cleared before a full diff is applied to it from the start.
+//
+// The checkpoint is only advanced once the image has been flushed, it is
+// stored alongside the image every checkpointInterval and when the diff
+// stops so the export can be resumed after the importer restarts.
+func applyDiff(ctx context.Context, logger *zap.Logger, dest backend.Destination, spec backend.ImageSpec, snap string, fromSnap string, r exportStream, cp *checkpoint, existing bool) (err error) {
+	clearImage := false
+
+	dgr := &digestReader{
+		r: r,
+		digest: sha256.New(),
+	}
+
+	var dr *diff.Reader
+	if cp.header != nil {
+		logger.Info("resuming diff", zap.Uint64("offset", cp.offset))
+
+		if err := dgr.digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(cp.digest); err != nil {
+			return fmt.Errorf("restore digest: %w", err)
+		}
+
+		dr = diff.NewResumeReader(dgr, cp.offset)
+	} else {
+		dr = diff.NewReader(dgr)
+
+		header, err := dr.ReadHeader()
+		if err != nil {
+			return err
+		}
+
+		if header.ToSnap != snap || header.FromSnap != fromSnap {
+			return fmt.Errorf("%w: diff is from %q to %q, expected from %q to %q",
+				diff.ErrInvalidDiff, header.FromSnap, header.ToSnap, fromSnap, snap)
+		}
+
+		state, err := dgr.state()
+		if err != nil {
+			return err
+		}
+
+		cp.header = header
+		cp.offset = dr.Applied()
+		cp.digest = state
+
+		clearImage = existing && header.FromSnap == ""
+	}
+
+	if cp.token == "" {
+		cp.token = r.ResumeToken()
+	}
+
+	header := cp.header
+
+	img, err := dest.OpenImage(ctx, spec, header.Size)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if closeErr := img.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}()
+
+	// The snapshots of the image keeps their data, only the head is
+	// cleared by shrinking it
+	if clearImage {
+		logger.Info("clearing image before full diff", zap.Stringer("image", spec))
+
+		if err := img.Resize(0); err != nil {
+			return fmt.Errorf("clear image %s: %w", spec, err)
+		}
+	}
+
+	size, err := img.Size()
+	if err != nil {
+		return err
+	}
+
+	if size != header.Size {
+		logger.Info("resizing image", zap.Stringer("image", spec), zap.Uint64("size", size), zap.Uint64("new_size", header.Size))
+
+		if err := img.Resize(header.Size); err != nil {
+			return err
+		}
+	}
+
+	// The offset and digest after the last record that was applied, the
+	// digest reader can be in the middle of the next record
+	applied := cp.offset
+	digest := cp.digest
+
+	flush := func() error {
+		if err := img.Flush(); err != nil {
+			return fmt.Errorf("flush image %s: %w", spec, err)
+		}
+
+		cp.offset = applied
+		cp.digest = digest
+
+		if !cp.resumable() {
+			return nil
+		}
+
+		// The export is only resumed from where it stopped in this
+		// process if the checkpoint cannot be stored
+		if err := saveCheckpoint(img, cp); err != nil {
+			logger.Warn("failed to store checkpoint", zap.Uint64("offset", cp.offset), zap.Error(err))
+		}
+
+		return nil
+	}
+
+	dr.OnApplied(func(offset uint64) error {
+		state, err := dgr.state()
+		if err != nil {
+			return err
+		}
+
+		applied = offset
+		digest = state
+
+		if applied-cp.offset < checkpointInterval {
+			return nil
+		}
+
+		return flush()
+	})
+
+	applyErr := dr.Apply(header, img)
+	if applyErr == nil {
+		if digest, err = dgr.state(); err != nil {
+			return err
+		}
+
+		applied = dr.Applied()
+		cp.complete = true
+	}
+
+	if err := flush(); err != nil {
+		cp.complete = false
+		return errors.Join(applyErr, err)
+	}
+
+	return applyErr
+}
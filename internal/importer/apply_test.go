@@ -0,0 +1,400 @@
+package importer
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/diff"
+
+	"go.uber.org/zap"
+)
+
+// An image in memory
+type fakeImage struct {
+	mu sync.Mutex
+	data []byte
+	checkpoint []byte
+	flushes int
+}
+
+func (i *fakeImage) WriteAt(p []byte, off int64) (int, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if off < 0 || int(off)+len(p) > len(i.data) {
+		return 0, errors.New("write past the end of the image")
+	}
+
+	return copy(i.data[off:], p), nil
+}
+
+func (i *fakeImage) Zero(offset uint64, length uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if offset+length > uint64(len(i.data)) {
+		return errors.New("zero past the end of the image")
+	}
+
+	clear(i.data[offset : offset+length])
+	return nil
+}
+
+func (i *fakeImage) Size() (uint64, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	return uint64(len(i.data)), nil
+}
+
+func (i *fakeImage) Resize(size uint64) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if size < uint64(len(i.data)) {
+		i.data = i.data[:size]
+	} else {
+		i.data = append(i.data, make([]byte, size-uint64(len(i.data)))...)
+	}
+
+	return nil
+}
+
+func (i *fakeImage) Flush() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.flushes++
+	return nil
+}
+
+func (i *fakeImage) SaveCheckpoint(data []byte) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.checkpoint = append([]byte(nil), data...)
+	return nil
+}
+
+func (i *fakeImage) Close() error {
+	return nil
+}
+
+// A destination that keeps the images in memory
+type fakeDestination struct {
+	mu sync.Mutex
+	images map[backend.ImageSpec]*fakeImage
+	snapshots map[backend.ImageSpec][]backend.Snapshot
+}
+
+func newFakeDestination() *fakeDestination {
+	return &fakeDestination{
+		images: make(map[backend.ImageSpec]*fakeImage),
+		snapshots: make(map[backend.ImageSpec][]backend.Snapshot),
+	}
+}
+
+func (d *fakeDestination) ListSnapshots(ctx context.Context, spec backend.ImageSpec) ([]backend.Snapshot, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.images[spec]; !ok {
+		return nil, backend.ErrNotFound
+	}
+
+	return append([]backend.Snapshot(nil), d.snapshots[spec]...), nil
+}
+
+func (d *fakeDestination) OpenImage(ctx context.Context, spec backend.ImageSpec, size uint64) (backend.Image, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img, ok := d.images[spec]
+	if !ok {
+		img = &fakeImage{
+			data: make([]byte, size),
+		}
+		d.images[spec] = img
+	}
+
+	return img, nil
+}
+
+func (d *fakeDestination) CreateImage(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	_, err := d.OpenImage(ctx, spec, info.Size)
+	return err
+}
+
+func (d *fakeDestination) SaveImageInfo(ctx context.Context, spec backend.ImageSpec, info *backend.ImageInfo) error {
+	return nil
+}
+
+func (d *fakeDestination) CreateSnapshot(ctx context.Context, spec backend.ImageSpec, name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	snaps := d.snapshots[spec]
+	d.snapshots[spec] = append(snaps, backend.Snapshot{
+		ID: uint64(len(snaps) + 1),
+		Name: name,
+		Size: uint64(len(d.images[spec].data)),
+	})
+
+	return nil
+}
+
+func (d *fakeDestination) LoadCheckpoint(ctx context.Context, spec backend.ImageSpec) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if img, ok := d.images[spec]; ok {
+		return img.checkpoint, nil
+	}
+
+	return nil, nil
+}
+
+func (d *fakeDestination) RemoveCheckpoint(ctx context.Context, spec backend.ImageSpec) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if img, ok := d.images[spec]; ok {
+		img.checkpoint = nil
+	}
+
+	return nil
+}
+
+func (d *fakeDestination) Close() error {
+	return nil
+}
+
+// A diff that is read as if it came from an exporter
+type testStream struct {
+	io.Reader
+	token string
+}
+
+func (s *testStream) ResumeToken() string {
+	return s.token
+}
+
+// Returns a stream that reads the data
+func newTestStream(data []byte) *testStream {
+	return &testStream{
+		Reader: bytes.NewReader(data),
+		token: "token",
+	}
+}
+
+// A record in a diff that is built for a test
+type testRecord struct {
+	offset uint64
+	length uint64
+	data []byte
+}
+
+// Returns a diff with the records and the image they are applied to
+func buildDiff(t *testing.T, fromSnap string, toSnap string, size uint64, base []byte, records []testRecord) ([]byte, []byte) {
+	t.Helper()
+
+	want := make([]byte, size)
+	copy(want, base)
+
+	var buf bytes.Buffer
+	dw := diff.NewWriter(&buf)
+
+	if err := dw.WriteHeader(fromSnap, toSnap, size); err != nil {
+		t.Fatalf("write header: %v", err)
+	}
+
+	for _, rec := range records {
+		var err error
+		if rec.data != nil {
+			err = dw.WriteData(rec.offset, rec.data)
+			copy(want[rec.offset:], rec.data)
+		} else {
+			err = dw.WriteZero(rec.offset, rec.length)
+			clear(want[rec.offset : rec.offset+rec.length])
+		}
+
+		if err != nil {
+			t.Fatalf("write record: %v", err)
+		}
+	}
+
+	if err := dw.WriteEnd(); err != nil {
+		t.Fatalf("write end: %v", err)
+	}
+
+	return buf.Bytes(), want
+}
+
+// Returns n bytes that is not zero
+func filled(n int, b byte) []byte {
+	return bytes.Repeat([]byte{b}, n)
+}
+
+func TestApplyDiff(t *testing.T) {
+	ctx := context.Background()
+	dest := newFakeDestination()
+
+	spec := backend.ImageSpec{
+		Pool: "pool",
+		Image: "image",
+	}
+
+	// Zero records that is not aligned to anything punch holes in data
+	full, want := buildDiff(t, "", "s1", 8192, nil, []testRecord{
+		{offset: 0, data: filled(4096, 0xaa)},
+		{offset: 4096, data: filled(4096, 0xbb)},
+		{offset: 100, length: 333},
+		{offset: 4000, length: 200},
+		{offset: 8191, length: 1},
+	})
+
+	cp := &checkpoint{}
+	if err := applyDiff(ctx, zap.NewNop(), dest, spec, "s1", "", newTestStream(full), cp, false); err != nil {
+		t.Fatalf("apply full diff: %v", err)
+	}
+
+	if !cp.complete || cp.offset != uint64(len(full)) {
+		t.Fatalf("got checkpoint %+v after full diff, expected complete at %d", cp, len(full))
+	}
+
+	if got := dest.images[spec].data; !bytes.Equal(got, want) {
+		t.Fatalf("image is not equal to the full diff")
+	}
+
+	// The incremental diff grows the image and zeroes across the old end
+	incremental, want := buildDiff(t, "s1", "s2", 10000, want, []testRecord{
+		{offset: 8500, data: filled(1000, 0xcc)},
+		{offset: 1, length: 4094},
+		{offset: 8000, length: 600},
+	})
+
+	cp = &checkpoint{}
+	if err := applyDiff(ctx, zap.NewNop(), dest, spec, "s2", "s1", newTestStream(incremental), cp, true); err != nil {
+		t.Fatalf("apply incremental diff: %v", err)
+	}
+
+	if got := dest.images[spec].data; !bytes.Equal(got, want) {
+		t.Fatalf("image is not equal to the incremental diff")
+	}
+}
+
+func TestApplyDiffExisting(t *testing.T) {
+	ctx := context.Background()
+	dest := newFakeDestination()
+
+	spec := backend.ImageSpec{
+		Pool: "pool",
+		Image: "image",
+	}
+
+	// Data from an earlier snapshot that is unallocated in the next one,
+	// the full diff has no records for it
+	stale, _ := buildDiff(t, "", "s1", 8192, nil, []testRecord{
+		{offset: 0, data: filled(8192, 0xee)},
+	})
+
+	if err := applyDiff(ctx, zap.NewNop(), dest, spec, "s1", "", newTestStream(stale), &checkpoint{}, false); err != nil {
+		t.Fatalf("apply stale diff: %v", err)
+	}
+
+	full, want := buildDiff(t, "", "s2", 12288, nil, []testRecord{
+		{offset: 4096, data: filled(2048, 0xaa)},
+	})
+
+	if err := applyDiff(ctx, zap.NewNop(), dest, spec, "s2", "", newTestStream(full), &checkpoint{}, true); err != nil {
+		t.Fatalf("apply full diff: %v", err)
+	}
+
+	if got := dest.images[spec].data; !bytes.Equal(got, want) {
+		t.Fatalf("image has data that is not in the full diff")
+	}
+}
+
+func TestApplyDiffWrongSnapshot(t *testing.T) {
+	data, _ := buildDiff(t, "s1", "s2", 4096, nil, nil)
+
+	cp := &checkpoint{}
+	err := applyDiff(context.Background(), zap.NewNop(), newFakeDestination(), backend.ImageSpec{Pool: "pool", Image: "image"},
+		"s2", "", newTestStream(data), cp, false)
+	if !errors.Is(err, diff.ErrInvalidDiff) {
+		t.Fatalf("got %v, expected ErrInvalidDiff", err)
+	}
+}
+
+func TestApplyDiffResume(t *testing.T) {
+	ctx := context.Background()
+	logger := zap.NewNop()
+	dest := newFakeDestination()
+
+	spec := backend.ImageSpec{
+		Pool: "pool",
+		Image: "image",
+	}
+
+	data, want := buildDiff(t, "", "s1", 16384, nil, []testRecord{
+		{offset: 0, data: filled(4096, 0xaa)},
+		{offset: 100, length: 333},
+		{offset: 8192, data: filled(4096, 0xbb)},
+		{offset: 12288, data: filled(4096, 0xcc)},
+	})
+
+	// The stream ends in the middle of the third record
+	cut := len(data) - 4096 - 17 - 2000
+	cp := &checkpoint{}
+	err := applyDiff(ctx, logger, dest, spec, "s1", "", newTestStream(data[:cut]), cp, false)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("got %v applying a truncated diff, expected io.ErrUnexpectedEOF", err)
+	}
+
+	if cp.complete || cp.offset == 0 || cp.offset >= uint64(cut) {
+		t.Fatalf("got checkpoint %+v, expected an offset before %d", cp, cut)
+	}
+
+	if dest.images[spec].flushes == 0 {
+		t.Fatalf("image was not flushed before the checkpoint was stored")
+	}
+
+	// The importer restarts and loads the checkpoint from the destination
+	loaded := loadCheckpoint(ctx, logger, dest, spec, "s1", "")
+	if !loaded.resumable() || loaded.offset != cp.offset || *loaded.header != *cp.header {
+		t.Fatalf("got checkpoint %+v from the destination, expected %+v", loaded, cp)
+	}
+
+	if other := loadCheckpoint(ctx, logger, dest, spec, "s2", "s1"); other.resumable() {
+		t.Fatalf("checkpoint for s1 was loaded for s2")
+	}
+
+	if err := applyDiff(ctx, logger, dest, spec, "s1", "", newTestStream(data[loaded.offset:]), loaded, true); err != nil {
+		t.Fatalf("resume diff: %v", err)
+	}
+
+	if !loaded.complete || loaded.offset != uint64(len(data)) {
+		t.Fatalf("got checkpoint %+v after resume, expected complete at %d", loaded, len(data))
+	}
+
+	if got := dest.images[spec].data; !bytes.Equal(got, want) {
+		t.Fatalf("image is not equal to the diff after resume")
+	}
+
+	// The digest covers the whole diff and not only the resumed part
+	digest := sha256.New()
+	if err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(loaded.digest); err != nil {
+		t.Fatalf("restore digest: %v", err)
+	}
+
+	if sum := sha256.Sum256(data); !bytes.Equal(digest.Sum(nil), sum[:]) {
+		t.Fatalf("digest after resume is not the digest of the whole diff")
+	}
+}
@@ -1,8 +1,15 @@
 package importer
 
 import (
+	"fmt"
 	"os"
 
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/backend/ceph"
+	"github.com/tobias-urdin/snapback/internal/backend/file"
+	"github.com/tobias-urdin/snapback/internal/config"
+	"github.com/tobias-urdin/snapback/internal/pins"
+
 	"github.com/spf13/cobra"
 	"go.uber.org/zap"
 )
@@ -11,29 +18,76 @@ func NewCommand() *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "importer",
 		Short: "Run importer",
-		Long:  "TODO",
-		Run:   runCommand,
+		Long: "Run importer. Settings is read from the --config file, " +
+			"environment variables and flags, in that order. The environment variable for a " +
+			"flag is " + envPrefix + " followed by the flag name in upper case with - replaced by _.",
+		Run: runCommand,
 	}
+
+	addConfigFlags(cmd.Flags())
+
 	return cmd
 }
 
 func runCommand(cmd *cobra.Command, args []string) {
-	logger, err := zap.NewProduction()
+	cfg, err := loadConfig(cmd.Flags())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	logger, err := config.NewLogger(cfg.LogLevel)
 	if err != nil {
 		panic(err)
 	}
 	defer logger.Sync()
 
-	if err := runImporter(cmd, logger); err != nil {
+	if err := runImporter(cfg, logger); err != nil {
 		logger.Error(err.Error())
 		os.Exit(1)
 	}
 }
 
-func runImporter(cmd *cobra.Command, logger *zap.Logger) error {
+func newDestination(cfg *Config, logger *zap.Logger) (backend.Destination, error) {
+	switch cfg.Destination {
+	case "ceph":
+		return ceph.New(logger, ceph.Options{
+			ConfigFile: cfg.Ceph.Config,
+			User: cfg.Ceph.User,
+			Keyring: cfg.Ceph.Keyring,
+			Cluster: cfg.Ceph.Cluster,
+		})
+	case "file":
+		return file.New(logger, cfg.DestinationPath)
+	}
+
+	return nil, fmt.Errorf("unknown destination %q", cfg.Destination)
+}
+
+func runImporter(cfg *Config, logger *zap.Logger) error {
 	logger.Info("starting importer")
 
-	imp := NewImporter(logger)
+	dest, err := newDestination(cfg, logger)
+	if err != nil {
+		return err
+	}
+
+	imp := NewImporter(logger, dest, Options{
+		Exporter: cfg.Exporter,
+		Pools: cfg.Pools,
+		Interval: cfg.Interval,
+		ReconcileInterval: cfg.ReconcileInterval,
+		Parallel: cfg.Parallel,
+		MaxAge: cfg.MaxAge,
+		ExportTimeout: cfg.ExportTimeout,
+		PoolMap: cfg.PoolMap,
+		TLSCert: cfg.TLS.Cert,
+		TLSKey: cfg.TLS.Key,
+		TLSCA: cfg.TLS.CA,
+		ServerName: cfg.TLS.ServerName,
+		KnownHosts: cfg.TLS.KnownHosts,
+		PinMode: pins.Mode(cfg.TLS.PinMode),
+	})
 
 	if err := imp.Init(); err != nil {
 		return err
@@ -0,0 +1,241 @@
+package importer
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/tobias-urdin/snapback/internal/config"
+	"github.com/tobias-urdin/snapback/internal/pins"
+
+	"github.com/spf13/pflag"
+)
+
+// The prefix of the environment variables for the importer
+const envPrefix = "SNAPBACK_IMPORTER_"
+
+// TLS settings for the importer
+type TLSConfig struct {
+	// The certificate the importer identifies itself with
+	Cert string `yaml:"cert"`
+
+	// The private key for the certificate
+	Key string `yaml:"key"`
+
+	// The CA that the exporter certificate must be signed by
+	CA string `yaml:"ca"`
+
+	// The name the exporter certificate must be valid for
+	ServerName string `yaml:"server-name"`
+
+	// The file with pinned exporters
+	KnownHosts string `yaml:"known-hosts"`
+
+	// What to do when the exporter is not pinned, strict or tofu
+	PinMode string `yaml:"pin-mode"`
+}
+
+// Importer config, it is loaded from a YAML file and overridden by
+// environment variables and flags.
+type Config struct {
+	// The address of the exporter
+	Exporter string `yaml:"exporter"`
+
+	// The pools on the exporter to import, the exporter is asked which
+	// pools it has if empty
+	Pools []string `yaml:"pools"`
+
+	// Maps a pool on the exporter to a pool on the destination
+	PoolMap map[string]string `yaml:"pool-map"`
+
+	// The time between import runs when the exporter cannot send events
+	Interval time.Duration `yaml:"interval"`
+
+	// The time between full import runs when events is received
+	ReconcileInterval time.Duration `yaml:"reconcile-interval"`
+
+	// The maximum number of exports that is run at once
+	Parallel int `yaml:"parallel"`
+
+	// Snapshots older than this is not imported, zero imports all
+	MaxAge time.Duration `yaml:"max-age"`
+
+	// The time an export of a snapshot can take before it is cancelled,
+	// zero means no limit
+	ExportTimeout time.Duration `yaml:"export-timeout"`
+
+	// The log level
+	LogLevel string `yaml:"log-level"`
+
+	// The storage to import to, ceph or file
+	Destination string `yaml:"destination"`
+
+	// The root directory for the file destination
+	DestinationPath string `yaml:"destination-path"`
+
+	// The Ceph cluster for the ceph destination
+	Ceph config.Ceph `yaml:"ceph"`
+
+	// TLS settings
+	TLS TLSConfig `yaml:"tls"`
+}
+
+// Returns the default config
+func DefaultConfig() Config {
+	return Config{
+		Exporter: DefaultExporter,
+		Interval: DefaultInterval,
+		ReconcileInterval: DefaultReconcileInterval,
+		Parallel: DefaultParallel,
+		LogLevel: "info",
+		Destination: "ceph",
+		Ceph: config.DefaultCeph(),
+		TLS: TLSConfig{
+			PinMode: string(pins.ModeStrict),
+		},
+	}
+}
+
+// Add the flags for the config
+func addConfigFlags(flags *pflag.FlagSet) {
+	defaults := DefaultConfig()
+
+	flags.String(config.FlagName, "", "YAML config file")
+	flags.String("exporter", defaults.Exporter, "address of the exporter")
+	flags.StringSlice("pools", defaults.Pools, "pools on the exporter to import, all pools the exporter allows is imported if empty")
+	flags.StringToString("pool-map", defaults.PoolMap, "map pools on the exporter to pools on the destination, source=destination")
+	flags.Duration("interval", defaults.Interval, "time between import runs when the exporter cannot send events")
+	flags.Duration("reconcile-interval", defaults.ReconcileInterval, "time between full import runs when events is received from the exporter")
+	flags.Int("parallel", defaults.Parallel, "maximum number of exports that is run at once")
+	flags.Duration("max-age", defaults.MaxAge, "snapshots older than this is not imported, 0 imports all")
+	flags.Duration("export-timeout", defaults.ExportTimeout, "time an export of a snapshot can take before it is cancelled, 0 is no limit")
+	flags.String("log-level", defaults.LogLevel, "log level, debug, info, warn or error")
+	flags.String("destination", defaults.Destination, "storage to import to, ceph or file")
+	flags.String("destination-path", defaults.DestinationPath, "root directory for the file destination")
+	config.AddCephFlags(flags)
+	flags.String("tls-cert", defaults.TLS.Cert, "certificate the importer identifies itself with")
+	flags.String("tls-key", defaults.TLS.Key, "private key for the certificate")
+	flags.String("tls-ca", defaults.TLS.CA, "ca that the exporter certificate must be signed by, optional with --known-hosts")
+	flags.String("server-name", defaults.TLS.ServerName, "name the exporter certificate must be valid for, defaults to the exporter host")
+	flags.String("known-hosts", defaults.TLS.KnownHosts, "file with pinned exporters, for example "+pins.DefaultPath)
+	flags.String("pin-mode", defaults.TLS.PinMode, "what to do when the exporter is not pinned, strict refuses it and tofu pins it")
+}
+
+// Load the config from the config file, environment variables and flags
+// and validate it
+func loadConfig(flags *pflag.FlagSet) (*Config, error) {
+	cfg := DefaultConfig()
+	b := config.NewBinder(flags, envPrefix)
+
+	if path := b.ConfigFile(); path != "" {
+		if err := config.Load(path, &cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	b.String("exporter", &cfg.Exporter)
+	b.StringSlice("pools", &cfg.Pools)
+	b.StringToString("pool-map", &cfg.PoolMap)
+	b.Duration("interval", &cfg.Interval)
+	b.Duration("reconcile-interval", &cfg.ReconcileInterval)
+	b.Int("parallel", &cfg.Parallel)
+	b.Duration("max-age", &cfg.MaxAge)
+	b.Duration("export-timeout", &cfg.ExportTimeout)
+	b.String("log-level", &cfg.LogLevel)
+	b.String("destination", &cfg.Destination)
+	b.String("destination-path", &cfg.DestinationPath)
+	cfg.Ceph.Bind(b)
+	b.String("tls-cert", &cfg.TLS.Cert)
+	b.String("tls-key", &cfg.TLS.Key)
+	b.String("tls-ca", &cfg.TLS.CA)
+	b.String("server-name", &cfg.TLS.ServerName)
+	b.String("known-hosts", &cfg.TLS.KnownHosts)
+	b.String("pin-mode", &cfg.TLS.PinMode)
+
+	if err := b.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+
+	return &cfg, nil
+}
+
+// Validate the config, all errors is returned
+func (c *Config) Validate() error {
+	var errs []error
+
+	errs = append(errs, config.Address("exporter", c.Exporter, true))
+
+	seen := map[string]bool{}
+	for idx, pool := range c.Pools {
+		switch {
+		case pool == "":
+			errs = append(errs, fmt.Errorf("pools[%d]: pool name is empty", idx))
+		case seen[pool]:
+			errs = append(errs, fmt.Errorf("pools[%d]: pool %s is listed more than once", idx, pool))
+		}
+
+		seen[pool] = true
+	}
+
+	for source, dest := range c.PoolMap {
+		if len(c.Pools) > 0 && !seen[source] {
+			errs = append(errs, fmt.Errorf("pool-map: pool %s is not in pools", source))
+		}
+
+		if dest == "" {
+			errs = append(errs, fmt.Errorf("pool-map: pool %s is mapped to an empty pool name", source))
+		}
+	}
+
+	if c.Interval <= 0 {
+		errs = append(errs, fmt.Errorf("interval: must be positive, got %s", c.Interval))
+	}
+
+	if c.ReconcileInterval <= 0 {
+		errs = append(errs, fmt.Errorf("reconcile-interval: must be positive, got %s", c.ReconcileInterval))
+	}
+
+	if c.Parallel < 1 {
+		errs = append(errs, fmt.Errorf("parallel: must be at least 1, got %d", c.Parallel))
+	}
+
+	if c.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("max-age: must not be negative, got %s", c.MaxAge))
+	}
+
+	if c.ExportTimeout < 0 {
+		errs = append(errs, fmt.Errorf("export-timeout: must not be negative, got %s", c.ExportTimeout))
+	}
+
+	errs = append(errs, config.LogLevel("log-level", c.LogLevel))
+
+	switch c.Destination {
+	case "ceph":
+		errs = append(errs, c.Ceph.Validate())
+	case "file":
+		if c.DestinationPath == "" {
+			errs = append(errs, errors.New("destination-path: is required for the file destination"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("destination: unknown destination %q, must be ceph or file", c.Destination))
+	}
+
+	errs = append(errs, config.FileRequired("tls.cert", c.TLS.Cert))
+	errs = append(errs, config.FileRequired("tls.key", c.TLS.Key))
+
+	if c.TLS.KnownHosts == "" {
+		errs = append(errs, config.FileRequired("tls.ca", c.TLS.CA))
+	} else {
+		errs = append(errs, config.FileExists("tls.ca", c.TLS.CA))
+	}
+
+	if _, err := pins.ParseMode(c.TLS.PinMode); err != nil {
+		errs = append(errs, fmt.Errorf("tls.pin-mode: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -1,201 +1,939 @@
 package importer
 
 import (
+	"errors"
+	"fmt"
 	"os"
 	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"sort"
 	"syscall"
 	"time"
 	"context"
-	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
 
-	"github.com/tobias-urdin/snapback/internal/message"
+	"github.com/tobias-urdin/snapback/client"
+	"github.com/tobias-urdin/snapback/internal/backend"
+	"github.com/tobias-urdin/snapback/internal/certs"
+	"github.com/tobias-urdin/snapback/internal/diff"
+	"github.com/tobias-urdin/snapback/internal/pins"
 
 	"go.uber.org/zap"
-	"github.com/quic-go/quic-go"
 )
 
-// Exporter address
-// TODO(tobias.urdin): Hardcoded
-const exporterAddr = "localhost:4242"
+// The default address of the exporter
+const DefaultExporter = "localhost:4242"
+
+// The number of list snapshot requests that is sent at once
+const listFanOut = 16
+
+// The default number of exports that is run at once
+const DefaultParallel = 4
+
+// The default time between import runs when the exporter cannot send
+// events
+const DefaultInterval = 10 * time.Second
+
+// The default time between full import runs when events is received
+// from the exporter
+const DefaultReconcileInterval = time.Hour
+
+// The number of attempts for an export that fails with a retryable error
+const exportAttempts = 5
+
+// The number of attempts for an export that is resumed when interrupted
+const resumeAttempts = 5
+
+// The time to wait for running exports to be cancelled when stopping
+const shutdownTimeout = 10 * time.Second
+
+// Importer options
+type Options struct {
+	// The address of the exporter
+	Exporter string
+
+	// The pools on the exporter to import, all pools the exporter lets
+	// the importer access is imported if empty
+	Pools []string
+
+	// The time between import runs when the exporter cannot send events
+	Interval time.Duration
+
+	// The time between full import runs when events is received from the
+	// exporter, the runs catches anything that was missed
+	ReconcileInterval time.Duration
+
+	// The maximum number of exports that is run at once
+	Parallel int
+
+	// Snapshots older than this is not imported, zero imports all
+	MaxAge time.Duration
+
+	// The time an export of a snapshot can take before it is cancelled,
+	// zero means no limit
+	ExportTimeout time.Duration
+
+	// Maps a pool on the exporter to a pool on the destination, pools
+	// that is not in the map is imported to a pool with the same name
+	PoolMap map[string]string
+
+	// The certificate and key the importer identifies itself with
+	TLSCert string
+	TLSKey string
+
+	// The CA that the exporter certificate must be signed by
+	TLSCA string
+
+	// The name the exporter certificate must be valid for, defaults
+	// to the host in the exporter address
+	ServerName string
+
+	// The file with pinned exporters, pinning is not used if empty
+	KnownHosts string
+
+	// What to do when the exporter is not pinned
+	PinMode pins.Mode
+}
 
 // Importer
 type Importer struct {
 	// Logger
 	logger *zap.Logger
 
-	// Message handler
-	handler *message.MessageHandler
+	// Options
+	opts Options
+
+	// Client for the exporter
+	client *client.Client
+
+	// The destination images is imported to
+	dest backend.Destination
 
-	// Connection
-	conn quic.Connection
+	// Holds a slot for each running image export
+	exports chan struct{}
+
+	// The images that is being imported
+	inflight *inflight
+
+	// Set while events is received from the exporter
+	subscribed atomic.Bool
+
+	// Asks the import loop to do a full run
+	reconcile chan struct{}
 }
 
-// Create a new importer
-func NewImporter(logger *zap.Logger) *Importer {
+// Create a new importer that imports images to the destination
+func NewImporter(logger *zap.Logger, dest backend.Destination, opts Options) *Importer {
+	if opts.Exporter == "" {
+		opts.Exporter = DefaultExporter
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = DefaultInterval
+	}
+
+	if opts.Parallel <= 0 {
+		opts.Parallel = DefaultParallel
+	}
+
+	if opts.ReconcileInterval <= 0 {
+		opts.ReconcileInterval = DefaultReconcileInterval
+	}
+
 	return &Importer{
 		logger: logger,
+		opts: opts,
+		dest: dest,
+		exports: make(chan struct{}, opts.Parallel),
+		inflight: newInflight(),
+		reconcile: make(chan struct{}, 1),
 	}
 }
 
 // Initialize importer
 func (i *Importer) Init() error {
 	i.logger.Info("initialize importer")
-        i.handler = message.NewHandler(i.logger)
 
-        return nil
+	return nil
 }
 
 // Close importer
 func (i *Importer) Close() {
 	i.logger.Info("close importer")
+
+	if err := i.dest.Close(); err != nil {
+		i.logger.Error("failed to close destination", zap.Error(err))
+	}
 }
 
-// Generate TLS config
-func (i *Importer) generateTLSConfig() *tls.Config {
-	return &tls.Config{
-		InsecureSkipVerify: true,
-		NextProtos:         []string{"snapback"},
+// Returns the image on the destination for an image on the exporter, the
+// image is in the same namespace on the destination
+func (i *Importer) destSpec(spec client.ImageSpec) backend.ImageSpec {
+	pool := spec.Pool
+	if destPool, ok := i.opts.PoolMap[pool]; ok {
+		pool = destPool
+	}
+
+	return backend.ImageSpec{
+		Pool: pool,
+		Namespace: spec.Namespace,
+		Image: spec.Image,
 	}
 }
 
-// Run one iteration of the importer
-func (i *Importer) run(ctx context.Context) error {
-	stream, err := i.conn.OpenStreamSync(ctx)
+// Returns the backend image info for the image info from the exporter,
+// the data pool is mapped like the image pool
+func (i *Importer) destImageInfo(info *client.ImageInfo) *backend.ImageInfo {
+	result := &backend.ImageInfo{
+		Size: info.Size,
+		Order: info.Order,
+		ObjectSize: info.ObjectSize,
+		Features: info.Features,
+		StripeUnit: info.StripeUnit,
+		StripeCount: info.StripeCount,
+		DataPool: info.DataPool,
+		Metadata: info.Metadata,
+		CreateTimestamp: info.CreateTimestamp,
+	}
+
+	if destPool, ok := i.opts.PoolMap[info.DataPool]; ok {
+		result.DataPool = destPool
+	}
+
+	if info.Parent != nil {
+		result.Parent = &backend.ParentSpec{
+			Pool: info.Parent.Pool,
+			Namespace: info.Parent.Namespace,
+			Image: info.Parent.Image,
+			Snapshot: info.Parent.Snapshot,
+		}
+	}
+
+	return result
+}
+
+// Get the image info from the exporter, create the image on the
+// destination with the same layout if it does not exist and store the
+// info alongside it. Without image info the image is created when the
+// first diff is applied.
+func (i *Importer) prepareImage(ctx context.Context, source client.ImageSpec, exists bool) error {
+	spec := i.destSpec(source)
+
+	info, err := i.client.ImageInfo(ctx, source, "")
+	if errors.Is(err, client.ErrNotSupported) {
+		i.logger.Debug("exporter does not support image info", zap.Stringer("image", source))
+		return nil
+	}
 	if err != nil {
+		return fmt.Errorf("get image info: %w", err)
+	}
+
+	destInfo := i.destImageInfo(info)
+
+	if !exists {
+		if err := i.dest.CreateImage(ctx, spec, destInfo); err != nil {
+			return err
+		}
+	}
+
+	if err := i.dest.SaveImageInfo(ctx, spec, destInfo); err != nil {
 		return err
 	}
-	defer stream.Close()
 
+	return nil
+}
+
+// Export a snapshot of an image and apply it to the destination, if
+// fromSnap is set only the changes since that snapshot is exported. An
+// export that is interrupted is resumed from where the diff was applied
+// to, unless the exporter cannot resume it. If existing is set the image
+// can have data that is not in a full diff, see applyDiff.
+func (i *Importer) export(ctx context.Context, source client.ImageSpec, snap string, fromSnap string, existing bool) error {
 	logger := i.logger.With(
-		zap.Any("stream", stream.StreamID()))
+		zap.Stringer("image", source),
+		zap.String("snapshot", snap),
+		zap.String("from_snapshot", fromSnap))
+
+	// The cause is sent to the exporter as the reason the export is cancelled
+	if i.opts.ExportTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, i.opts.ExportTimeout,
+			fmt.Errorf("export timed out after %s", i.opts.ExportTimeout))
+		defer cancel()
+	}
+
+	cp := loadCheckpoint(ctx, logger, i.dest, i.destSpec(source), snap, fromSnap)
 
-	logger.Info("starting import")
+	for attempt := 1; ; attempt++ {
+		err := i.exportOnce(ctx, logger, source, snap, fromSnap, cp, existing)
+		if err == nil {
+			logger.Info("export completed")
+			return nil
+		}
+
+		if ctx.Err() != nil {
+			return fmt.Errorf("export cancelled: %w", context.Cause(ctx))
+		}
 
-	listMsg := message.ListPoolRequestV1{
-		Pool: "nova",
+		if errors.Is(err, client.ErrInvalidResumeToken) {
+			// The snapshots has changed, the diff cannot be trusted to
+			// be the same so it is started over
+			logger.Warn("export cannot be resumed, starting over", zap.Error(err))
+			cp = i.resetCheckpoint(ctx, logger, source)
+		} else if errors.Is(err, client.ErrDigestMismatch) {
+			// What was applied is not what the exporter sent, the
+			// snapshot is not created and the diff is applied again
+			logger.Warn("export failed verification, starting over", zap.Error(err))
+			cp = i.resetCheckpoint(ctx, logger, source)
+		} else if !cp.resumable() || !resumable(err) {
+			return err
+		}
+
+		// What was applied before the export started over is not in the
+		// diff that is applied next
+		existing = true
+
+		if attempt == resumeAttempts || ctx.Err() != nil {
+			return err
+		}
+
+		logger.Warn("export interrupted, resuming", zap.Uint64("offset", cp.offset),
+			zap.Int("attempt", attempt), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
 	}
+}
 
-	if err := message.Send(stream, &listMsg); err != nil {
-		return err
+// Remove the checkpoint that is stored for the image and returns an empty
+// checkpoint to start the export over with
+func (i *Importer) resetCheckpoint(ctx context.Context, logger *zap.Logger, source client.ImageSpec) *checkpoint {
+	if err := i.dest.RemoveCheckpoint(ctx, i.destSpec(source)); err != nil {
+		logger.Warn("failed to remove checkpoint", zap.Error(err))
 	}
 
-	var respMsg message.Message
-	if err := i.handler.Read(stream, &respMsg); err != nil {
+	return &checkpoint{}
+}
+
+// Returns true if an export that failed with the error can be resumed,
+// errors that would fail the same way again cannot
+func resumable(err error) bool {
+	return !errors.Is(err, client.ErrNotFound) &&
+		!errors.Is(err, client.ErrPermissionDenied) &&
+		!errors.Is(err, client.ErrInvalidFromSnapshot) &&
+		!errors.Is(err, client.ErrNotSupported) &&
+		!errors.Is(err, diff.ErrInvalidDiff)
+}
+
+// Export a snapshot of an image from the checkpoint and apply it to the
+// destination
+func (i *Importer) exportOnce(ctx context.Context, logger *zap.Logger, source client.ImageSpec, snap string, fromSnap string, cp *checkpoint, existing bool) error {
+	r, err := i.client.Export(ctx, &client.ExportRequest{
+		Pool: source.Pool,
+		Namespace: source.Namespace,
+		Image: source.Image,
+		Snapshot: snap,
+		FromSnapshot: fromSnap,
+		ResumeToken: cp.token,
+		Offset: cp.offset,
+		DigestState: cp.digest,
+	})
+	if err != nil {
 		return err
 	}
+	defer r.Close()
+
+	// NOTE: An error from the exporter is returned when the
+	// diff is read so it is passed through applyDiff.
+	if !cp.complete {
+		if err := applyDiff(ctx, logger, i.dest, i.destSpec(source), snap, fromSnap, r, cp, existing); err != nil {
+			return fmt.Errorf("apply diff: %w", err)
+		}
+	}
 
-	var respList message.ListPoolResponseV1
-	if err := respMsg.Unmarshal(&respList); err != nil {
+	// NOTE: The diff ends before the export response, read
+	// to the end so we know that the exporter finished the export.
+	if _, err := io.Copy(io.Discard, r); err != nil {
 		return err
 	}
 
-	logger.Info("list pool response message", zap.Any("msg", respList))
+	return nil
+}
 
-	cb := func(msg *message.Message) error {
-		var chunk message.ExportChunkV1
-		if err := msg.Unmarshal(&chunk); err != nil {
-			return err
+// Returns the snapshots that should be imported ordered by their ID.
+// Snapshots that is not user snapshots is skipped, rbd creates and removes
+// them by itself. Snapshots older than the max age is only kept so they
+// can be used as a base if they are already imported.
+func (i *Importer) selectSnapshots(logger *zap.Logger, image client.ImageSpec, snaps []client.Snapshot) []client.Snapshot {
+	result := make([]client.Snapshot, 0, len(snaps))
+	for _, snap := range snaps {
+		// NOTE: Older exporters does not send the namespace
+		if snap.Namespace != "" && snap.Namespace != string(backend.SnapshotNamespaceUser) {
+			logger.Debug("skipping snapshot that is not a user snapshot", zap.Stringer("image", image),
+				zap.String("snapshot", snap.Name), zap.String("namespace", snap.Namespace))
+			continue
 		}
 
-		logger.Info("got export chunk", zap.Any("crc", chunk.PayloadCRC))
-		return nil
+		result = append(result, snap)
 	}
 
-	for _, image := range respList.Names {
-		logger.Info("get snapshots for image", zap.String("image", image))
-		listSnapMsg := message.ListSnapshotsRequestV1{
-			Pool: "nova",
-			Image: image,
-		}
+	// NOTE: Older exporters does not send the ID but the
+	// snapshots is already in order, a stable sort keeps that order.
+	sort.SliceStable(result, func(a, b int) bool {
+		return result[a].ID < result[b].ID
+	})
 
-		if err := message.Send(stream, &listSnapMsg); err != nil {
-			logger.Error("failed to send message", zap.String("error", err.Error()))
-			continue
+	return result
+}
+
+// Returns true if the snapshot is too old to be imported
+func (i *Importer) tooOld(snap client.Snapshot) bool {
+	if i.opts.MaxAge <= 0 || snap.Timestamp.IsZero() {
+		return false
+	}
+
+	return time.Since(snap.Timestamp) > i.opts.MaxAge
+}
+
+// Import the snapshots of an image that is missing on the destination in
+// order. Each snapshot is exported incrementally from the newest snapshot
+// that both sides has, and is created on the destination once applied so
+// the next snapshot has a base. A snapshot that fails with a retryable
+// error is retried a few times.
+func (i *Importer) exportImage(ctx context.Context, source client.ImageSpec, snapshots []client.Snapshot) error {
+	spec := i.destSpec(source)
+
+	destSnaps, err := i.dest.ListSnapshots(ctx, spec)
+	if err != nil && !errors.Is(err, backend.ErrNotFound) {
+		return fmt.Errorf("list snapshots of destination image %s: %w", spec, err)
+	}
+
+	imported := make(map[string]bool, len(destSnaps))
+	for _, snap := range destSnaps {
+		imported[snap.Name] = true
+	}
+
+	pending := false
+	for _, snap := range snapshots {
+		if !imported[snap.Name] && !i.tooOld(snap) {
+			pending = true
+			break
 		}
+	}
+
+	if !pending {
+		return nil
+	}
+
+	existing := err == nil
+	if err := i.prepareImage(ctx, source, existing); err != nil {
+		return fmt.Errorf("prepare destination image %s: %w", spec, err)
+	}
+
+	fromSnap := ""
+
+	for _, info := range snapshots {
+		snap := info.Name
 
-		var respSnapMsg message.Message
-		if err := i.handler.Read(stream, &respSnapMsg); err != nil {
-			logger.Error("failed to read message", zap.String("error", err.Error()))
+		if imported[snap] {
+			fromSnap = snap
 			continue
 		}
 
-		var respSnaps message.ListSnapshotsResponseV1
-		if err := respSnapMsg.Unmarshal(&respSnaps); err != nil {
-			logger.Error("failed to unmarshal snaps", zap.String("error", err.Error()))
+		if i.tooOld(info) {
+			i.logger.Debug("skipping snapshot older than max age", zap.Stringer("image", source),
+				zap.String("snapshot", snap), zap.Time("timestamp", info.Timestamp))
 			continue
 		}
 
-		logger.Info("found snapshots for image", zap.String("image", image), zap.Any("snapshots", respSnaps.Snapshots))
-
-		// TODO(tobias.urdin): Hack just testing
-		for _, snap := range respSnaps.Snapshots {
-			exp := message.ExportRequestV1{
-				Pool: "nova",
-				Image: image,
-				Snapshot: snap,
+		for attempt := 1; ; attempt++ {
+			err := i.export(ctx, source, snap, fromSnap, existing)
+			if err == nil {
+				break
 			}
 
-			if err := message.Send(stream, &exp); err != nil {
-				logger.Error("failed to send export message", zap.String("error", err.Error()))
+			// The export can have written to the image before it failed
+			existing = true
+
+			// The exporter rejected our base, do a full export instead,
+			// the image is cleared before it is applied
+			if fromSnap != "" && (errors.Is(err, client.ErrInvalidFromSnapshot) || errors.Is(err, client.ErrNotSupported)) {
+				i.logger.Warn("invalid from snapshot, falling back to full export", zap.Stringer("image", source),
+					zap.String("snapshot", snap), zap.String("from_snapshot", fromSnap), zap.Error(err))
+
+				fromSnap = ""
 				continue
 			}
 
-			rawResp, err := i.handler.ReadChunks(stream, cb)
-			if err != nil {
-				logger.Error("failed to read chunks", zap.String("error", err.Error()))
-				continue
+			if !client.IsRetryable(err) || attempt == exportAttempts {
+				return fmt.Errorf("export %s@%s: %w", source, snap, err)
 			}
 
-			var resp message.ExportResponseV1
-			if err := rawResp.Unmarshal(&resp); err != nil {
-				logger.Error("failed to read export response message", zap.String("error", err.Error()))
-				continue
+			i.logger.Warn("export failed, retrying", zap.Stringer("image", source), zap.String("snapshot", snap),
+				zap.Int("attempt", attempt), zap.Error(err))
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(attempt) * time.Second):
+			}
+		}
+
+		if err := i.dest.CreateSnapshot(ctx, spec, snap); err != nil {
+			return fmt.Errorf("create snapshot %s of destination image %s: %w", snap, spec, err)
+		}
+
+		if err := i.dest.RemoveCheckpoint(ctx, spec); err != nil {
+			i.logger.Warn("failed to remove checkpoint", zap.Stringer("image", spec), zap.Error(err))
+		}
+
+		i.logger.Info("imported snapshot", zap.Stringer("image", spec), zap.String("snapshot", snap),
+			zap.String("from_snapshot", fromSnap))
+
+		fromSnap = snap
+		existing = true
+	}
+
+	return nil
+}
+
+// A namespace in a pool on the exporter that is imported
+type target struct {
+	// The pool name
+	pool string
+
+	// The RBD namespace, empty for the default namespace
+	namespace string
+}
+
+// Returns the pools and namespaces to import. The exporter is asked which
+// pools and namespaces the importer can access, only the configured pools
+// is imported if any is configured. Exporters that cannot list pools
+// only has the default namespace of the configured pools imported.
+func (i *Importer) targets(ctx context.Context) ([]target, error) {
+	pools, err := i.client.ListPools(ctx)
+	if errors.Is(err, client.ErrNotSupported) {
+		if len(i.opts.Pools) == 0 {
+			return nil, errors.New("exporter cannot list pools, the pools to import must be configured")
+		}
+
+		targets := make([]target, 0, len(i.opts.Pools))
+		for _, pool := range i.opts.Pools {
+			targets = append(targets, target{
+				pool: pool,
+			})
+		}
+
+		return targets, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list pools: %w", err)
+	}
+
+	var targets []target
+	for _, pool := range pools {
+		if len(i.opts.Pools) > 0 && !slices.Contains(i.opts.Pools, pool.Name) {
+			continue
+		}
+
+		for _, namespace := range pool.Namespaces {
+			targets = append(targets, target{
+				pool: pool.Name,
+				namespace: namespace,
+			})
+		}
+	}
+
+	return targets, nil
+}
+
+// Run one iteration of the importer
+func (i *Importer) run(ctx context.Context) error {
+	logger := i.logger
+
+	targets, err := i.targets(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("starting import", zap.Strings("pools", i.opts.Pools), zap.Int("namespaces", len(targets)))
+
+	var errs []error
+	for _, t := range targets {
+		logger := logger.With(zap.String("pool", t.pool), zap.String("namespace", t.namespace))
+
+		if err := i.importNamespace(ctx, logger, t); err != nil {
+			errs = append(errs, fmt.Errorf("import pool %s namespace %q: %w", t.pool, t.namespace, err))
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Import the images in a namespace of a pool, the errors of each image is
+// logged and the number of images that failed is returned as an error
+func (i *Importer) importNamespace(ctx context.Context, logger *zap.Logger, t target) error {
+	names, err := i.client.ListImages(ctx, &client.ListImagesRequest{
+		Pool: t.pool,
+		Namespace: t.namespace,
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("list pool response", zap.Int("images", len(names)))
+	logger.Debug("images in pool", zap.Strings("names", names))
+
+	specs := make([]client.ImageSpec, 0, len(names))
+	for _, name := range names {
+		specs = append(specs, client.ImageSpec{
+			Pool: t.pool,
+			Namespace: t.namespace,
+			Image: name,
+		})
+	}
+
+	// NOTE: The list snapshot requests is pipelined on the same stream,
+	// listFanOut of them is sent at once.
+	snapshots := make([][]client.Snapshot, len(specs))
+
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, listFanOut)
+	for idx, spec := range specs {
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(idx int, spec client.ImageSpec) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			snaps, err := i.client.ListSnapshots(ctx, spec)
+			if err != nil {
+				logger.Error("failed to list snapshots", zap.String("image", spec.Image), zap.Error(err))
+				failed.Add(1)
+				return
 			}
 
-			logger.Info("got export response", zap.Any("msg", resp))
+			snapshots[idx] = i.selectSnapshots(logger, spec, snaps)
+		}(idx, spec)
+	}
+	wg.Wait()
+
+	// Images are exported in parallel where each export is done on its
+	// own stream, snapshots of an image is exported in order. There is
+	// no point in starting more images than there is export slots.
+	sem = make(chan struct{}, i.opts.Parallel)
+	for idx, spec := range specs {
+		if len(snapshots[idx]) == 0 {
+			continue
 		}
+
+		sem <- struct{}{}
+		wg.Add(1)
+
+		go func(spec client.ImageSpec, snaps []client.Snapshot) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := i.importImage(ctx, logger, spec, snaps); err != nil {
+				failed.Add(1)
+			}
+		}(spec, snapshots[idx])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("%d of %d images failed", n, len(specs))
 	}
 
 	return nil
 }
 
+// Tracks the images that is being imported so an image is only imported
+// once at a time
+type inflight struct {
+	// Protects images
+	mu sync.Mutex
+
+	// The images that is being imported
+	images map[client.ImageSpec]*inflightImage
+}
+
+// An image that is being imported
+type inflightImage struct {
+	// Set if the image should be imported again once done
+	again bool
+
+	// The error of the last import, it is set before done is closed
+	err error
+
+	// Closed when the image is no longer being imported
+	done chan struct{}
+}
+
+// Returns a new inflight
+func newInflight() *inflight {
+	return &inflight{
+		images: make(map[client.ImageSpec]*inflightImage),
+	}
+}
+
+// Returns true if the image can be imported, if it is already being
+// imported it is marked to be imported again and false is returned with
+// the image that is being imported
+func (f *inflight) start(spec client.ImageSpec) (bool, *inflightImage) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if img, ok := f.images[spec]; ok {
+		img.again = true
+		return false, img
+	}
+
+	f.images[spec] = &inflightImage{
+		done: make(chan struct{}),
+	}
+	return true, nil
+}
+
+// Returns true if the image should be imported again, otherwise the
+// image is no longer being imported and err is the result of the import
+func (f *inflight) done(spec client.ImageSpec, err error) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	img := f.images[spec]
+	if img.again {
+		img.again = false
+		return true
+	}
+
+	img.err = err
+	close(img.done)
+	delete(f.images, spec)
+	return false
+}
+
+// Wait until no image is being imported, returns the number of images
+// that is still being imported when the timeout expires
+func (f *inflight) wait(timeout time.Duration) int {
+	deadline := time.After(timeout)
+
+	for {
+		f.mu.Lock()
+		running := make([]<-chan struct{}, 0, len(f.images))
+		for _, img := range f.images {
+			running = append(running, img.done)
+		}
+		f.mu.Unlock()
+
+		if len(running) == 0 {
+			return 0
+		}
+
+		for _, done := range running {
+			select {
+			case <-done:
+			case <-deadline:
+				return len(running)
+			}
+		}
+	}
+}
+
+// Import the snapshots of an image, the snapshots is listed on the
+// exporter if snaps is nil. If the image is already being imported it is
+// imported again once done with its snapshots listed again, we wait for
+// that so the caller knows that the image has been imported.
+func (i *Importer) importImage(ctx context.Context, logger *zap.Logger, spec client.ImageSpec, snaps []client.Snapshot) error {
+	started, img := i.inflight.start(spec)
+	if !started {
+		logger.Debug("image is already being imported", zap.String("image", spec.Image))
+
+		select {
+		case <-img.done:
+			return img.err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return i.runImport(ctx, logger, spec, snaps)
+}
+
+// Import an image in the background, the import is tracked like the ones
+// started by importImage so the importer waits for it when stopping
+func (i *Importer) goImport(ctx context.Context, logger *zap.Logger, spec client.ImageSpec) {
+	if started, _ := i.inflight.start(spec); !started {
+		logger.Debug("image is already being imported", zap.String("image", spec.Image))
+		return
+	}
+
+	go i.runImport(ctx, logger, spec, nil)
+}
+
+// Import an image that was started in inflight until it no longer has to
+// be imported again, returns the error of the last import
+func (i *Importer) runImport(ctx context.Context, logger *zap.Logger, spec client.ImageSpec, snaps []client.Snapshot) error {
+	for {
+		err := i.importOnce(ctx, logger, spec, snaps)
+		if !i.inflight.done(spec, err) {
+			return err
+		}
+
+		snaps = nil
+	}
+}
+
+// Import the snapshots of an image once, the errors is logged here since
+// imports started by events has no one else to report them to
+func (i *Importer) importOnce(ctx context.Context, logger *zap.Logger, spec client.ImageSpec, snaps []client.Snapshot) error {
+	if snaps == nil {
+		list, err := i.client.ListSnapshots(ctx, spec)
+		if err != nil {
+			logger.Error("failed to list snapshots", zap.String("image", spec.Image), zap.Error(err))
+			return fmt.Errorf("list snapshots of %s: %w", spec, err)
+		}
+
+		snaps = i.selectSnapshots(logger, spec, list)
+	}
+
+	select {
+	case i.exports <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	err := i.exportImage(ctx, spec, snaps)
+	<-i.exports
+
+	if err != nil && ctx.Err() != nil {
+		logger.Info("image export stopped", zap.String("image", spec.Image), zap.Error(err))
+	} else if err != nil {
+		logger.Error("image export failed", zap.String("image", spec.Image), zap.Error(err))
+	}
+
+	return err
+}
+
+// Returns a function that verifies the exporter certificate against
+// its pin, or nil if pinning is not used.
+func (i *Importer) pinVerifier() (func(*x509.Certificate) error, error) {
+	if i.opts.KnownHosts == "" {
+		return nil, nil
+	}
+
+	kh, err := pins.Load(i.opts.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	return kh.Verifier(i.logger, i.opts.Exporter, i.opts.PinMode), nil
+}
+
 // Run the importer
 func (i *Importer) Run() error {
-	i.logger.Info("connecting to exporter", zap.String("address", exporterAddr))
+	i.logger.Info("connecting to exporter", zap.String("address", i.opts.Exporter))
+
+	serverName := i.opts.ServerName
+	if serverName == "" {
+		host, _, err := net.SplitHostPort(i.opts.Exporter)
+		if err != nil {
+			return err
+		}
+
+		serverName = host
+	}
+
+	verify, err := i.pinVerifier()
+	if err != nil {
+		return err
+	}
+
+	tlsConfig, err := certs.ClientConfig(i.opts.TLSCert, i.opts.TLSKey, i.opts.TLSCA, serverName, verify)
+	if err != nil {
+		return err
+	}
 
 	sigC := make(chan os.Signal, 1)
-	ctx, cancel := context.WithCancel(context.Background())
+	ctx, cancel := context.WithCancelCause(context.Background())
 
-	conn, err := quic.DialAddr(ctx, exporterAddr, i.generateTLSConfig(), nil)
+	c, err := client.Dial(ctx, i.opts.Exporter, client.Options{
+		TLS: tlsConfig,
+		Logger: i.logger,
+	})
 	if err != nil {
+		cancel(nil)
 		return err
 	}
-	i.conn = conn
-	defer conn.CloseWithError(0, "Goodbye")
+	i.client = c
+	defer c.Close()
 
-	// TODO(tobias.urdin): Validate that we trust the exporters certificate fingerprint
+	// Images is imported as soon as the exporter sends an event
+	go i.watch(ctx)
 
-	// Start the import loop that we run on an interval
+	// Start the import loop that we run on an interval, the interval is
+	// longer while events is received since the run only has to catch
+	// what was missed
 	go func(ctx context.Context) {
 		i.logger.Info("starting import loop")
 
 		for {
-			if err := i.run(ctx); err != nil {
+			if err := i.run(ctx); err != nil && ctx.Err() == nil {
 				i.logger.Error("import run failed", zap.String("error", err.Error()))
 			}
 
-			i.logger.Info("next run in 10 seconds")
-			time.Sleep(10 * time.Second)
-		}
+			interval := i.opts.Interval
+			if i.subscribed.Load() {
+				interval = i.opts.ReconcileInterval
+			}
 
-		i.logger.Info("stopping import loop")
+			i.logger.Info("waiting for next run", zap.Duration("interval", interval))
+
+			select {
+			case <-ctx.Done():
+				i.logger.Info("stopping import loop")
+				return
+			case <-time.After(interval):
+			case <-i.reconcile:
+			}
+		}
 	}(ctx)
 
 	signal.Notify(sigC, syscall.SIGTERM, syscall.SIGINT)
 	<-sigC
 	i.logger.Info("signal captured, exiting...")
 
-	cancel()
+	cancel(errors.New("importer is stopping"))
+	i.waitImports(shutdownTimeout)
 
 	return nil
 }
+
+// Wait for the running imports to stop, their exports is cancelled on the
+// exporter before the connection is closed
+func (i *Importer) waitImports(timeout time.Duration) {
+	if running := i.inflight.wait(timeout); running > 0 {
+		i.logger.Warn("imports did not stop in time", zap.Int("running", running))
+	}
+}
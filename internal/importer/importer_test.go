@@ -0,0 +1,57 @@
+package importer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tobias-urdin/snapback/client"
+)
+
+func TestInflight(t *testing.T) {
+	f := newInflight()
+	spec := client.ImageSpec{Pool: "pool", Image: "image"}
+
+	if started, _ := f.start(spec); !started {
+		t.Fatalf("first import was not started")
+	}
+
+	started, img := f.start(spec)
+	if started {
+		t.Fatalf("second import was started while the first is running")
+	}
+
+	if !f.done(spec, errors.New("superseded")) {
+		t.Fatalf("image is not imported again after a second start")
+	}
+
+	select {
+	case <-img.done:
+		t.Fatalf("done is closed before the image is imported again")
+	default:
+	}
+
+	if running := f.wait(10 * time.Millisecond); running != 1 {
+		t.Fatalf("got %d running imports, expected 1", running)
+	}
+
+	failed := errors.New("failed")
+	if f.done(spec, failed) {
+		t.Fatalf("image is imported a third time")
+	}
+
+	select {
+	case <-img.done:
+	default:
+		t.Fatalf("done is not closed once the image is imported")
+	}
+
+	// The waiter gets the result of the last import
+	if img.err != failed {
+		t.Fatalf("got %v, expected the error of the last import", img.err)
+	}
+
+	if running := f.wait(time.Second); running != 0 {
+		t.Fatalf("got %d running imports, expected none", running)
+	}
+}
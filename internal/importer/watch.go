@@ -0,0 +1,124 @@
+package importer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/tobias-urdin/snapback/client"
+
+	"go.uber.org/zap"
+)
+
+// The time to wait before subscribing again when a subscription ended
+const resubscribeDelay = 10 * time.Second
+
+// Ask the import loop to do a full run now
+func (i *Importer) requestReconcile() {
+	select {
+	case i.reconcile <- struct{}{}:
+	default:
+	}
+}
+
+// Subscribe to events from the exporter and import an image when a
+// snapshot is created on it, the subscription is renewed when it ends.
+// Returns when the context is cancelled or if the exporter cannot send
+// events, the import loop then polls the exporter instead.
+func (i *Importer) watch(ctx context.Context) {
+	first := true
+
+	for {
+		err := i.subscribe(ctx, first)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if errors.Is(err, client.ErrNotSupported) {
+			i.logger.Info("exporter cannot send events, polling it instead", zap.Duration("interval", i.opts.Interval))
+			return
+		}
+
+		i.logger.Warn("subscription ended, subscribing again", zap.Duration("delay", resubscribeDelay), zap.Error(err))
+		first = false
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// Subscribe to events for the pools and namespaces that is imported and
+// handle them until the subscription ends
+//
+// NOTE: Namespaces that is created after the subscription
+// started is only imported by the full runs until the next subscription.
+func (i *Importer) subscribe(ctx context.Context, first bool) error {
+	targets, err := i.targets(ctx)
+	if err != nil {
+		return err
+	}
+
+	if len(targets) == 0 {
+		return errors.New("no pools to subscribe to")
+	}
+
+	subs := make([]client.SubscribeTarget, 0, len(targets))
+	for _, t := range targets {
+		subs = append(subs, client.SubscribeTarget{
+			Pool: t.pool,
+			Namespace: t.namespace,
+		})
+	}
+
+	sub, err := i.client.Subscribe(ctx, subs)
+	if err != nil {
+		return err
+	}
+	defer sub.Close()
+
+	i.logger.Info("subscribed to events", zap.Int("namespaces", len(targets)),
+		zap.Duration("interval", sub.Interval()))
+
+	i.subscribed.Store(true)
+
+	// Events can have been missed while there was no subscription, the
+	// first subscription is started together with the first run
+	if !first {
+		i.requestReconcile()
+	}
+
+	for event := range sub.Events() {
+		i.handleEvent(ctx, event)
+	}
+
+	// Poll the exporter until there is a subscription again
+	i.subscribed.Store(false)
+	i.requestReconcile()
+
+	return sub.Err()
+}
+
+// Handle an event from the exporter
+func (i *Importer) handleEvent(ctx context.Context, event client.Event) {
+	logger := i.logger.With(zap.String("pool", event.Image.Pool), zap.String("namespace", event.Image.Namespace))
+
+	// NOTE: Snapshots and images that is removed on the
+	// exporter is kept on the destination, it is a backup after all.
+	switch event.Kind {
+	case client.EventSnapshotCreated:
+		logger.Info("snapshot created on exporter", zap.String("image", event.Image.Image),
+			zap.String("snapshot", event.Snapshot))
+
+		i.goImport(ctx, logger, event.Image)
+	case client.EventSnapshotRemoved:
+		logger.Info("snapshot removed on exporter, it is kept on the destination", zap.String("image", event.Image.Image),
+			zap.String("snapshot", event.Snapshot))
+	case client.EventImageRemoved:
+		logger.Info("image removed on exporter, it is kept on the destination", zap.String("image", event.Image.Image))
+	default:
+		logger.Warn("unknown event from exporter", zap.Stringer("kind", event.Kind), zap.String("image", event.Image.Image))
+	}
+}
@@ -0,0 +1,173 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+// The codec a chunk payload is compressed with
+type Codec uint8
+
+const (
+	// The payload is not compressed
+	CodecNone Codec = 0
+
+	// The payload is compressed with zstd
+	CodecZstd Codec = 1
+
+	// The payload is compressed with an lz4 block
+	CodecLZ4 Codec = 2
+)
+
+// The codecs that can be used to compress chunks
+var Codecs = []Codec{CodecZstd, CodecLZ4}
+
+// Returned when a payload is compressed with a codec we do not know
+var ErrUnknownCodec = errors.New("unknown codec")
+
+// Returns the name of the codec
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecZstd:
+		return "zstd"
+	case CodecLZ4:
+		return "lz4"
+	}
+
+	return fmt.Sprintf("unknown(%d)", uint8(c))
+}
+
+// Returns the codec with the name
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none":
+		return CodecNone, nil
+	case "zstd":
+		return CodecZstd, nil
+	case "lz4":
+		return CodecLZ4, nil
+	}
+
+	return CodecNone, fmt.Errorf("%w %q", ErrUnknownCodec, name)
+}
+
+// NOTE: The zstd encoder and decoder is safe to use from
+// multiple goroutines with EncodeAll and DecodeAll so they are shared.
+var (
+	zstdOnce sync.Once
+	zstdEncoder *zstd.Encoder
+	zstdDecoder *zstd.Decoder
+	zstdErr error
+)
+
+// Returns the shared zstd encoder and decoder
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault))
+		if zstdErr != nil {
+			return
+		}
+
+		zstdDecoder, zstdErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0),
+			zstd.WithDecoderMaxMemory(MaxFrameSize))
+	})
+
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// Returns the size of the buffer that is needed to compress n bytes
+func CompressBound(n int) int {
+	return lz4.CompressBlockBound(n)
+}
+
+// Compress the payload with the codec into dst, it is only allocated if it
+// is smaller than CompressBound of the payload. Returns nil if the payload
+// does not get smaller, it should then be sent as it is.
+func Compress(codec Codec, dst []byte, p []byte) ([]byte, error) {
+	if codec == CodecNone {
+		return nil, nil
+	}
+
+	if cap(dst) < CompressBound(len(p)) {
+		dst = make([]byte, 0, CompressBound(len(p)))
+	}
+
+	switch codec {
+	case CodecZstd:
+		enc, _, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+
+		res := enc.EncodeAll(p, dst[:0])
+		if len(res) >= len(p) {
+			return nil, nil
+		}
+
+		return res, nil
+	case CodecLZ4:
+		res := dst[:cap(dst)]
+
+		// NOTE: A zero length means that the payload
+		// could not be compressed.
+		n, err := lz4.CompressBlock(p, res, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if n == 0 || n >= len(p) {
+			return nil, nil
+		}
+
+		return res[:n], nil
+	}
+
+	return nil, fmt.Errorf("%w %s", ErrUnknownCodec, codec)
+}
+
+// Decompress the payload with the codec, size is the size of the payload
+// before it was compressed
+func Decompress(codec Codec, p []byte, size uint64) ([]byte, error) {
+	if size > MaxFrameSize {
+		return nil, fmt.Errorf("decompressed size %d exceeds maximum of %d", size, MaxFrameSize)
+	}
+
+	var res []byte
+
+	switch codec {
+	case CodecNone:
+		return p, nil
+	case CodecZstd:
+		_, dec, err := zstdCodec()
+		if err != nil {
+			return nil, err
+		}
+
+		if res, err = dec.DecodeAll(p, make([]byte, 0, size)); err != nil {
+			return nil, fmt.Errorf("zstd: %w", err)
+		}
+	case CodecLZ4:
+		res = make([]byte, size)
+
+		n, err := lz4.UncompressBlock(p, res)
+		if err != nil {
+			return nil, fmt.Errorf("lz4: %w", err)
+		}
+
+		res = res[:n]
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnknownCodec, codec)
+	}
+
+	if uint64(len(res)) != size {
+		return nil, fmt.Errorf("decompressed size is %d, expected %d", len(res), size)
+	}
+
+	return res, nil
+}
@@ -0,0 +1,76 @@
+package message
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+func TestCompressRoundTrip(t *testing.T) {
+	payload := bytes.Repeat([]byte("snapback chunk payload\n"), 4096)
+
+	for _, codec := range []Codec{CodecZstd, CodecLZ4} {
+		t.Run(codec.String(), func(t *testing.T) {
+			compressed, err := Compress(codec, nil, payload)
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+
+			if compressed == nil || len(compressed) >= len(payload) {
+				t.Fatalf("payload did not get smaller")
+			}
+
+			got, err := Decompress(codec, compressed, uint64(len(payload)))
+			if err != nil {
+				t.Fatalf("decompress: %v", err)
+			}
+
+			if !bytes.Equal(got, payload) {
+				t.Fatalf("decompressed payload is not equal to the payload")
+			}
+
+			// A wrong size is rejected whether it is too small or too large
+			for _, size := range []uint64{uint64(len(payload)) - 1, uint64(len(payload)) + 1} {
+				if _, err := Decompress(codec, compressed, size); err == nil {
+					t.Fatalf("decompress with size %d did not fail", size)
+				}
+			}
+
+			if _, err := Decompress(codec, compressed, MaxFrameSize+1); err == nil {
+				t.Fatalf("decompress with a size above MaxFrameSize did not fail")
+			}
+		})
+	}
+}
+
+func TestCompressIncompressible(t *testing.T) {
+	payload := make([]byte, 64*1024)
+	if _, err := rand.Read(payload); err != nil {
+		t.Fatalf("read random: %v", err)
+	}
+
+	// A payload that does not get smaller is sent with CodecNone
+	for _, codec := range []Codec{CodecNone, CodecZstd, CodecLZ4} {
+		compressed, err := Compress(codec, make([]byte, 0, CompressBound(len(payload))), payload)
+		if err != nil {
+			t.Fatalf("compress with %s: %v", codec, err)
+		}
+
+		if compressed != nil {
+			t.Fatalf("got %d bytes compressed with %s, expected nil", len(compressed), codec)
+		}
+	}
+}
+
+func TestCompressUnknownCodec(t *testing.T) {
+	codec := Codec(42)
+
+	if _, err := Compress(codec, nil, []byte("payload")); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("got %v compressing, expected ErrUnknownCodec", err)
+	}
+
+	if _, err := Decompress(codec, []byte("payload"), 7); !errors.Is(err, ErrUnknownCodec) {
+		t.Fatalf("got %v decompressing, expected ErrUnknownCodec", err)
+	}
+}
@@ -1,15 +1,19 @@
 package message
 
 import (
+	"context"
+
 	"go.uber.org/zap"
 	"github.com/quic-go/quic-go"
 )
 
 // Message context
 type Context struct {
+	ctx context.Context
 	logger *zap.Logger
 	message *Message
 	stream quic.Stream
+	session *Session
 }
 
 // Returns logger
@@ -17,6 +21,13 @@ func (c *Context) Logger() *zap.Logger {
 	return c.logger
 }
 
+// Returns the context of the request, it is cancelled when the peer
+// cancels the request or the stream, when the write side of the stream is
+// closed or the peer stops reading it
+func (c *Context) Context() context.Context {
+	return c.ctx
+}
+
 // Returns message
 func (c *Context) Message() *Message {
 	return c.message
@@ -27,7 +38,17 @@ func (c *Context) Stream() quic.Stream {
 	return c.stream
 }
 
-// Send a message
+// Returns the negotiated session
+func (c *Context) Session() *Session {
+	return c.session
+}
+
+// Returns the ID of the request that is handled
+func (c *Context) RequestID() uint64 {
+	return c.message.Header.RequestID
+}
+
+// Send a message as a reply to the request that is handled
 func (c *Context) Send(m MessageInterface) error {
-	return Send(c.stream, m)
+	return SendRequest(c.stream, c.message.Header.RequestID, m)
 }
@@ -0,0 +1,352 @@
+package message
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+// Returned when the dispatcher has been closed
+var ErrDispatcherClosed = errors.New("dispatcher closed")
+
+// The time to wait for the peer to confirm that an export was cancelled
+const cancelTimeout = 5 * time.Second
+
+// A request that is waiting for its responses
+type pendingCall struct {
+	// Messages for the request
+	messages chan *Message
+
+	// Closed when the caller no longer wants any messages
+	done chan struct{}
+}
+
+// Dispatcher is used by the client to send requests on a stream and match
+// the incoming messages to the requests by their request ID. This allows
+// multiple requests to be outstanding on the same stream.
+type Dispatcher struct {
+	// Logger
+	logger *zap.Logger
+
+	// The stream
+	stream quic.Stream
+
+	// The session negotiated on the stream
+	session *Session
+
+	// Serializes writes to the stream
+	writeMu sync.Mutex
+
+	// Protects the fields below
+	mu sync.Mutex
+
+	// The request ID of the last request
+	lastID uint64
+
+	// The requests waiting for responses
+	pending map[uint64]*pendingCall
+
+	// The error that stopped the read loop
+	err error
+
+	// Closed when the read loop stops
+	closed chan struct{}
+}
+
+// Returns a new Dispatcher and starts reading messages from the stream,
+// the handshake must already have been done on the stream.
+func NewDispatcher(logger *zap.Logger, stream quic.Stream, session *Session) *Dispatcher {
+	d := &Dispatcher{
+		logger: logger,
+		stream: stream,
+		session: session,
+		pending: make(map[uint64]*pendingCall),
+		closed: make(chan struct{}),
+	}
+
+	go d.readLoop()
+
+	return d
+}
+
+// Returns the negotiated session
+func (d *Dispatcher) Session() *Session {
+	return d.session
+}
+
+// Read messages from the stream and hand them to the pending requests
+func (d *Dispatcher) readLoop() {
+	var err error
+
+	for {
+		var msg Message
+		if err = readMessage(d.stream, &msg); err != nil {
+			break
+		}
+
+		d.mu.Lock()
+		call, ok := d.pending[msg.Header.RequestID]
+		d.mu.Unlock()
+
+		if !ok {
+			// NOTE: Since messages are framed an unexpected
+			// message does not desync the stream so we report and skip it.
+			if msg.Header.RequestID == 0 || msg.Header.RequestID > d.currentID() {
+				d.logger.Warn("unexpected message", zap.Any("type", msg.Header.Type), zap.Uint64("request_id", msg.Header.RequestID))
+			} else {
+				d.logger.Warn("late message for finished request", zap.Any("type", msg.Header.Type), zap.Uint64("request_id", msg.Header.RequestID))
+			}
+
+			continue
+		}
+
+		select {
+		case call.messages <- &msg:
+		case <-call.done:
+			d.logger.Warn("late message for finished request", zap.Any("type", msg.Header.Type), zap.Uint64("request_id", msg.Header.RequestID))
+		}
+	}
+
+	if err == io.EOF {
+		err = ErrDispatcherClosed
+	}
+
+	d.mu.Lock()
+	d.err = err
+	d.mu.Unlock()
+
+	close(d.closed)
+}
+
+// Returns the last request ID that was used
+func (d *Dispatcher) currentID() uint64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.lastID
+}
+
+// Register a new request and send it
+func (d *Dispatcher) start(req MessageInterface) (uint64, *pendingCall, error) {
+	call := &pendingCall{
+		messages: make(chan *Message, 16),
+		done: make(chan struct{}),
+	}
+
+	d.mu.Lock()
+	d.lastID++
+	id := d.lastID
+	d.pending[id] = call
+	d.mu.Unlock()
+
+	d.writeMu.Lock()
+	err := SendRequest(d.stream, id, req)
+	d.writeMu.Unlock()
+
+	if err != nil {
+		d.finish(id, call)
+		return 0, nil, err
+	}
+
+	return id, call, nil
+}
+
+// Unregister a request, messages that arrive after this are late
+func (d *Dispatcher) finish(id uint64, call *pendingCall) {
+	d.mu.Lock()
+	delete(d.pending, id)
+	d.mu.Unlock()
+
+	close(call.done)
+}
+
+// Wait for the next message for a request
+func (d *Dispatcher) next(ctx context.Context, call *pendingCall) (*Message, error) {
+	select {
+	case msg := <-call.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-d.closed:
+		// Deliver messages that was received before the read loop stopped
+		select {
+		case msg := <-call.messages:
+			return msg, nil
+		default:
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+
+		return nil, d.err
+	}
+}
+
+// Send a request and wait for the response of the expected type, an error
+// message from the peer is returned as an *Error.
+func (d *Dispatcher) Call(ctx context.Context, req MessageInterface, expected MessageType) (*Message, error) {
+	id, call, err := d.start(req)
+	if err != nil {
+		return nil, err
+	}
+	defer d.finish(id, call)
+
+	msg, err := d.next(ctx, call)
+	if err != nil {
+		return nil, err
+	}
+
+	if msg.Header.Type == ErrorType {
+		return nil, msg.AsError()
+	}
+
+	if msg.Header.Type != expected {
+		return nil, NewError(ErrorCodeProtocolViolation, "expected message type %d for request %d, got type %d", expected, id, msg.Header.Type)
+	}
+
+	return msg, nil
+}
+
+// Send a request that is answered with a stream of chunks and a final
+// response, cb is called for each chunk and the response is returned.
+func (d *Dispatcher) CallChunks(ctx context.Context, req MessageInterface, cb func(*Message) error) (*Message, error) {
+	id, call, err := d.start(req)
+	if err != nil {
+		return nil, err
+	}
+	defer d.finish(id, call)
+
+	for {
+		msg, err := d.next(ctx, call)
+		if err != nil {
+			if ctx.Err() != nil {
+				d.cancelExport(id, call, context.Cause(ctx))
+			}
+
+			return nil, err
+		}
+
+		switch msg.Header.Type {
+		case ExportChunkType:
+			if err := cb(msg); err != nil {
+				return nil, err
+			}
+		case ExportResponseType:
+			return msg, nil
+		case ErrorType:
+			return nil, msg.AsError()
+		default:
+			return nil, NewError(ErrorCodeProtocolViolation, "chunk stream for request %d did not end with a response, type: %d", id, msg.Header.Type)
+		}
+	}
+}
+
+// Tell the peer to stop the export with the request ID and wait for it to
+// confirm, the chunks that is still on the way is discarded
+func (d *Dispatcher) cancelExport(id uint64, call *pendingCall, cause error) {
+	logger := d.logger.With(zap.Uint64("request_id", id))
+
+	if !d.session.Supports(CancelExportType) {
+		logger.Debug("peer cannot cancel exports, the stream is closed instead")
+		return
+	}
+
+	d.writeMu.Lock()
+	err := SendRequest(d.stream, id, &CancelExportV1{
+		Reason: cause.Error(),
+	})
+	d.writeMu.Unlock()
+
+	if err != nil {
+		logger.Warn("failed to cancel export", zap.Error(err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cancelTimeout)
+	defer cancel()
+
+	for {
+		msg, err := d.next(ctx, call)
+		if err != nil {
+			logger.Warn("export cancel was not confirmed", zap.Error(err))
+			return
+		}
+
+		switch msg.Header.Type {
+		case ExportResponseType:
+			logger.Debug("export finished before it was cancelled")
+			return
+		case ErrorType:
+			logger.Debug("export cancelled", zap.Error(msg.AsError()))
+			return
+		}
+	}
+}
+
+// Send a request that is answered with a response of the expected type
+// followed by events, cb is called with the response and then with each
+// event until cb fails, the context is cancelled or the stream ends.
+func (d *Dispatcher) CallEvents(ctx context.Context, req MessageInterface, expected MessageType, cb func(*Message) error) error {
+	id, call, err := d.start(req)
+	if err != nil {
+		return err
+	}
+	defer d.finish(id, call)
+
+	msg, err := d.next(ctx, call)
+	if err != nil {
+		return err
+	}
+
+	if msg.Header.Type == ErrorType {
+		return msg.AsError()
+	}
+
+	if msg.Header.Type != expected {
+		return NewError(ErrorCodeProtocolViolation, "expected message type %d for request %d, got type %d", expected, id, msg.Header.Type)
+	}
+
+	if err := cb(msg); err != nil {
+		return err
+	}
+
+	for {
+		msg, err := d.next(ctx, call)
+		if err != nil {
+			return err
+		}
+
+		switch msg.Header.Type {
+		case EventType:
+			if err := cb(msg); err != nil {
+				return err
+			}
+		case ErrorType:
+			return msg.AsError()
+		default:
+			return NewError(ErrorCodeProtocolViolation, "event stream for request %d got type %d", id, msg.Header.Type)
+		}
+	}
+}
+
+// Close the stream and wait for the read loop to stop
+func (d *Dispatcher) Close() error {
+	err := d.stream.Close()
+
+	// NOTE: Close only closes the write direction, stop
+	// reading as well so the read loop does not wait for the peer.
+	d.stream.CancelRead(0)
+	<-d.closed
+
+	if err != nil {
+		return fmt.Errorf("close stream: %w", err)
+	}
+
+	return nil
+}
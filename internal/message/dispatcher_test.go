@@ -0,0 +1,45 @@
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+)
+
+func TestDispatcherCloseError(t *testing.T) {
+	mh := NewHandler(zap.NewNop())
+	stop := make(chan struct{})
+
+	// The peer neither sends nor closes anything until the test is done
+	stream := newTestStream(t, func(stream quic.Stream) error {
+		if _, err := mh.Accept(stream, testCapabilities); err != nil {
+			return err
+		}
+
+		<-stop
+		return nil
+	})
+	t.Cleanup(func() { close(stop) })
+
+	session, err := mh.Hello(stream, testCapabilities)
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+
+	d := NewDispatcher(zap.NewNop(), stream, session)
+
+	// Close fails on a stream that is reset, the read loop must still stop
+	stream.CancelWrite(0)
+
+	if err := d.Close(); err == nil {
+		t.Fatal("expected close to fail on a reset stream")
+	}
+
+	select {
+	case <-d.closed:
+	case <-time.After(time.Second):
+		t.Fatal("the read loop did not stop")
+	}
+}
@@ -0,0 +1,215 @@
+package message
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/quic-go/quic-go"
+)
+
+// The error code sent in error messages
+type ErrorCode int
+
+const (
+	// The error is not known
+	ErrorCodeUnknown ErrorCode = 0
+
+	// The requested pool, image or snapshot was not found
+	ErrorCodeNotFound ErrorCode = 1
+
+	// The peer is not allowed to perform the request
+	ErrorCodePermissionDenied ErrorCode = 2
+
+	// The storage backend failed to perform the request
+	ErrorCodeBackendFailure ErrorCode = 3
+
+	// The peer sent something that violates the protocol
+	ErrorCodeProtocolViolation ErrorCode = 4
+
+	// The peer is too busy to handle the request right now
+	ErrorCodeBusy ErrorCode = 5
+
+	// The from snapshot of an incremental export does not exist or
+	// is not older than the snapshot that is exported
+	ErrorCodeInvalidFromSnapshot ErrorCode = 6
+
+	// The resume token of an export does not match the export or the
+	// snapshots has changed since the token was issued
+	ErrorCodeInvalidResumeToken ErrorCode = 7
+
+	// The request was cancelled by the peer
+	ErrorCodeCancelled ErrorCode = 8
+)
+
+// The error code a stream is reset with when the request on it is
+// cancelled and the stream cannot be used for anything else
+const StreamErrorCancelled quic.StreamErrorCode = 1
+
+// Returns the name of the error code
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeNotFound:
+		return "not found"
+	case ErrorCodePermissionDenied:
+		return "permission denied"
+	case ErrorCodeBackendFailure:
+		return "backend failure"
+	case ErrorCodeProtocolViolation:
+		return "protocol violation"
+	case ErrorCodeBusy:
+		return "busy"
+	case ErrorCodeInvalidFromSnapshot:
+		return "invalid from snapshot"
+	case ErrorCodeInvalidResumeToken:
+		return "invalid resume token"
+	case ErrorCodeCancelled:
+		return "cancelled"
+	}
+
+	return fmt.Sprintf("unknown error %d", int(c))
+}
+
+// Returns true if a request that failed with the code can be retried
+func (c ErrorCode) Retryable() bool {
+	return c == ErrorCodeBackendFailure || c == ErrorCodeBusy
+}
+
+// Error is the Go error for an error that is sent to or received from a peer
+type Error struct {
+	// The error code
+	Code ErrorCode
+
+	// The human-readable error message
+	Message string
+
+	// If the request can be retried
+	Retryable bool
+
+	// The ID of the request that failed
+	RequestID uint64
+}
+
+// Returns the error string
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return e.Code.String()
+	}
+
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// Errors are matched on their code so errors.Is can be used
+// with the sentinel errors below.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+
+	return t.Code == e.Code
+}
+
+var (
+	// Matches errors with ErrorCodeNotFound
+	ErrNotFound = &Error{Code: ErrorCodeNotFound}
+
+	// Matches errors with ErrorCodePermissionDenied
+	ErrPermissionDenied = &Error{Code: ErrorCodePermissionDenied}
+
+	// Matches errors with ErrorCodeBackendFailure
+	ErrBackendFailure = &Error{Code: ErrorCodeBackendFailure}
+
+	// Matches errors with ErrorCodeProtocolViolation
+	ErrProtocolViolation = &Error{Code: ErrorCodeProtocolViolation}
+
+	// Matches errors with ErrorCodeBusy
+	ErrBusy = &Error{Code: ErrorCodeBusy}
+
+	// Matches errors with ErrorCodeInvalidFromSnapshot
+	ErrInvalidFromSnapshot = &Error{Code: ErrorCodeInvalidFromSnapshot}
+
+	// Matches errors with ErrorCodeInvalidResumeToken
+	ErrInvalidResumeToken = &Error{Code: ErrorCodeInvalidResumeToken}
+
+	// Matches errors with ErrorCodeCancelled
+	ErrCancelled = &Error{Code: ErrorCodeCancelled}
+)
+
+// Returns a new error with the code and a formatted message
+func NewError(code ErrorCode, format string, args ...interface{}) *Error {
+	return &Error{
+		Code: code,
+		Message: fmt.Sprintf(format, args...),
+		Retryable: code.Retryable(),
+	}
+}
+
+// Returns err as an *Error, errors that does not wrap an *Error
+// is reported as a backend failure.
+func AsError(err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+
+	return NewError(ErrorCodeBackendFailure, "%s", err.Error())
+}
+
+// Returns the error message that is sent to the peer for err using
+// the highest error message version negotiated in the session.
+func newErrorMessage(session *Session, err *Error) MessageInterface {
+	if session != nil && session.Version(ErrorType) >= 2 {
+		return &ErrorMessageV2{
+			Code: err.Code,
+			Message: err.Message,
+			Retryable: err.Retryable,
+			RequestID: err.RequestID,
+		}
+	}
+
+	return &ErrorMessage{
+		ErrorCode: int(err.Code),
+	}
+}
+
+// Returns the error in an error message
+func (m *Message) AsError() error {
+	if m.Header.Type != ErrorType {
+		return fmt.Errorf("message type %d is not an error", m.Header.Type)
+	}
+
+	switch m.Header.Version {
+	case 1:
+		var msg ErrorMessage
+		if err := m.Unmarshal(&msg); err != nil {
+			return err
+		}
+
+		code := ErrorCode(msg.ErrorCode)
+
+		return &Error{
+			Code: code,
+			Retryable: code.Retryable(),
+			RequestID: m.Header.RequestID,
+		}
+	case 2:
+		var msg ErrorMessageV2
+		if err := m.Unmarshal(&msg); err != nil {
+			return err
+		}
+
+		requestID := msg.RequestID
+		if requestID == 0 {
+			requestID = m.Header.RequestID
+		}
+
+		return &Error{
+			Code: msg.Code,
+			Message: msg.Message,
+			Retryable: msg.Retryable,
+			RequestID: requestID,
+		}
+	}
+
+	return fmt.Errorf("unsupported error message version %d", m.Header.Version)
+}
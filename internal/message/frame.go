@@ -0,0 +1,107 @@
+package message
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	// The version of the frame header
+	FrameVersion = 1
+
+	// The size of the frame header, one byte for the version and
+	// four bytes for the big-endian length of the payload
+	FrameHeaderSize = 5
+
+	// The maximum size of a frame payload
+	MaxFrameSize = 16 * 1024 * 1024
+)
+
+var (
+	// Returned when a frame payload exceeds MaxFrameSize
+	ErrFrameTooLarge = errors.New("frame too large")
+
+	// Returned when a frame has an unknown header version
+	ErrFrameVersion = errors.New("unsupported frame version")
+
+	// Returned when a frame has a zero length payload
+	ErrFrameEmpty = errors.New("empty frame")
+)
+
+// Write a frame containing payload to w
+func writeFrame(w io.Writer, payload []byte) error {
+	// NOTE: Header and payload is written in a single
+	// call so a frame is never interleaved with another writer.
+	buf := make([]byte, FrameHeaderSize+len(payload))
+	copy(buf[FrameHeaderSize:], payload)
+
+	if err := putFrameHeader(buf); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(buf); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Fill in the header of a frame for the payload that follows it, the
+// frame must start with FrameHeaderSize bytes that is reserved for it
+func putFrameHeader(frame []byte) error {
+	length := len(frame) - FrameHeaderSize
+
+	if length == 0 {
+		return ErrFrameEmpty
+	}
+
+	if length > MaxFrameSize {
+		return fmt.Errorf("%w: %d bytes exceeds maximum of %d", ErrFrameTooLarge, length, MaxFrameSize)
+	}
+
+	frame[0] = FrameVersion
+	binary.BigEndian.PutUint32(frame[1:FrameHeaderSize], uint32(length))
+
+	return nil
+}
+
+// Read a frame from r and return the payload
+func readFrame(r io.Reader) ([]byte, error) {
+	var header [FrameHeaderSize]byte
+
+	// A clean EOF before any header byte is the end of the stream,
+	// anything else that ends early is a truncated frame.
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated frame header: %w", err)
+		}
+
+		return nil, err
+	}
+
+	if header[0] != FrameVersion {
+		return nil, fmt.Errorf("%w: %d", ErrFrameVersion, header[0])
+	}
+
+	length := binary.BigEndian.Uint32(header[1:])
+	if length == 0 {
+		return nil, ErrFrameEmpty
+	}
+
+	if length > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes exceeds maximum of %d", ErrFrameTooLarge, length, MaxFrameSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, fmt.Errorf("truncated frame, expected %d bytes: %w", length, io.ErrUnexpectedEOF)
+		}
+
+		return nil, err
+	}
+
+	return payload, nil
+}
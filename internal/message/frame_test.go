@@ -0,0 +1,93 @@
+package message
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	payloads := [][]byte{
+		[]byte("a"),
+		[]byte("line one\nline two\n"),
+		[]byte{'\n', 0, '\n', 0xff, '\n'},
+	}
+
+	var buf bytes.Buffer
+	for _, p := range payloads {
+		if err := writeFrame(&buf, p); err != nil {
+			t.Fatalf("writeFrame: %v", err)
+		}
+	}
+
+	for _, want := range payloads {
+		got, err := readFrame(&buf)
+		if err != nil {
+			t.Fatalf("readFrame: %v", err)
+		}
+
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got payload %q, expected %q", got, want)
+		}
+	}
+
+	if _, err := readFrame(&buf); err != io.EOF {
+		t.Fatalf("got %v at end of stream, expected io.EOF", err)
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	if err := writeFrame(&buf, []byte("payload\n")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+
+	frame := buf.Bytes()
+
+	tests := map[string][]byte{
+		"short header": frame[:FrameHeaderSize-2],
+		"header only": frame[:FrameHeaderSize],
+		"short payload": frame[:len(frame)-1],
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := readFrame(bytes.NewReader(data))
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("got %v, expected io.ErrUnexpectedEOF", err)
+			}
+		})
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	var header [FrameHeaderSize]byte
+	header[0] = FrameVersion
+	binary.BigEndian.PutUint32(header[1:], MaxFrameSize+1)
+
+	if _, err := readFrame(bytes.NewReader(header[:])); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v reading frame, expected ErrFrameTooLarge", err)
+	}
+
+	if err := writeFrame(io.Discard, make([]byte, MaxFrameSize+1)); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("got %v writing frame, expected ErrFrameTooLarge", err)
+	}
+}
+
+func TestFrameInvalid(t *testing.T) {
+	if err := writeFrame(io.Discard, nil); !errors.Is(err, ErrFrameEmpty) {
+		t.Fatalf("got %v writing empty frame, expected ErrFrameEmpty", err)
+	}
+
+	header := []byte{FrameVersion, 0, 0, 0, 0}
+	if _, err := readFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameEmpty) {
+		t.Fatalf("got %v reading empty frame, expected ErrFrameEmpty", err)
+	}
+
+	header = []byte{FrameVersion + 1, 0, 0, 0, 1, 0}
+	if _, err := readFrame(bytes.NewReader(header)); !errors.Is(err, ErrFrameVersion) {
+		t.Fatalf("got %v reading frame, expected ErrFrameVersion", err)
+	}
+}
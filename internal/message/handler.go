@@ -2,9 +2,10 @@ package message
 
 import (
 	"bufio"
+	"context"
 	"errors"
-	"fmt"
 	"io"
+	"sync"
 
 	"go.uber.org/zap"
 	"github.com/quic-go/quic-go"
@@ -60,90 +61,301 @@ func (mh *MessageHandler) getHandler(msg *Message) MessageHandlerFunc {
 }
 
 // Read the stream and return the message
-func (mh *MessageHandler) read(r *bufio.Reader, msg *Message) error {
-	// Read until newline which is what we use in our protocol
-	// to tell the end of the data for this message
-	buf, _, err := r.ReadLine()
-	if err != nil {
-		return err
-	}
+func (mh *MessageHandler) read(r io.Reader, msg *Message) error {
+	return readMessage(r, msg)
+}
+
+// Read the stream and return the message
+func (mh *MessageHandler) Read(stream quic.Stream, msg *Message) error {
+	return mh.read(stream, msg)
+}
 
-	// Unmarshal the raw message into a Message
-	if err := unmarshal(buf, msg); err != nil {
+// Read a response of the expected type from the stream, an error message
+// from the peer is returned as an *Error.
+func (mh *MessageHandler) ReadResponse(stream quic.Stream, msg *Message, expected MessageType) error {
+	if err := mh.read(stream, msg); err != nil {
 		return err
 	}
 
-	return nil
-}
+	if msg.Header.Type == ErrorType {
+		return msg.AsError()
+	}
 
-// Read the stream and return the message
-func (mh *MessageHandler) Read(stream quic.Stream, msg *Message) error {
-	r := bufio.NewReader(stream)
+	if msg.Header.Type != expected {
+		return NewError(ErrorCodeProtocolViolation, "expected message type %d, got type %d", expected, msg.Header.Type)
+	}
 
-	return mh.read(r, msg)
+	return nil
 }
 
 // Read chunks from the stream
 func (mh *MessageHandler) ReadChunks(stream quic.Stream, cb func(*Message) error) (*Message, error) {
-	r := bufio.NewReader(stream)
-
 	for {
 		var msg Message
-		if err := mh.read(r, &msg); err != nil {
+		if err := mh.read(stream, &msg); err != nil {
 			return nil, err
 		}
 
-		if msg.Header.Type != ExportChunkType {
-			if msg.Header.Type != ExportResponseType {
-				return nil, fmt.Errorf("chunk stream did not end with a response, type: %d", msg.Header.Type)
+		switch msg.Header.Type {
+		case ExportChunkType:
+			if err := cb(&msg); err != nil {
+				return nil, err
 			}
-
+		case ExportResponseType:
 			return &msg, nil
+		case ErrorType:
+			return nil, msg.AsError()
+		default:
+			return nil, NewError(ErrorCodeProtocolViolation, "chunk stream did not end with a response, type: %d", msg.Header.Type)
 		}
+	}
+}
 
-		if err := cb(&msg); err != nil {
-			return nil, err
+// Send an error for the request with the ID to the peer
+func (mh *MessageHandler) sendError(stream quic.Stream, session *Session, requestID uint64, err error) error {
+	// Copy the error so we don't modify any of the sentinel errors
+	e := *AsError(err)
+	e.RequestID = requestID
+
+	return SendRequest(stream, requestID, newErrorMessage(session, &e))
+}
+
+// The request that Run is handling
+type runningRequest struct {
+	// Protects the fields below
+	mu sync.Mutex
+
+	// The request ID
+	id uint64
+
+	// Cancels the request, nil when no request is handled
+	cancel context.CancelCauseFunc
+}
+
+// Set the request that is handled
+func (r *runningRequest) set(id uint64, cancel context.CancelCauseFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.id = id
+	r.cancel = cancel
+}
+
+// Clear the request when it has been handled
+func (r *runningRequest) clear() {
+	r.set(0, nil)
+}
+
+// Cancel the request if it is the one with the ID, returns false if
+// it is not handled
+func (r *runningRequest) cancelID(id uint64, cause error) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel == nil || r.id != id {
+		return false
+	}
+
+	r.cancel(cause)
+	return true
+}
+
+// Cancel the request that is handled, if any
+func (r *runningRequest) cancelAny(cause error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.cancel != nil {
+		r.cancel(cause)
+	}
+}
+
+// Read messages from the stream and pass them on until the stream ends or
+// done is closed. Cancel messages is handled here since the request they
+// cancel is handled while we read.
+func (mh *MessageHandler) readLoop(logger *zap.Logger, r io.Reader, running *runningRequest, msgs chan<- *Message, readErr chan<- error, done <-chan struct{}) {
+	for {
+		var msg Message
+		if err := mh.read(r, &msg); err != nil {
+			// The peer can close its side of the stream once the request
+			// is sent, only a reset cancels the request.
+			if err != io.EOF {
+				running.cancelAny(err)
+			}
+
+			readErr <- err
+			return
+		}
+
+		if msg.Header.Type == CancelExportType {
+			mh.cancelExport(logger, running, &msg)
+			continue
 		}
+
+		// NOTE: Only one request is handled at a time, a cancel that is
+		// sent after another request is not seen until that request is
+		// handled. Exports has a stream of their own.
+		select {
+		case msgs <- &msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Cancel the export the cancel export message is for
+func (mh *MessageHandler) cancelExport(logger *zap.Logger, running *runningRequest, msg *Message) {
+	logger = logger.With(zap.Uint64("request_id", msg.Header.RequestID))
+
+	if msg.Header.Version != 1 {
+		logger.Warn("unsupported cancel export version", zap.Any("version", msg.Header.Version))
+		return
 	}
 
-	return nil, errors.New("read chunks never finished")
+	var cancel CancelExportV1
+	if err := msg.Unmarshal(&cancel); err != nil {
+		logger.Warn("invalid cancel export", zap.Error(err))
+		return
+	}
+
+	cause := NewError(ErrorCodeCancelled, "export cancelled by peer")
+	if cancel.Reason != "" {
+		cause = NewError(ErrorCodeCancelled, "export cancelled by peer: %s", cancel.Reason)
+	}
+
+	// The export can have finished before the cancel arrived, the peer
+	// then has the response already.
+	if !running.cancelID(msg.Header.RequestID, cause) {
+		logger.Debug("cancel for a request that is not running")
+		return
+	}
+
+	logger.Info("cancelling export", zap.String("reason", cancel.Reason))
 }
 
 // This runs the mssage handler that reads messages from the stream and gives the
-// messages to the handler that is registered for the message.
-func (mh *MessageHandler) Run(logger *zap.Logger, stream quic.Stream) error {
+// messages to the handler that is registered for the message. The session is
+// the result of the handshake that must have been done on the stream.
+//
+// Errors returned by a handler is sent to the peer and the handler continues
+// with the next message, a message that cannot be read ends the stream since
+// we can no longer know where the next message starts.
+//
+// The stream is read while a message is handled so the peer can cancel the
+// request with a cancel export message, the request then fails with an
+// ErrorCodeCancelled error. If the peer resets the stream or stops reading
+// it the request is cancelled and the stream is reset with
+// StreamErrorCancelled.
+func (mh *MessageHandler) Run(logger *zap.Logger, stream quic.Stream, session *Session) error {
+	// NOTE: Nothing else reads the stream so it is safe to buffer.
 	r := bufio.NewReader(stream)
 
-        for {
-		var msg Message
-		if err := mh.read(r, &msg); err != nil {
+	running := &runningRequest{}
+	msgs := make(chan *Message)
+	readErr := make(chan error, 1)
+	done := make(chan struct{})
+
+	defer func() {
+		close(done)
+
+		// Stop reading so the read loop does not wait for the peer
+		stream.CancelRead(0)
+	}()
+
+	go mh.readLoop(logger, r, running, msgs, readErr, done)
+
+	for {
+		var msg *Message
+
+		select {
+		case msg = <-msgs:
+		case err := <-readErr:
 			if err == io.EOF {
 				return nil
 			}
 
+			if isStreamCancelled(err) {
+				logger.Info("stream cancelled by peer", zap.Error(err))
+				stream.CancelWrite(StreamErrorCancelled)
+				return nil
+			}
+
 			logger.Error("failed to read message", zap.String("error", err.Error()))
-			// TODO(tobias.urdin): Send error
+
+			protoErr := NewError(ErrorCodeProtocolViolation, "failed to read message: %s", err.Error())
+			if sendErr := mh.sendError(stream, session, 0, protoErr); sendErr != nil {
+				logger.Error("failed to send error", zap.String("error", sendErr.Error()))
+			}
+
 			return err
 		}
 
+		handlerFunc := mh.getHandler(msg)
+		if handlerFunc == nil {
+			protoErr := NewError(ErrorCodeProtocolViolation, "no handler for message type %d version %d", msg.Header.Type, msg.Header.Version)
+			if err := mh.sendError(stream, session, msg.Header.RequestID, protoErr); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		reqCtx, cancel := context.WithCancelCause(stream.Context())
+		running.set(msg.Header.RequestID, cancel)
+
 		ctx := Context{
+			ctx: reqCtx,
 			logger: logger,
-			message: &msg,
+			message: msg,
 			stream: stream,
+			session: session,
 		}
 
-		handlerFunc := mh.getHandler(&msg)
-		if handlerFunc == nil {
-			// TODO(tobias.urdin): Send error to sender, could not handle message
-			return errors.New("could not handle message")
+		err := handlerFunc(&ctx)
+
+		running.clear()
+		cause := context.Cause(reqCtx)
+		cancelled := reqCtx.Err() != nil
+		cancel(nil)
+
+		if err == nil {
+			continue
 		}
 
-		if err := handlerFunc(&ctx); err != nil {
-			// TODO(tobias.urdin): Send error to sender, failed to handle message
+		switch {
+		case cancelled && errors.Is(cause, ErrCancelled):
+			logger.Info("request cancelled", zap.Uint64("request_id", msg.Header.RequestID), zap.Error(cause))
+			err = cause
+		case cancelled && (isStreamCancelled(cause) || stream.Context().Err() != nil):
+			// The peer has reset the stream or stopped reading it, nothing
+			// more can be sent on it
+			logger.Info("request cancelled, stream cancelled by peer", zap.Uint64("request_id", msg.Header.RequestID),
+				zap.Error(cause))
+			stream.CancelWrite(StreamErrorCancelled)
+			return nil
+		case cancelled:
+			// The read loop failed, the error is handled as the next message
+			continue
+		default:
 			logger.Error("failed to handle message", zap.String("error", err.Error()))
+		}
+
+		if err := mh.sendError(stream, session, msg.Header.RequestID, err); err != nil {
 			return err
 		}
-        }
+	}
+}
 
-	return nil
+// Returns true if the error is from the peer resetting the stream or the
+// connection going away
+func isStreamCancelled(err error) bool {
+	var streamErr *quic.StreamError
+	if errors.As(err, &streamErr) {
+		return streamErr.Remote
+	}
+
+	var appErr *quic.ApplicationError
+	var idleErr *quic.IdleTimeoutError
+
+	return errors.As(err, &appErr) || errors.As(err, &idleErr)
 }
@@ -0,0 +1,259 @@
+package message
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/quic-go/quic-go"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+const testProto = "snapback-test"
+
+var testCapabilities = &Capabilities{
+	SoftwareVersion: "test",
+	Messages: map[MessageType][]MessageVersion{
+		ErrorType: {1, 2},
+		ExportRequestType: {3},
+		ExportResponseType: {2},
+		ExportChunkType: {1},
+		CancelExportType: {1},
+	},
+	Required: []MessageType{
+		ErrorType,
+	},
+}
+
+// Returns a self-signed certificate for localhost
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{CommonName: "localhost"},
+		DNSNames: []string{"localhost"},
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("create certificate: %v", err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey: key,
+	}
+}
+
+// Opens a stream over a QUIC connection on the loopback, serve is run with
+// the other end of it and must return when the stream is closed
+func newTestStream(t *testing.T, serve func(quic.Stream) error) quic.Stream {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(cancel)
+
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{testProto},
+	}, nil)
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	served := make(chan error, 1)
+
+	go func() {
+		conn, err := ln.Accept(ctx)
+		if err != nil {
+			served <- err
+			return
+		}
+
+		stream, err := conn.AcceptStream(ctx)
+		if err != nil {
+			served <- err
+			return
+		}
+
+		served <- serve(stream)
+	}()
+
+	conn, err := quic.DialAddr(ctx, ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		MinVersion: tls.VersionTLS13,
+		NextProtos: []string{testProto},
+	}, nil)
+	if err != nil {
+		t.Fatalf("dial: %v", err)
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		t.Fatalf("open stream: %v", err)
+	}
+
+	t.Cleanup(func() {
+		stream.Close()
+
+		if err := <-served; err != nil {
+			t.Errorf("serve: %v", err)
+		}
+
+		conn.CloseWithError(0, "")
+	})
+
+	return stream
+}
+
+// Runs the handler on a test stream and returns a dispatcher for the other
+// end of it and the handler logs
+func newTestPair(t *testing.T, mh *MessageHandler) (*Dispatcher, *observer.ObservedLogs) {
+	t.Helper()
+
+	core, logs := observer.New(zap.DebugLevel)
+
+	stream := newTestStream(t, func(stream quic.Stream) error {
+		session, err := mh.Accept(stream, testCapabilities)
+		if err != nil {
+			return err
+		}
+
+		return mh.Run(zap.New(core), stream, session)
+	})
+
+	session, err := mh.Hello(stream, testCapabilities)
+	if err != nil {
+		t.Fatalf("hello: %v", err)
+	}
+
+	return NewDispatcher(zap.NewNop(), stream, session), logs
+}
+
+// Returns a handler for export requests that answers right away unless
+// the image is "wait", it then sends a chunk and waits to be cancelled
+func newExportHandler(causes chan<- error) *MessageHandler {
+	mh := NewHandler(zap.NewNop())
+
+	mh.AddHandler(ExportRequestType, 3, func(ctx *Context) error {
+		var req ExportRequestV3
+		if err := ctx.Message().Unmarshal(&req); err != nil {
+			return err
+		}
+
+		if req.Image != "wait" {
+			return ctx.Send(&ExportResponseV2{})
+		}
+
+		if err := ctx.Send(&ExportChunkV1{Payload: []byte("chunk")}); err != nil {
+			return err
+		}
+
+		<-ctx.Context().Done()
+
+		cause := context.Cause(ctx.Context())
+		causes <- cause
+
+		return cause
+	})
+
+	return mh
+}
+
+// Send an export request that is answered right away
+func exportDone(t *testing.T, d *Dispatcher) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := d.CallChunks(ctx, &ExportRequestV3{Image: "done"}, func(*Message) error {
+		return errors.New("unexpected chunk")
+	})
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	if msg.Header.Type != ExportResponseType {
+		t.Fatalf("expected export response, got type %d", msg.Header.Type)
+	}
+}
+
+func TestHandlerCancelExport(t *testing.T) {
+	causes := make(chan error, 1)
+	d, logs := newTestPair(t, newExportHandler(causes))
+
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+
+	_, err := d.CallChunks(ctx, &ExportRequestV3{Image: "wait"}, func(*Message) error {
+		cancel(errors.New("stopping"))
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the export to be cancelled, got %v", err)
+	}
+
+	select {
+	case cause := <-causes:
+		if !errors.Is(cause, ErrCancelled) || !strings.Contains(cause.Error(), "stopping") {
+			t.Fatalf("unexpected cause %v", cause)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the export was not cancelled")
+	}
+
+	// The stream is still used for the next request
+	exportDone(t, d)
+
+	if n := logs.FilterMessage("cancelling export").Len(); n != 1 {
+		t.Fatalf("expected the export to be cancelled once, got %d", n)
+	}
+}
+
+func TestHandlerCancelAfterResponse(t *testing.T) {
+	causes := make(chan error, 1)
+	d, logs := newTestPair(t, newExportHandler(causes))
+
+	exportDone(t, d)
+
+	// The export has finished so the cancel is for a request that is not
+	// running, it must not cancel the request after it
+	d.writeMu.Lock()
+	err := SendRequest(d.stream, d.currentID(), &CancelExportV1{Reason: "late"})
+	d.writeMu.Unlock()
+
+	if err != nil {
+		t.Fatalf("send cancel: %v", err)
+	}
+
+	exportDone(t, d)
+
+	if n := logs.FilterMessage("cancel for a request that is not running").Len(); n != 1 {
+		t.Fatalf("expected the late cancel to be ignored, got %d", n)
+	}
+
+	if n := logs.FilterMessage("cancelling export").Len(); n != 0 {
+		t.Fatalf("expected no export to be cancelled, got %d", n)
+	}
+}
@@ -0,0 +1,206 @@
+package message
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/quic-go/quic-go"
+)
+
+// Optional protocol feature
+type Feature string
+
+const (
+	// Chunks can be sent compressed
+	FeatureCompression Feature = "compression"
+
+	// Exports can be resumed from an offset
+	FeatureResume Feature = "resume"
+
+	// Images can be addressed in RBD namespaces
+	FeatureNamespaces Feature = "namespaces"
+)
+
+// Returned when the peer does not support what we require
+var ErrIncompatiblePeer = errors.New("incompatible peer")
+
+// The capabilities that is advertised to the peer in the handshake
+type Capabilities struct {
+	// The software version
+	SoftwareVersion string
+
+	// The message types and the versions of them that is supported
+	Messages map[MessageType][]MessageVersion
+
+	// The optional features that is supported
+	Features []Feature
+
+	// The codecs chunks can be compressed with
+	Codecs []Codec
+
+	// The message types that must have a common version with the peer
+	Required []MessageType
+}
+
+// The session is the result of a successful handshake
+type Session struct {
+	// The software version of the peer
+	PeerVersion string
+
+	// The highest common version for each message type
+	versions map[MessageType]MessageVersion
+
+	// The features both sides support
+	features map[Feature]bool
+
+	// The codecs both sides support
+	codecs map[Codec]bool
+
+	// The certificate the peer authenticated with, the handshake only
+	// sees the stream so it is set by the caller
+	Peer *x509.Certificate
+}
+
+// Returns the negotiated version for a message type, zero if there is none
+func (s *Session) Version(t MessageType) MessageVersion {
+	return s.versions[t]
+}
+
+// Returns true if the message type has a negotiated version
+func (s *Session) Supports(t MessageType) bool {
+	return s.versions[t] != 0
+}
+
+// Returns true if both sides support the feature
+func (s *Session) HasFeature(f Feature) bool {
+	return s.features[f]
+}
+
+// Returns true if both sides support compression with the codec
+func (s *Session) HasCodec(c Codec) bool {
+	return s.HasFeature(FeatureCompression) && s.codecs[c]
+}
+
+// Negotiate a session from our local capabilities and the remote ones
+func Negotiate(local *Capabilities, peerVersion string, remote map[MessageType][]MessageVersion, remoteFeatures []Feature, remoteCodecs []Codec) (*Session, error) {
+	session := &Session{
+		PeerVersion: peerVersion,
+		versions: make(map[MessageType]MessageVersion, len(local.Messages)),
+		features: make(map[Feature]bool, len(local.Features)),
+		codecs: make(map[Codec]bool, len(local.Codecs)),
+	}
+
+	for msgType, localVersions := range local.Messages {
+		if v := highestCommon(localVersions, remote[msgType]); v != 0 {
+			session.versions[msgType] = v
+		}
+	}
+
+	for _, msgType := range local.Required {
+		if !session.Supports(msgType) {
+			return nil, fmt.Errorf("%w %q: no common version for message type %d, local versions %v, remote versions %v",
+				ErrIncompatiblePeer, peerVersion, msgType, local.Messages[msgType], remote[msgType])
+		}
+	}
+
+	for _, lf := range local.Features {
+		for _, rf := range remoteFeatures {
+			if lf == rf {
+				session.features[lf] = true
+			}
+		}
+	}
+
+	for _, lc := range local.Codecs {
+		for _, rc := range remoteCodecs {
+			if lc == rc {
+				session.codecs[lc] = true
+			}
+		}
+	}
+
+	return session, nil
+}
+
+// Returns the highest version present in both a and b, zero if there is none
+func highestCommon(a []MessageVersion, b []MessageVersion) MessageVersion {
+	sorted := append([]MessageVersion(nil), a...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i] > sorted[j]
+	})
+
+	for _, va := range sorted {
+		for _, vb := range b {
+			if va == vb {
+				return va
+			}
+		}
+	}
+
+	return 0
+}
+
+// Perform the client side of the handshake by sending a hello
+// and negotiating a session from the acknowledgement.
+func (mh *MessageHandler) Hello(stream quic.Stream, local *Capabilities) (*Session, error) {
+	hello := HelloV1{
+		SoftwareVersion: local.SoftwareVersion,
+		Messages: local.Messages,
+		Features: local.Features,
+		Codecs: local.Codecs,
+	}
+
+	if err := Send(stream, &hello); err != nil {
+		return nil, err
+	}
+
+	var msg Message
+	if err := mh.Read(stream, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Header.Type != HelloAckType || msg.Header.Version != 1 {
+		return nil, fmt.Errorf("expected hello ack, got type %d version %d", msg.Header.Type, msg.Header.Version)
+	}
+
+	var ack HelloAckV1
+	if err := msg.Unmarshal(&ack); err != nil {
+		return nil, err
+	}
+
+	return Negotiate(local, ack.SoftwareVersion, ack.Messages, ack.Features, ack.Codecs)
+}
+
+// Perform the server side of the handshake by reading the hello and
+// replying with our capabilities. The acknowledgement is sent even if
+// we cannot agree so the peer can report why.
+func (mh *MessageHandler) Accept(stream quic.Stream, local *Capabilities) (*Session, error) {
+	var msg Message
+	if err := mh.Read(stream, &msg); err != nil {
+		return nil, err
+	}
+
+	if msg.Header.Type != HelloType || msg.Header.Version != 1 {
+		return nil, fmt.Errorf("expected hello, got type %d version %d", msg.Header.Type, msg.Header.Version)
+	}
+
+	var hello HelloV1
+	if err := msg.Unmarshal(&hello); err != nil {
+		return nil, err
+	}
+
+	ack := HelloAckV1{
+		SoftwareVersion: local.SoftwareVersion,
+		Messages: local.Messages,
+		Features: local.Features,
+		Codecs: local.Codecs,
+	}
+
+	if err := Send(stream, &ack); err != nil {
+		return nil, err
+	}
+
+	return Negotiate(local, hello.SoftwareVersion, hello.Messages, hello.Features, hello.Codecs)
+}
@@ -0,0 +1,54 @@
+package message
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	local := &Capabilities{
+		Messages: map[MessageType][]MessageVersion{
+			ErrorType: {1, 2},
+			ExportRequestType: {1, 2, 3},
+			ExportResponseType: {1, 2},
+			CancelExportType: {1},
+		},
+		Required: []MessageType{
+			ErrorType,
+			ExportRequestType,
+			ExportResponseType,
+		},
+		Features: []Feature{FeatureResume},
+	}
+
+	session, err := Negotiate(local, "peer", map[MessageType][]MessageVersion{
+		ErrorType: {1},
+		ExportRequestType: {1, 2},
+		ExportResponseType: {1},
+	}, []Feature{FeatureResume}, nil)
+	if err != nil {
+		t.Fatalf("negotiate: %v", err)
+	}
+
+	if v := session.Version(ExportRequestType); v != 2 {
+		t.Fatalf("expected export request version 2, got %d", v)
+	}
+
+	if session.Supports(CancelExportType) {
+		t.Fatal("expected cancel export to not be supported")
+	}
+
+	if !session.HasFeature(FeatureResume) {
+		t.Fatal("expected resume to be supported")
+	}
+
+	// A peer without a common version of a required message is refused
+	_, err = Negotiate(local, "peer", map[MessageType][]MessageVersion{
+		ErrorType: {1},
+		ExportRequestType: {4},
+		ExportResponseType: {1},
+	}, nil, nil)
+	if !errors.Is(err, ErrIncompatiblePeer) {
+		t.Fatalf("expected ErrIncompatiblePeer, got %v", err)
+	}
+}
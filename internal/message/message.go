@@ -1,6 +1,12 @@
 package message
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
 	"github.com/fxamacker/cbor/v2"
 )
 
@@ -28,6 +34,36 @@ const (
 
 	// The message type number for export chunk
 	ExportChunkType = 8
+
+	// The message type number for hello
+	HelloType = 9
+
+	// The message type number for hello acknowledgement
+	HelloAckType = 10
+
+	// The message type number for image info request
+	ImageInfoRequestType = 11
+
+	// The message type number for image info response
+	ImageInfoResponseType = 12
+
+	// The message type number for list pools request
+	ListPoolsRequestType = 13
+
+	// The message type number for list pools response
+	ListPoolsResponseType = 14
+
+	// The message type number for subscribe request
+	SubscribeRequestType = 15
+
+	// The message type number for subscribe response
+	SubscribeResponseType = 16
+
+	// The message type number for event
+	EventType = 17
+
+	// The message type number for cancel export
+	CancelExportType = 18
 )
 
 // The message Type
@@ -43,6 +79,11 @@ type MessageHeader struct {
 
 	// The version of the message type
 	Version MessageVersion `cbor:"2,keyasint"`
+
+	// The ID of the request this message belongs to, responses and
+	// errors carry the ID of the request they reply to. Zero means
+	// that the message is not part of a request.
+	RequestID uint64 `cbor:"3,keyasint,omitempty"`
 }
 
 // The message interface
@@ -71,6 +112,73 @@ func (m *Message) Unmarshal(v interface{}) error {
 	return cbor.Unmarshal(m.Data, v)
 }
 
+// The message as it is sent, the data is encoded in place instead of
+// being marshalled on its own first. It is encoded the same as a Message.
+type outgoingMessage struct {
+	// The message header
+	Header MessageHeader `cbor:"1,keyasint"`
+
+	// The message data
+	Data MessageInterface `cbor:"2,keyasint"`
+}
+
+// The buffers that messages is encoded into, they grow to the size of
+// the largest message which is an export chunk
+var frameBuffers = sync.Pool{
+	New: func() any {
+		return new(bytes.Buffer)
+	},
+}
+
+// Encode a message with the request ID set in the header and write it
+// to w in a frame
+func writeMessage(w io.Writer, m MessageInterface, requestID uint64) error {
+	buf := frameBuffers.Get().(*bytes.Buffer)
+	defer frameBuffers.Put(buf)
+
+	// The message is encoded after the frame header so the frame can
+	// be written from the buffer without copying the message
+	var header [FrameHeaderSize]byte
+	buf.Reset()
+	buf.Write(header[:])
+
+	msg := outgoingMessage{
+		Header: MessageHeader{
+			Type: m.Type(),
+			Version: m.Version(),
+			RequestID: requestID,
+		},
+		Data: m,
+	}
+
+	if err := cbor.NewEncoder(buf).Encode(&msg); err != nil {
+		return err
+	}
+
+	frame := buf.Bytes()
+	if err := putFrameHeader(frame); err != nil {
+		return err
+	}
+
+	if _, err := w.Write(frame); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Read the next frame from r and unmarshal it into a Message
+func readMessage(r io.Reader, msg *Message) error {
+	// Read the next frame which contains the data for this message
+	buf, err := readFrame(r)
+	if err != nil {
+		return err
+	}
+
+	// Unmarshal the raw message into a Message
+	return unmarshal(buf, msg)
+}
+
 // Unmarshal data into a Message
 func unmarshal(data []byte, msg *Message) error {
 	if err := cbor.Unmarshal(data, msg); err != nil {
@@ -119,6 +227,54 @@ func (e *ErrorMessage) Marshal() ([]byte, error) {
 	return res, nil
 }
 
+// The error message version 2 that describes why a request failed
+type ErrorMessageV2 struct {
+	// The error code
+	Code ErrorCode `cbor:"1,keyasint"`
+
+	// The human-readable error message
+	Message string `cbor:"2,keyasint"`
+
+	// If the request can be retried
+	Retryable bool `cbor:"3,keyasint"`
+
+	// The ID of the request that failed
+	RequestID uint64 `cbor:"4,keyasint"`
+}
+
+// The error message version 2 type
+func (e *ErrorMessageV2) Type() MessageType {
+	return ErrorType
+}
+
+// The error message version 2 version
+func (e *ErrorMessageV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal error version 2 to message
+func (e *ErrorMessageV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // The list pool request version 1
 type ListPoolRequestV1 struct {
 	// The pool name we want to list images on
@@ -197,6 +353,109 @@ func (l *ListPoolResponseV1) Marshal() ([]byte, error) {
 	return res, nil
 }
 
+// The list pool request version 2, it lists one page of the images that
+// matches the filter
+type ListPoolRequestV2 struct {
+	// The pool name we want to list images on
+	Pool string `cbor:"1,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// Only images that matches the glob is listed
+	Glob string `cbor:"3,keyasint,omitempty"`
+
+	// Only images that matches the regular expression is listed
+	Regex string `cbor:"4,keyasint,omitempty"`
+
+	// The token from the previous page, empty for the first page
+	PageToken string `cbor:"5,keyasint,omitempty"`
+
+	// The maximum number of images in the page, zero for the default
+	Limit uint32 `cbor:"6,keyasint,omitempty"`
+}
+
+// The list pool request type
+func (l *ListPoolRequestV2) Type() MessageType {
+	return ListPoolRequestType
+}
+
+// The list pool request version
+func (l *ListPoolRequestV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal list pool request version 2 to message
+func (l *ListPoolRequestV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: l.Type(),
+			Version: l.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The list pool response version 2
+type ListPoolResponseV2 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The RBD namespace in the pool
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// The image names in the page ordered by name
+	Names []string `cbor:"3,keyasint"`
+
+	// The token for the next page, empty if this is the last page
+	NextPageToken string `cbor:"4,keyasint,omitempty"`
+}
+
+// The list pool response type
+func (l *ListPoolResponseV2) Type() MessageType {
+	return ListPoolResponseType
+}
+
+// The list pool response version
+func (l *ListPoolResponseV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal list pool response version 2 to message
+func (l *ListPoolResponseV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: l.Type(),
+			Version: l.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // The list snapshots request version 1
 type ListSnapshotsRequestV1 struct {
 	// The pool name
@@ -204,6 +463,9 @@ type ListSnapshotsRequestV1 struct {
 
 	// The image name
 	Image string `cbor:"2,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"3,keyasint,omitempty"`
 }
 
 // The list snapshot request type
@@ -249,6 +511,9 @@ type ListSnapshotsResponseV1 struct {
 
 	// The snapshots
 	Snapshots []string `cbor:"3,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"4,keyasint,omitempty"`
 }
 
 // The list snapshots response type
@@ -284,6 +549,75 @@ func (l *ListSnapshotsResponseV1) Marshal() ([]byte, error) {
 	return res, nil
 }
 
+// A snapshot in the list snapshots response version 2
+type SnapshotV2 struct {
+	// The snapshot ID, a newer snapshot always has a higher ID
+	ID uint64 `cbor:"1,keyasint"`
+
+	// The snapshot name
+	Name string `cbor:"2,keyasint"`
+
+	// The size of the image when the snapshot was taken
+	Size uint64 `cbor:"3,keyasint"`
+
+	// When the snapshot was created
+	Timestamp time.Time `cbor:"4,keyasint"`
+
+	// If the snapshot is protected
+	Protected bool `cbor:"5,keyasint"`
+
+	// The snapshot namespace, user, group, trash or mirror
+	Namespace string `cbor:"6,keyasint"`
+}
+
+// The list snapshots response version 2
+type ListSnapshotsResponseV2 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The image name
+	Image string `cbor:"2,keyasint"`
+
+	// The snapshots ordered by their ID
+	Snapshots []SnapshotV2 `cbor:"3,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"4,keyasint,omitempty"`
+}
+
+// The list snapshots response type
+func (l *ListSnapshotsResponseV2) Type() MessageType {
+	return ListSnapshotsResponseType
+}
+
+// The list snapshots response version
+func (l *ListSnapshotsResponseV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal list snapshots response version 2 to message
+func (l *ListSnapshotsResponseV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: l.Type(),
+			Version: l.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 // The export request version 1
 type ExportRequestV1 struct {
 	// The pool name
@@ -294,6 +628,9 @@ type ExportRequestV1 struct {
 
 	// The snapshot on the image we want to export
 	Snapshot string `cbor:"3,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"4,keyasint,omitempty"`
 }
 
 // The export request type
@@ -329,30 +666,37 @@ func (e *ExportRequestV1) Marshal() ([]byte, error) {
 	return res, nil
 }
 
-// The export response version 1
-type ExportResponseV1 struct {
+// The export request version 2
+type ExportRequestV2 struct {
 	// The pool name
 	Pool string `cbor:"1,keyasint"`
 
-	// The image name
+	// The image name we want to export from the pool
 	Image string `cbor:"2,keyasint"`
 
-	// The snapshot name
+	// The snapshot on the image we want to export
 	Snapshot string `cbor:"3,keyasint"`
+
+	// The snapshot the export starts from, only the changes between
+	// this snapshot and Snapshot is exported. Empty means a full export.
+	FromSnapshot string `cbor:"4,keyasint,omitempty"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"5,keyasint,omitempty"`
 }
 
-// The export response type
-func (e *ExportResponseV1) Type() MessageType {
-	return ExportResponseType
+// The export request type
+func (e *ExportRequestV2) Type() MessageType {
+	return ExportRequestType
 }
 
-// The export response version
-func (e *ExportResponseV1) Version() MessageVersion {
-	return MessageVersion(1)
+// The export message version
+func (e *ExportRequestV2) Version() MessageVersion {
+	return MessageVersion(2)
 }
 
-// Marshal the export response version 1 to message
-func (e *ExportResponseV1) Marshal() ([]byte, error) {
+// Marshal the export request version 2 to message
+func (e *ExportRequestV2) Marshal() ([]byte, error) {
 	data, err := cbor.Marshal(e)
 	if err != nil {
 		return nil, err
@@ -374,27 +718,46 @@ func (e *ExportResponseV1) Marshal() ([]byte, error) {
 	return res, nil
 }
 
-// The export chunk version 1
-type ExportChunkV1 struct {
-	// The bytes payload for this chunk
-	Payload []byte `cbor:"2,keyasint"`
+// The export request version 3, it can resume an export that was
+// interrupted
+type ExportRequestV3 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
 
-	// The CRC32 of the payload for this chunk
-	PayloadCRC uint32 `cbor:"3,keyasint"`
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// The image name we want to export from the pool
+	Image string `cbor:"3,keyasint"`
+
+	// The snapshot on the image we want to export
+	Snapshot string `cbor:"4,keyasint"`
+
+	// The snapshot the export starts from, only the changes between
+	// this snapshot and Snapshot is exported. Empty means a full export.
+	FromSnapshot string `cbor:"5,keyasint,omitempty"`
+
+	// The resume token from the first chunk of the export that is
+	// resumed, empty for a new export
+	ResumeToken string `cbor:"6,keyasint,omitempty"`
+
+	// The offset in the diff stream the export is resumed at, it must be
+	// zero for a new export
+	Offset uint64 `cbor:"7,keyasint,omitempty"`
 }
 
-// The export chunk type
-func (e *ExportChunkV1) Type() MessageType {
-	return ExportChunkType
+// The export request type
+func (e *ExportRequestV3) Type() MessageType {
+	return ExportRequestType
 }
 
-// The export chunk version
-func (e *ExportChunkV1) Version() MessageVersion {
-	return MessageVersion(1)
+// The export request version
+func (e *ExportRequestV3) Version() MessageVersion {
+	return MessageVersion(3)
 }
 
-// Marshal the export chunk version 1 to message
-func (e *ExportChunkV1) Marshal() ([]byte, error) {
+// Marshal export request version 3 to message
+func (e *ExportRequestV3) Marshal() ([]byte, error) {
 	data, err := cbor.Marshal(e)
 	if err != nil {
 		return nil, err
@@ -415,3 +778,861 @@ func (e *ExportChunkV1) Marshal() ([]byte, error) {
 
 	return res, nil
 }
+
+// The export response version 1
+type ExportResponseV1 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The image name
+	Image string `cbor:"2,keyasint"`
+
+	// The snapshot name
+	Snapshot string `cbor:"3,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"4,keyasint,omitempty"`
+}
+
+// The export response type
+func (e *ExportResponseV1) Type() MessageType {
+	return ExportResponseType
+}
+
+// The export response version
+func (e *ExportResponseV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the export response version 1 to message
+func (e *ExportResponseV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The export response version 2, it lets the importer verify that it got
+// all of the diff
+type ExportResponseV2 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// The image name
+	Image string `cbor:"3,keyasint"`
+
+	// The snapshot name
+	Snapshot string `cbor:"4,keyasint"`
+
+	// The SHA-256 of the whole diff, the part before Offset that was not
+	// sent on a resumed stream is included
+	Digest []byte `cbor:"5,keyasint"`
+
+	// The number of bytes of the whole diff
+	Bytes uint64 `cbor:"6,keyasint"`
+
+	// The number of chunks that was sent on the stream
+	Chunks uint64 `cbor:"7,keyasint"`
+
+	// The offset in the diff the stream started at
+	Offset uint64 `cbor:"8,keyasint,omitempty"`
+}
+
+// The export response type
+func (e *ExportResponseV2) Type() MessageType {
+	return ExportResponseType
+}
+
+// The export response version
+func (e *ExportResponseV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal export response version 2 to message
+func (e *ExportResponseV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The export chunk version 1
+type ExportChunkV1 struct {
+	// The bytes payload for this chunk
+	Payload []byte `cbor:"2,keyasint"`
+
+	// The CRC32 of the payload for this chunk
+	PayloadCRC uint32 `cbor:"3,keyasint"`
+}
+
+// The export chunk type
+func (e *ExportChunkV1) Type() MessageType {
+	return ExportChunkType
+}
+
+// The export chunk version
+func (e *ExportChunkV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the export chunk version 1 to message
+func (e *ExportChunkV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The export chunk version 2
+type ExportChunkV2 struct {
+	// The bytes payload for this chunk
+	Payload []byte `cbor:"1,keyasint"`
+
+	// The CRC32 of the payload for this chunk
+	PayloadCRC uint32 `cbor:"2,keyasint"`
+
+	// The sequence number of the chunk on the stream, it starts at zero
+	Sequence uint64 `cbor:"3,keyasint"`
+
+	// The offset in the diff stream of the first byte of the payload
+	Offset uint64 `cbor:"4,keyasint"`
+
+	// The token the export can be resumed with, it is only set on the
+	// first chunk and only if the export can be resumed
+	ResumeToken string `cbor:"5,keyasint,omitempty"`
+}
+
+// The export chunk type
+func (e *ExportChunkV2) Type() MessageType {
+	return ExportChunkType
+}
+
+// The export chunk version
+func (e *ExportChunkV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal export chunk version 2 to message
+func (e *ExportChunkV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The export chunk version 3
+type ExportChunkV3 struct {
+	// The bytes payload for this chunk, compressed with Codec
+	Payload []byte `cbor:"1,keyasint"`
+
+	// The CRC32 of the payload for this chunk before it was compressed
+	PayloadCRC uint32 `cbor:"2,keyasint"`
+
+	// The sequence number of the chunk on the stream, it starts at zero
+	Sequence uint64 `cbor:"3,keyasint"`
+
+	// The offset in the diff stream of the first byte of the payload
+	Offset uint64 `cbor:"4,keyasint"`
+
+	// The token the export can be resumed with, it is only set on the
+	// first chunk and only if the export can be resumed
+	ResumeToken string `cbor:"5,keyasint,omitempty"`
+
+	// The codec the payload is compressed with, a chunk that does not
+	// get smaller when compressed is sent as it is
+	Codec Codec `cbor:"6,keyasint,omitempty"`
+
+	// The size of the payload before it was compressed, it is only set
+	// when the payload is compressed
+	Size uint64 `cbor:"7,keyasint,omitempty"`
+}
+
+// The export chunk type
+func (e *ExportChunkV3) Type() MessageType {
+	return ExportChunkType
+}
+
+// The export chunk version
+func (e *ExportChunkV3) Version() MessageVersion {
+	return MessageVersion(3)
+}
+
+// Marshal export chunk version 3 to message
+func (e *ExportChunkV3) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The hello version 1 that is sent by the client when a stream is opened
+type HelloV1 struct {
+	// The software version of the sender
+	SoftwareVersion string `cbor:"1,keyasint"`
+
+	// The message types and the versions of them the sender supports
+	Messages map[MessageType][]MessageVersion `cbor:"2,keyasint"`
+
+	// The optional features the sender supports
+	Features []Feature `cbor:"3,keyasint"`
+
+	// The codecs the sender can compress and decompress chunks with
+	//
+	// NOTE: Added after the first release, it is left out by
+	// older peers which then cannot use compression.
+	Codecs []Codec `cbor:"4,keyasint,omitempty"`
+}
+
+// The hello type
+func (h *HelloV1) Type() MessageType {
+	return HelloType
+}
+
+// The hello version
+func (h *HelloV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the hello version 1 to message
+func (h *HelloV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: h.Type(),
+			Version: h.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The hello acknowledgement version 1 that is sent in reply to a hello
+type HelloAckV1 struct {
+	// The software version of the sender
+	SoftwareVersion string `cbor:"1,keyasint"`
+
+	// The message types and the versions of them the sender supports
+	Messages map[MessageType][]MessageVersion `cbor:"2,keyasint"`
+
+	// The optional features the sender supports
+	Features []Feature `cbor:"3,keyasint"`
+
+	// The codecs the sender can compress and decompress chunks with, see
+	// HelloV1.Codecs
+	Codecs []Codec `cbor:"4,keyasint,omitempty"`
+}
+
+// The hello acknowledgement type
+func (h *HelloAckV1) Type() MessageType {
+	return HelloAckType
+}
+
+// The hello acknowledgement version
+func (h *HelloAckV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the hello acknowledgement version 1 to message
+func (h *HelloAckV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(h)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: h.Type(),
+			Version: h.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The image info request version 1
+type ImageInfoRequestV1 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The image name
+	Image string `cbor:"2,keyasint"`
+
+	// The snapshot to get information about, empty for the image head
+	Snapshot string `cbor:"3,keyasint,omitempty"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"4,keyasint,omitempty"`
+}
+
+// The image info request type
+func (i *ImageInfoRequestV1) Type() MessageType {
+	return ImageInfoRequestType
+}
+
+// The image info request version
+func (i *ImageInfoRequestV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the image info request version 1 to message
+func (i *ImageInfoRequestV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: i.Type(),
+			Version: i.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The image info response version 1
+type ImageInfoResponseV1 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The image name
+	Image string `cbor:"2,keyasint"`
+
+	// The snapshot name
+	Snapshot string `cbor:"3,keyasint,omitempty"`
+
+	// The size of the image in bytes
+	Size uint64 `cbor:"4,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"5,keyasint,omitempty"`
+}
+
+// The image info response type
+func (i *ImageInfoResponseV1) Type() MessageType {
+	return ImageInfoResponseType
+}
+
+// The image info response version
+func (i *ImageInfoResponseV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal the image info response version 1 to message
+func (i *ImageInfoResponseV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: i.Type(),
+			Version: i.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The parent of a cloned image in the image info response version 2
+type ImageParentV2 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The namespace in the pool
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// The image name
+	Image string `cbor:"3,keyasint"`
+
+	// The snapshot the image was cloned from
+	Snapshot string `cbor:"4,keyasint"`
+}
+
+// The image info response version 2, it has the layout and metadata
+// needed to create the image on the destination
+type ImageInfoResponseV2 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The image name
+	Image string `cbor:"2,keyasint"`
+
+	// The snapshot name
+	Snapshot string `cbor:"3,keyasint,omitempty"`
+
+	// The size of the image in bytes
+	Size uint64 `cbor:"4,keyasint"`
+
+	// The objects of the image is 1 << Order bytes
+	Order uint8 `cbor:"5,keyasint"`
+
+	// The size of the objects of the image
+	ObjectSize uint64 `cbor:"6,keyasint"`
+
+	// The names of the enabled features
+	Features []string `cbor:"7,keyasint"`
+
+	// The stripe unit in bytes
+	StripeUnit uint64 `cbor:"8,keyasint"`
+
+	// The number of objects that is striped over
+	StripeCount uint64 `cbor:"9,keyasint"`
+
+	// The pool that data is stored in, empty if it is the image pool
+	DataPool string `cbor:"10,keyasint,omitempty"`
+
+	// The parent the image was cloned from
+	Parent *ImageParentV2 `cbor:"11,keyasint,omitempty"`
+
+	// The image-meta key/value pairs
+	Metadata map[string]string `cbor:"12,keyasint,omitempty"`
+
+	// When the image was created
+	CreateTimestamp time.Time `cbor:"13,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"14,keyasint,omitempty"`
+}
+
+// The image info response type
+func (i *ImageInfoResponseV2) Type() MessageType {
+	return ImageInfoResponseType
+}
+
+// The image info response version
+func (i *ImageInfoResponseV2) Version() MessageVersion {
+	return MessageVersion(2)
+}
+
+// Marshal the image info response version 2 to message
+func (i *ImageInfoResponseV2) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(i)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: i.Type(),
+			Version: i.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The list pools request version 1, it lists the pools with images that
+// the client can access
+type ListPoolsRequestV1 struct{}
+
+// The list pools request type
+func (l *ListPoolsRequestV1) Type() MessageType {
+	return ListPoolsRequestType
+}
+
+// The list pools request version
+func (l *ListPoolsRequestV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal list pools request version 1 to message
+func (l *ListPoolsRequestV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: l.Type(),
+			Version: l.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// A pool in the list pools response version 1
+type PoolV1 struct {
+	// The pool name
+	Name string `cbor:"1,keyasint"`
+
+	// The RBD namespaces in the pool that the client can access, the
+	// default namespace is the empty string
+	Namespaces []string `cbor:"2,keyasint"`
+}
+
+// The list pools response version 1
+type ListPoolsResponseV1 struct {
+	// The pools ordered by name
+	Pools []PoolV1 `cbor:"1,keyasint"`
+}
+
+// The list pools response type
+func (l *ListPoolsResponseV1) Type() MessageType {
+	return ListPoolsResponseType
+}
+
+// The list pools response version
+func (l *ListPoolsResponseV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal list pools response version 1 to message
+func (l *ListPoolsResponseV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(l)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: l.Type(),
+			Version: l.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// What a subscription is for, an image or all images in a namespace of
+// a pool
+type SubscriptionV1 struct {
+	// The pool name
+	Pool string `cbor:"1,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"2,keyasint,omitempty"`
+
+	// The image name, empty for all images in the namespace
+	Image string `cbor:"3,keyasint,omitempty"`
+}
+
+// The subscribe request version 1, it is sent on a stream of its own
+// since events is sent on the stream for as long as it is open
+type SubscribeRequestV1 struct {
+	// The pools, namespaces and images to get events for
+	Subscriptions []SubscriptionV1 `cbor:"1,keyasint"`
+}
+
+// The subscribe request type
+func (s *SubscribeRequestV1) Type() MessageType {
+	return SubscribeRequestType
+}
+
+// The subscribe request version
+func (s *SubscribeRequestV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal subscribe request version 1 to message
+func (s *SubscribeRequestV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: s.Type(),
+			Version: s.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The subscribe response version 1, events for the request follows it
+type SubscribeResponseV1 struct {
+	// How often the exporter checks for changes in seconds
+	Interval uint32 `cbor:"1,keyasint"`
+}
+
+// The subscribe response type
+func (s *SubscribeResponseV1) Type() MessageType {
+	return SubscribeResponseType
+}
+
+// The subscribe response version
+func (s *SubscribeResponseV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal subscribe response version 1 to message
+func (s *SubscribeResponseV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: s.Type(),
+			Version: s.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The kind of change an event is for
+type EventKind int
+
+const (
+	// A snapshot was created on an image
+	EventSnapshotCreated EventKind = 1
+
+	// A snapshot was removed from an image
+	EventSnapshotRemoved EventKind = 2
+
+	// An image was removed
+	EventImageRemoved EventKind = 3
+)
+
+// Returns the name of the event kind
+func (k EventKind) String() string {
+	switch k {
+	case EventSnapshotCreated:
+		return "snapshot created"
+	case EventSnapshotRemoved:
+		return "snapshot removed"
+	case EventImageRemoved:
+		return "image removed"
+	}
+
+	return fmt.Sprintf("unknown event %d", int(k))
+}
+
+// The event version 1, it is sent with the request ID of the subscribe
+// request it belongs to
+type EventV1 struct {
+	// The kind of change
+	Kind EventKind `cbor:"1,keyasint"`
+
+	// The pool name
+	Pool string `cbor:"2,keyasint"`
+
+	// The RBD namespace in the pool, empty for the default namespace
+	Namespace string `cbor:"3,keyasint,omitempty"`
+
+	// The image name
+	Image string `cbor:"4,keyasint"`
+
+	// The snapshot name, empty for image events
+	Snapshot string `cbor:"5,keyasint,omitempty"`
+
+	// The snapshot ID, zero for image events
+	SnapshotID uint64 `cbor:"6,keyasint,omitempty"`
+}
+
+// The event type
+func (e *EventV1) Type() MessageType {
+	return EventType
+}
+
+// The event version
+func (e *EventV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal event version 1 to message
+func (e *EventV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: e.Type(),
+			Version: e.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// The cancel export version 1, it is sent with the request ID of the export
+// that is cancelled. The export ends with an ErrorCodeCancelled error.
+type CancelExportV1 struct {
+	// Why the export is cancelled
+	Reason string `cbor:"1,keyasint,omitempty"`
+}
+
+// The cancel export type
+func (c *CancelExportV1) Type() MessageType {
+	return CancelExportType
+}
+
+// The cancel export version
+func (c *CancelExportV1) Version() MessageVersion {
+	return MessageVersion(1)
+}
+
+// Marshal cancel export version 1 to message
+func (c *CancelExportV1) Marshal() ([]byte, error) {
+	data, err := cbor.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := Message{
+		Header: MessageHeader{
+			Type: c.Type(),
+			Version: c.Version(),
+		},
+		Data: data,
+	}
+
+	res, err := cbor.Marshal(&msg)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
@@ -0,0 +1,99 @@
+package message
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/fxamacker/cbor/v2"
+)
+
+func TestWriteMessage(t *testing.T) {
+	chunk := &ExportChunkV3{
+		Payload: bytes.Repeat([]byte("chunk\n"), 1024),
+		PayloadCRC: 42,
+		Sequence: 3,
+		Offset: 4096,
+		ResumeToken: "token",
+	}
+
+	var buf bytes.Buffer
+	if err := writeMessage(&buf, chunk, 7); err != nil {
+		t.Fatalf("writeMessage: %v", err)
+	}
+
+	// The frame must be the same as when the data is marshalled on its own
+	data, err := cbor.Marshal(chunk)
+	if err != nil {
+		t.Fatalf("marshal chunk: %v", err)
+	}
+
+	want, err := cbor.Marshal(&Message{
+		Header: MessageHeader{
+			Type: ExportChunkType,
+			Version: chunk.Version(),
+			RequestID: 7,
+		},
+		Data: data,
+	})
+	if err != nil {
+		t.Fatalf("marshal message: %v", err)
+	}
+
+	payload, err := readFrame(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+
+	if !bytes.Equal(payload, want) {
+		t.Fatalf("encoded message differs from the marshalled message")
+	}
+
+	var msg Message
+	if err := readMessage(&buf, &msg); err != nil {
+		t.Fatalf("readMessage: %v", err)
+	}
+
+	if msg.Header.Type != ExportChunkType || msg.Header.RequestID != 7 {
+		t.Fatalf("unexpected header %+v", msg.Header)
+	}
+
+	var got ExportChunkV3
+	if err := msg.Unmarshal(&got); err != nil {
+		t.Fatalf("unmarshal chunk: %v", err)
+	}
+
+	if !bytes.Equal(got.Payload, chunk.Payload) || got.Sequence != chunk.Sequence || got.Offset != chunk.Offset ||
+		got.ResumeToken != chunk.ResumeToken {
+		t.Fatalf("got chunk %d at %d, expected %d at %d", got.Sequence, got.Offset, chunk.Sequence, chunk.Offset)
+	}
+
+	if err := readMessage(&buf, &msg); err != io.EOF {
+		t.Fatalf("expected EOF after the message, got %v", err)
+	}
+}
+
+func TestWriteMessageTooLarge(t *testing.T) {
+	chunk := &ExportChunkV3{
+		Payload: make([]byte, MaxFrameSize),
+	}
+
+	if err := writeMessage(io.Discard, chunk, 1); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("expected ErrFrameTooLarge, got %v", err)
+	}
+}
+
+func BenchmarkWriteMessage(b *testing.B) {
+	chunk := &ExportChunkV3{
+		Payload: make([]byte, 4*1024*1024),
+	}
+
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		if err := writeMessage(io.Discard, chunk, 1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -1,25 +1,22 @@
 package message
 
 import (
-        "github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go"
 )
 
 // Send a message
 func Send(stream quic.Stream, m MessageInterface) error {
-        encoded, err := m.Marshal()
-        if err != nil {
-                return err
-        }
+	encoded, err := m.Marshal()
+	if err != nil {
+		return err
+	}
 
-        // NOTE(tobias.urdin): Our protocol handles newlines as the end
-        // of a message and the start of new messages so we need to end
-        // all message with a newline.
-        encoded = append(encoded, "\n"...)
-
-        if _, err := stream.Write(encoded); err != nil {
-                return err
-        }
-
-        return nil
+	// NOTE: Each message is sent in a length-prefixed frame
+	// since the CBOR encoded message is binary and can contain any byte.
+	return writeFrame(stream, encoded)
 }
 
+// Send a message that is part of the request with the ID
+func SendRequest(stream quic.Stream, requestID uint64, m MessageInterface) error {
+	return writeMessage(stream, m, requestID)
+}
@@ -0,0 +1,144 @@
+package pins
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+// The default path to the known hosts file
+const DefaultPath = "/etc/snapback/known_hosts"
+
+func NewCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "pins",
+		Short: "Manage pinned exporters",
+		Long: "Manage the exporters that is pinned in the --known-hosts file. The importer checks " +
+			"the fingerprint of the exporter public key against the file when it is used without a CA.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	cmd.PersistentFlags().String("known-hosts", DefaultPath, "file with pinned exporters")
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "List pinned exporters",
+		Args:  cobra.NoArgs,
+		RunE:  runList,
+	})
+
+	addCmd := &cobra.Command{
+		Use:   "add ADDRESS [FINGERPRINT]",
+		Short: "Pin the fingerprint of an exporter",
+		Long:  "Pin the fingerprint of an exporter, the fingerprint is either given or read from the exporter certificate with --cert.",
+		Args:  cobra.RangeArgs(1, 2),
+		RunE:  runAdd,
+	}
+	addCmd.Flags().String("cert", "", "exporter certificate to read the fingerprint from")
+	cmd.AddCommand(addCmd)
+
+	cmd.AddCommand(&cobra.Command{
+		Use:   "remove ADDRESS",
+		Short: "Remove the pin of an exporter",
+		Args:  cobra.ExactArgs(1),
+		RunE:  runRemove,
+	})
+
+	return cmd
+}
+
+// Load the known hosts file from the flag
+func loadKnownHosts(cmd *cobra.Command) (*KnownHosts, error) {
+	path, err := cmd.Flags().GetString("known-hosts")
+	if err != nil {
+		return nil, err
+	}
+
+	return Load(path)
+}
+
+// Returns the fingerprint of the certificate in a PEM file
+func certFingerprint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return "", fmt.Errorf("no certificate found in %s", path)
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	return Fingerprint(cert), nil
+}
+
+func runList(cmd *cobra.Command, args []string) error {
+	kh, err := loadKnownHosts(cmd)
+	if err != nil {
+		return err
+	}
+
+	for _, pin := range kh.List() {
+		fmt.Fprintf(cmd.OutOrStdout(), "%s %s\n", pin.Address, pin.Fingerprint)
+	}
+
+	return nil
+}
+
+func runAdd(cmd *cobra.Command, args []string) error {
+	certPath, err := cmd.Flags().GetString("cert")
+	if err != nil {
+		return err
+	}
+
+	var fingerprint string
+	switch {
+	case len(args) == 2 && certPath != "":
+		return errors.New("either a fingerprint or --cert can be given")
+	case len(args) == 2:
+		fingerprint = args[1]
+	case certPath != "":
+		if fingerprint, err = certFingerprint(certPath); err != nil {
+			return err
+		}
+	default:
+		return errors.New("a fingerprint or --cert is required")
+	}
+
+	kh, err := loadKnownHosts(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := kh.Add(args[0], fingerprint); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "pinned %s %s\n", args[0], fingerprint)
+	return nil
+}
+
+func runRemove(cmd *cobra.Command, args []string) error {
+	kh, err := loadKnownHosts(cmd)
+	if err != nil {
+		return err
+	}
+
+	if err := kh.Remove(args[0]); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "removed pin for %s\n", args[0])
+	return nil
+}
@@ -0,0 +1,277 @@
+package pins
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// The prefix of a fingerprint
+const fingerprintPrefix = "SHA256:"
+
+// Returned when an exporter is not pinned in strict mode
+var ErrNotPinned = errors.New("exporter is not pinned")
+
+// Returned when the fingerprint of an exporter does not match the pin
+var ErrMismatch = errors.New("exporter fingerprint does not match pin")
+
+// Mode decides what happens when an exporter without a pin is connected to
+type Mode string
+
+const (
+	// Refuse exporters that is not pinned
+	ModeStrict Mode = "strict"
+
+	// Pin the fingerprint of an exporter on first use
+	ModeTOFU Mode = "tofu"
+)
+
+// Returns the mode for a name
+func ParseMode(name string) (Mode, error) {
+	switch Mode(name) {
+	case ModeStrict, ModeTOFU:
+		return Mode(name), nil
+	}
+
+	return "", fmt.Errorf("unknown pin mode %q, must be %s or %s", name, ModeStrict, ModeTOFU)
+}
+
+// Returns the SHA-256 fingerprint of the public key in a certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return fingerprintPrefix + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// Returns an error if the fingerprint is malformed
+func validFingerprint(fingerprint string) error {
+	encoded, ok := strings.CutPrefix(fingerprint, fingerprintPrefix)
+	if !ok {
+		return fmt.Errorf("fingerprint %q must start with %s", fingerprint, fingerprintPrefix)
+	}
+
+	sum, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil || len(sum) != sha256.Size {
+		return fmt.Errorf("fingerprint %q is not a base64 encoded SHA-256 sum", fingerprint)
+	}
+
+	return nil
+}
+
+// Pin of an exporter
+type Pin struct {
+	// The address of the exporter
+	Address string
+
+	// The fingerprint of the exporter public key
+	Fingerprint string
+}
+
+// KnownHosts is a file with pinned exporters, each line has the address
+// of an exporter and the fingerprint of its public key
+//
+//	exporter.example.com:4242 SHA256:...
+//
+// Empty lines and lines starting with # is ignored.
+type KnownHosts struct {
+	// Protects the pins
+	mu sync.Mutex
+
+	// The path to the file
+	path string
+
+	// Fingerprints by address
+	pins map[string]string
+}
+
+// Load the known hosts file, a file that does not exist has no pins
+func Load(path string) (*KnownHosts, error) {
+	kh := &KnownHosts{
+		path: path,
+		pins: map[string]string{},
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return kh, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected address and fingerprint", path, lineno)
+		}
+
+		if err := validFingerprint(fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineno, err)
+		}
+
+		kh.pins[fields[0]] = fields[1]
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return kh, nil
+}
+
+// Returns the pins ordered by address
+func (kh *KnownHosts) List() []Pin {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	pins := make([]Pin, 0, len(kh.pins))
+	for addr, fingerprint := range kh.pins {
+		pins = append(pins, Pin{
+			Address: addr,
+			Fingerprint: fingerprint,
+		})
+	}
+
+	sort.Slice(pins, func(i, j int) bool {
+		return pins[i].Address < pins[j].Address
+	})
+
+	return pins
+}
+
+// Pin the fingerprint for an address and save the file, an existing
+// pin is replaced.
+func (kh *KnownHosts) Add(addr string, fingerprint string) error {
+	if err := validFingerprint(fingerprint); err != nil {
+		return err
+	}
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	kh.pins[addr] = fingerprint
+	return kh.save()
+}
+
+// Remove the pin for an address and save the file
+func (kh *KnownHosts) Remove(addr string) error {
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	if _, ok := kh.pins[addr]; !ok {
+		return fmt.Errorf("%w: %s", ErrNotPinned, addr)
+	}
+
+	delete(kh.pins, addr)
+	return kh.save()
+}
+
+// Write the pins to the file, the file is replaced so a partially
+// written file is never read.
+func (kh *KnownHosts) save() error {
+	addrs := make([]string, 0, len(kh.pins))
+	for addr := range kh.pins {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	var b strings.Builder
+	for _, addr := range addrs {
+		fmt.Fprintf(&b, "%s %s\n", addr, kh.pins[addr])
+	}
+
+	dir := filepath.Dir(kh.path)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(kh.path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := tmp.Chmod(0o644); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if _, err := tmp.WriteString(b.String()); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), kh.path)
+}
+
+// Verify the certificate of the exporter at an address against its pin,
+// in TOFU mode an exporter without a pin is pinned. Returns true if the
+// exporter was pinned.
+func (kh *KnownHosts) Verify(addr string, cert *x509.Certificate, mode Mode) (bool, error) {
+	fingerprint := Fingerprint(cert)
+
+	kh.mu.Lock()
+	defer kh.mu.Unlock()
+
+	pinned, ok := kh.pins[addr]
+	if ok {
+		if pinned != fingerprint {
+			return false, fmt.Errorf("%w: %s presented %s, pinned %s", ErrMismatch, addr, fingerprint, pinned)
+		}
+
+		return false, nil
+	}
+
+	if mode != ModeTOFU {
+		return false, fmt.Errorf("%w: %s presented %s", ErrNotPinned, addr, fingerprint)
+	}
+
+	kh.pins[addr] = fingerprint
+	if err := kh.save(); err != nil {
+		delete(kh.pins, addr)
+		return false, fmt.Errorf("pin %s: %w", addr, err)
+	}
+
+	return true, nil
+}
+
+// Returns a function that verifies the certificate of the exporter at an
+// address against its pin, that can be used in the TLS config
+func (kh *KnownHosts) Verifier(logger *zap.Logger, addr string, mode Mode) func(*x509.Certificate) error {
+	return func(cert *x509.Certificate) error {
+		pinned, err := kh.Verify(addr, cert, mode)
+		if err != nil {
+			logger.Error("exporter pin verification failed", zap.Error(err))
+			return err
+		}
+
+		if pinned {
+			logger.Warn("pinned exporter on first use",
+				zap.String("address", addr),
+				zap.String("fingerprint", Fingerprint(cert)))
+		}
+
+		return nil
+	}
+}
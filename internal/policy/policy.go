@@ -0,0 +1,278 @@
+package policy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+
+	"github.com/tobias-urdin/snapback/internal/pins"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Right is what a client is allowed to do with an image
+type Right string
+
+const (
+	// List the images in a pool and the snapshots of an image
+	RightList Right = "list"
+
+	// Export an image
+	RightExport Right = "export"
+)
+
+// Rule gives a client rights on the images in a pool
+type Rule struct {
+	// Glob pattern for the pool
+	Pool string `yaml:"pool"`
+
+	// Glob patterns for the RBD namespaces in the pool, only the default
+	// namespace if empty. The default namespace is the empty string so
+	// "*" matches all namespaces including the default namespace.
+	Namespaces []string `yaml:"namespaces"`
+
+	// Glob patterns for the images in the pool, all images if empty
+	Images []string `yaml:"images"`
+
+	// The rights on the images
+	Rights []Right `yaml:"rights"`
+}
+
+// Identity of a client, the client matches if any of the identities
+// in its certificate is listed.
+type Identity struct {
+	// Certificate subject, either the common name or the full
+	// distinguished name
+	Subjects []string `yaml:"subjects"`
+
+	// DNS names, IP addresses, email addresses or URIs in the certificate
+	SANs []string `yaml:"sans"`
+
+	// Fingerprint of the certificate public key in the format used
+	// in the known hosts file
+	Fingerprints []string `yaml:"fingerprints"`
+}
+
+// Client in the policy
+type Client struct {
+	// The name of the client, used when logging access decisions
+	Name string `yaml:"name"`
+
+	// The identities that is this client
+	Match Identity `yaml:"match"`
+
+	// The rules for the client
+	Rules []Rule `yaml:"rules"`
+}
+
+// Policy decides which pools and images a client can access, clients
+// that is not in the policy has no access. The policy is loaded from a
+// YAML file
+//
+//	clients:
+//	  - name: backup
+//	    match:
+//	      subjects: [importer]
+//	    rules:
+//	      - pool: volumes
+//	        images: ["volume-*"]
+//	        rights: [list, export]
+//	      - pool: tenants
+//	        namespaces: ["tenant-a"]
+//	        rights: [list]
+type Policy struct {
+	// The clients in the policy, the first client that matches is used
+	Clients []Client `yaml:"clients"`
+}
+
+// Load the policy from a file
+func Load(path string) (*Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", path, err)
+	}
+
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %w", path, err)
+	}
+
+	return &p, nil
+}
+
+// Returns an error if a pattern or right in the policy is invalid
+func (p *Policy) validate() error {
+	for _, client := range p.Clients {
+		if client.Name == "" {
+			return errors.New("client without a name")
+		}
+
+		id := client.Match
+		if len(id.Subjects) == 0 && len(id.SANs) == 0 && len(id.Fingerprints) == 0 {
+			return fmt.Errorf("client %s does not match any identity", client.Name)
+		}
+
+		for _, rule := range client.Rules {
+			patterns := append([]string{rule.Pool}, rule.Namespaces...)
+			patterns = append(patterns, rule.Images...)
+			for _, pattern := range patterns {
+				if _, err := path.Match(pattern, ""); err != nil {
+					return fmt.Errorf("client %s: pattern %q: %w", client.Name, pattern, err)
+				}
+			}
+
+			for _, right := range rule.Rights {
+				if right != RightList && right != RightExport {
+					return fmt.Errorf("client %s: unknown right %q", client.Name, right)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns true if any of the values is in the list
+func containsAny(list []string, values ...string) bool {
+	for _, item := range list {
+		for _, value := range values {
+			if item == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Returns true if the certificate has one of the identities
+func (id *Identity) matches(cert *x509.Certificate) bool {
+	if containsAny(id.Subjects, cert.Subject.CommonName, cert.Subject.String()) {
+		return true
+	}
+
+	sans := append([]string{}, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	if containsAny(id.SANs, sans...) {
+		return true
+	}
+
+	return containsAny(id.Fingerprints, pins.Fingerprint(cert))
+}
+
+// Returns the client for a certificate or nil if the certificate
+// does not match any client
+func (p *Policy) Client(cert *x509.Certificate) *Client {
+	if cert == nil {
+		return nil
+	}
+
+	for idx := range p.Clients {
+		if p.Clients[idx].Match.matches(cert) {
+			return &p.Clients[idx]
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the rule gives the right on the pool
+func (r *Rule) allowsPool(pool string, right Right) bool {
+	if matched, _ := path.Match(r.Pool, pool); !matched {
+		return false
+	}
+
+	for _, rr := range r.Rights {
+		if rr == right {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the rule gives the right on the namespace in the pool
+func (r *Rule) allowsNamespace(pool string, namespace string, right Right) bool {
+	if !r.allowsPool(pool, right) {
+		return false
+	}
+
+	if len(r.Namespaces) == 0 {
+		return namespace == ""
+	}
+
+	for _, pattern := range r.Namespaces {
+		if matched, _ := path.Match(pattern, namespace); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the rule gives the right on the image
+func (r *Rule) allowsImage(pool string, namespace string, image string, right Right) bool {
+	if !r.allowsNamespace(pool, namespace, right) {
+		return false
+	}
+
+	if len(r.Images) == 0 {
+		return true
+	}
+
+	for _, pattern := range r.Images {
+		if matched, _ := path.Match(pattern, image); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the client has the right on any image in any namespace
+// of the pool
+func (c *Client) AllowsPool(pool string, right Right) bool {
+	for idx := range c.Rules {
+		if c.Rules[idx].allowsPool(pool, right) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the client has the right on any image in the namespace
+// of the pool
+func (c *Client) AllowsNamespace(pool string, namespace string, right Right) bool {
+	for idx := range c.Rules {
+		if c.Rules[idx].allowsNamespace(pool, namespace, right) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns true if the client has the right on the image
+func (c *Client) AllowsImage(pool string, namespace string, image string, right Right) bool {
+	for idx := range c.Rules {
+		if c.Rules[idx].allowsImage(pool, namespace, image, right) {
+			return true
+		}
+	}
+
+	return false
+}
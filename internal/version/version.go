@@ -0,0 +1,5 @@
+package version
+
+// The software version, overridden at build time with
+// -ldflags "-X github.com/tobias-urdin/snapback/internal/version.Version=..."
+var Version = "dev"